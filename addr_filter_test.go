@@ -0,0 +1,121 @@
+package swarm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	addrutil "github.com/libp2p/go-addr-util"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	transport "github.com/libp2p/go-libp2p-transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// stubDialTransport can dial anything over its protocols.
+type stubDialTransport struct {
+	transport.Transport
+	protocols []int
+}
+
+func (t *stubDialTransport) CanDial(addr ma.Multiaddr) bool { return true }
+
+func (t *stubDialTransport) Proxy() bool { return false }
+
+func (t *stubDialTransport) Protocols() []int { return t.protocols }
+
+// filterSwarm returns a swarm with a few transports and address filters, and
+// 100 addresses of all kinds to filter.
+func filterSwarm(tb testing.TB, ctx context.Context) (*Swarm, []ma.Multiaddr) {
+	s := NewSwarm(ctx, peer.ID("self"), pstoremem.NewPeerstore(), nil)
+	for _, protos := range [][]int{{ma.P_TCP}, {ma.P_QUIC}, {ma.P_UTP}, {ma.P_UDT}} {
+		if err := s.AddTransport(&stubDialTransport{protocols: protos}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := s.AddAddrFilter("/ip4/10.0.0.0/ipcidr/8"); err != nil {
+		tb.Fatal(err)
+	}
+
+	var addrs []ma.Multiaddr
+	for i := 0; len(addrs) < 100; i++ {
+		addrs = append(addrs,
+			ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/tcp/%d", i, 4000+i)),
+			ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/udp/%d/quic", i, 4000+i)),
+			ma.StringCast(fmt.Sprintf("/ip6/2001:db8::%x/tcp/%d", i, 4000+i)),
+			ma.StringCast(fmt.Sprintf("/ip4/10.0.0.%d/tcp/%d", i, 4000+i)), // blocked
+			ma.StringCast(fmt.Sprintf("/ip6/fe80::%x/tcp/%d", i, 4000+i)),  // link-local
+			ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/udp/%d", i, 4000+i)),  // no transport
+			ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/sctp/%d", i, 4000+i)), // no transport
+			ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/udp/%d/utp", i, 4000+i)),
+			ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/udp/%d/udt", i, 4000+i)),
+			ma.StringCast(fmt.Sprintf("/ip6/2001:db8::%x/udp/%d/quic", i, 4000+i)),
+		)
+	}
+	return s, addrs
+}
+
+// filterKnownUndialablesPerAddr is filterKnownUndialables, looking up the
+// transport of every address.
+func (s *Swarm) filterKnownUndialablesPerAddr(addrs []ma.Multiaddr) []ma.Multiaddr {
+	var fs []func(ma.Multiaddr) bool
+	for _, f := range s.undialableFilters() {
+		if f.reason == "no transport" {
+			f.keep = s.canDial
+		}
+		fs = append(fs, f.keep)
+	}
+	return addrutil.FilterAddrs(addrs, fs...)
+}
+
+func TestFilterKnownUndialablesBatched(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, addrs := filterSwarm(t, ctx)
+	defer s.Close()
+
+	check := func() {
+		t.Helper()
+		expected := s.filterKnownUndialablesPerAddr(addrs)
+		got := s.filterKnownUndialables(addrs)
+		if len(got) != len(expected) {
+			t.Fatalf("expected %d addresses, got %d", len(expected), len(got))
+		}
+		for i := range expected {
+			if !got[i].Equal(expected[i]) {
+				t.Fatalf("expected %s at %d, got %s", expected[i], i, got[i])
+			}
+		}
+	}
+	check()
+	if n := len(s.filterKnownUndialables(addrs)); n != 60 {
+		t.Fatalf("expected 60 dialable addresses, got %d", n)
+	}
+
+	// a selector bypasses the cache.
+	s.SetTransportSelector(func(addr ma.Multiaddr, candidates []transport.Transport) transport.Transport {
+		if addr.String() == addrs[0].String() {
+			return nil
+		}
+		return candidates[0]
+	})
+	check()
+}
+
+func BenchmarkFilterKnownUndialables(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, addrs := filterSwarm(b, ctx)
+	defer s.Close()
+
+	b.Run("per-address", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.filterKnownUndialablesPerAddr(addrs)
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.filterKnownUndialables(addrs)
+		}
+	})
+}
@@ -0,0 +1,442 @@
+package swarm
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// addrScoresVersion is the version of the format written by
+// AddrScoreboard.Export.
+const addrScoresVersion = 1
+
+// AddrScoreboard is a type for tracking how well dialing individual peer
+// addresses has worked out in the past. The swarm uses it to try known-good
+// addresses first.
+//
+// * It's safe to use its zero value.
+// * It's thread-safe.
+// * It's *not* safe to move this type after using.
+//
+// Failures are forgotten over time so an address that failed for a while gets
+// another chance: the number of failures is halved every
+// AddrFailureHalfLife (see SetFailureHalfLife).
+//
+// It tracks at most DefaultMaxAddrScorePeers peers (see SetMaxEntries) and
+// DefaultMaxAddrScoresPerPeer addresses per peer (see SetMaxAddrsPerPeer),
+// forgetting the least recently scored ones first.
+type AddrScoreboard struct {
+	entries map[peer.ID]*peerAddrScores
+	// lru holds the entries, least recently scored first.
+	lru        list.List
+	maxEntries int
+	maxAddrs   int
+	halfLife   time.Duration
+	lock       sync.Mutex
+}
+
+// DefaultMaxAddrScorePeers is the default maximum number of peers an
+// AddrScoreboard tracks.
+const DefaultMaxAddrScorePeers = 10000
+
+// DefaultMaxAddrScoresPerPeer is the default maximum number of addresses an
+// AddrScoreboard tracks per peer.
+const DefaultMaxAddrScoresPerPeer = 64
+
+// AddrFailureHalfLife is the default time it takes for an address's number of
+// failed dials to be halved.
+var AddrFailureHalfLife = 10 * time.Minute
+
+type peerAddrScores struct {
+	id peer.ID
+	// imported is true if these scores were imported and haven't yet been
+	// checked against the peer's current addresses.
+	imported bool
+	addrs    map[string]*addrScore
+	elem     *list.Element
+}
+
+type addrScore struct {
+	successes int
+	failures  int
+	rtt       time.Duration
+	// lastFailure is when failures was last updated.
+	lastFailure time.Time
+	// updated is when a dial was last recorded (or imported).
+	updated time.Time
+}
+
+// decayed returns a copy of the score with its failures decayed to now.
+func (a *addrScore) decayed(now time.Time, halfLife time.Duration) *addrScore {
+	if a == nil {
+		return nil
+	}
+	d := *a
+	d.failures = a.decayedFailures(now, halfLife)
+	return &d
+}
+
+func (a *addrScore) decayedFailures(now time.Time, halfLife time.Duration) int {
+	if a.failures == 0 {
+		return 0
+	}
+	halvings := now.Sub(a.lastFailure) / halfLife
+	if halvings >= 32 {
+		return 0
+	}
+	return a.failures >> uint(halvings)
+}
+
+// better returns true if the address with score a should be dialed before the
+// address with score b. Addresses we know nothing about have a nil score.
+func (a *addrScore) better(b *addrScore) bool {
+	var as, bs int
+	if a != nil {
+		as = a.successes - a.failures
+	}
+	if b != nil {
+		bs = b.successes - b.failures
+	}
+	if as != bs {
+		return as > bs
+	}
+	// Same score, prefer the lower (known) latency.
+	if a == nil || a.rtt == 0 {
+		return false
+	}
+	return b == nil || b.rtt == 0 || a.rtt < b.rtt
+}
+
+// SetFailureHalfLife sets the time it takes for an address's number of failed
+// dials to be halved, overriding AddrFailureHalfLife. A duration <= 0
+// restores the default.
+func (sb *AddrScoreboard) SetFailureHalfLife(d time.Duration) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	sb.halfLife = d
+}
+
+func (sb *AddrScoreboard) failureHalfLife() time.Duration {
+	if sb.halfLife > 0 {
+		return sb.halfLife
+	}
+	return AddrFailureHalfLife
+}
+
+func (sb *AddrScoreboard) init() {
+	if sb.entries == nil {
+		sb.entries = make(map[peer.ID]*peerAddrScores)
+	}
+}
+
+// SetMaxEntries sets the maximum number of peers tracked. Once it's reached,
+// the least recently scored peers are forgotten. A limit <= 0 restores the
+// default (DefaultMaxAddrScorePeers).
+func (sb *AddrScoreboard) SetMaxEntries(n int) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	sb.init()
+	sb.maxEntries = n
+	sb.evict()
+}
+
+// SetMaxAddrsPerPeer sets the maximum number of addresses tracked per peer.
+// Once it's reached, the least recently scored addresses of the peer are
+// forgotten. A limit <= 0 restores the default
+// (DefaultMaxAddrScoresPerPeer).
+func (sb *AddrScoreboard) SetMaxAddrsPerPeer(n int) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	sb.maxAddrs = n
+	for _, ps := range sb.entries {
+		sb.evictAddrs(ps, "")
+	}
+}
+
+// score returns the score of address a of peer p, creating it if needed, and
+// marks it as the most recently scored. sb.lock must be held.
+func (sb *AddrScoreboard) score(p peer.ID, a ma.Multiaddr) *addrScore {
+	sb.init()
+	ps, ok := sb.entries[p]
+	if !ok {
+		ps = &peerAddrScores{id: p, addrs: make(map[string]*addrScore)}
+		ps.elem = sb.lru.PushBack(ps)
+		sb.entries[p] = ps
+	} else {
+		sb.lru.MoveToBack(ps.elem)
+	}
+	key := string(a.Bytes())
+	s, ok := ps.addrs[key]
+	if !ok {
+		s = new(addrScore)
+		ps.addrs[key] = s
+	}
+	s.updated = time.Now()
+	sb.evictAddrs(ps, key)
+	sb.evict()
+	return s
+}
+
+// evict forgets the least recently scored peers until we're within the
+// limit. sb.lock must be held.
+func (sb *AddrScoreboard) evict() {
+	max := sb.maxEntries
+	if max <= 0 {
+		max = DefaultMaxAddrScorePeers
+	}
+	for len(sb.entries) > max {
+		sb.remove(sb.lru.Front().Value.(*peerAddrScores))
+	}
+}
+
+// evictAddrs forgets the least recently scored addresses of ps, other than
+// keep, until it's within the limit. sb.lock must be held.
+func (sb *AddrScoreboard) evictAddrs(ps *peerAddrScores, keep string) {
+	max := sb.maxAddrs
+	if max <= 0 {
+		max = DefaultMaxAddrScoresPerPeer
+	}
+	for len(ps.addrs) > max {
+		var oldest string
+		var oldestScore *addrScore
+		for a, s := range ps.addrs {
+			if a != keep && (oldestScore == nil || s.updated.Before(oldestScore.updated)) {
+				oldest, oldestScore = a, s
+			}
+		}
+		delete(ps.addrs, oldest)
+	}
+}
+
+func (sb *AddrScoreboard) remove(ps *peerAddrScores) {
+	sb.lru.Remove(ps.elem)
+	delete(sb.entries, ps.id)
+}
+
+// AddSuccess records a successful dial to peer p on address a that took rtt.
+func (sb *AddrScoreboard) AddSuccess(p peer.ID, a ma.Multiaddr, rtt time.Duration) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	s := sb.score(p, a)
+	s.successes++
+	s.rtt = rtt
+}
+
+// AddFailure records a failed dial to peer p on address a.
+func (sb *AddrScoreboard) AddFailure(p peer.ID, a ma.Multiaddr) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	now := time.Now()
+	s := sb.score(p, a)
+	s.failures = s.decayedFailures(now, sb.failureHalfLife()) + 1
+	s.lastFailure = now
+}
+
+// Clear removes all scores for peer p.
+func (sb *AddrScoreboard) Clear(p peer.ID) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	if ps, ok := sb.entries[p]; ok {
+		sb.remove(ps)
+	}
+}
+
+// SortAddrs sorts the given addresses of peer p in place, best first.
+// Addresses we know nothing about are sorted after addresses that have worked
+// but before addresses that have mostly failed (recently). The relative order
+// of equally scored addresses is preserved.
+func (sb *AddrScoreboard) SortAddrs(p peer.ID, addrs []ma.Multiaddr) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	if _, ok := sb.entries[p]; !ok {
+		return
+	}
+	sort.Stable(&addrsByScore{addrs, sb.scores(p, addrs)})
+}
+
+// scores returns the current scores of the given addresses of peer p, nil
+// for the addresses we know nothing about. sb.lock must be held.
+func (sb *AddrScoreboard) scores(p peer.ID, addrs []ma.Multiaddr) []*addrScore {
+	scores := make([]*addrScore, len(addrs))
+	ps, ok := sb.entries[p]
+	if !ok {
+		return scores
+	}
+	now, halfLife := time.Now(), sb.failureHalfLife()
+	for i, a := range addrs {
+		scores[i] = ps.addrs[string(a.Bytes())].decayed(now, halfLife)
+	}
+	return scores
+}
+
+// successRates estimates, for each of the given addresses of peer p, the
+// probability that dialing it succeeds from its dial history. It's 1/2 for
+// addresses we know nothing about and moves towards the observed success
+// rate as dials are recorded.
+func (sb *AddrScoreboard) successRates(p peer.ID, addrs []ma.Multiaddr) []float64 {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	rates := make([]float64, len(addrs))
+	for i, s := range sb.scores(p, addrs) {
+		var successes, failures int
+		if s != nil {
+			successes, failures = s.successes, s.failures
+		}
+		rates[i] = float64(successes+1) / float64(successes+failures+2)
+	}
+	return rates
+}
+
+// ties returns, for each of the given (sorted) addresses of peer p, whether
+// it's scored the same as the one before it.
+func (sb *AddrScoreboard) ties(p peer.ID, addrs []ma.Multiaddr) []bool {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	scores := sb.scores(p, addrs)
+	ties := make([]bool, len(addrs))
+	for i := 1; i < len(addrs); i++ {
+		ties[i] = !scores[i-1].better(scores[i]) && !scores[i].better(scores[i-1])
+	}
+	return ties
+}
+
+type addrsByScore struct {
+	addrs  []ma.Multiaddr
+	scores []*addrScore
+}
+
+func (s *addrsByScore) Len() int           { return len(s.addrs) }
+func (s *addrsByScore) Less(i, j int) bool { return s.scores[i].better(s.scores[j]) }
+func (s *addrsByScore) Swap(i, j int) {
+	s.addrs[i], s.addrs[j] = s.addrs[j], s.addrs[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+
+// dropUnknown discards imported scores for addresses of peer p that aren't
+// in addrs (the peer's current addresses). It only does so the first time
+// imported scores are used.
+func (sb *AddrScoreboard) dropUnknown(p peer.ID, addrs []ma.Multiaddr) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	ps, ok := sb.entries[p]
+	if !ok || !ps.imported {
+		return
+	}
+	ps.imported = false
+
+	known := make(map[string]struct{}, len(addrs))
+	for _, a := range addrs {
+		known[string(a.Bytes())] = struct{}{}
+	}
+	for a := range ps.addrs {
+		if _, ok := known[a]; !ok {
+			delete(ps.addrs, a)
+		}
+	}
+}
+
+// exportedAddrScores is the serialized form of an AddrScoreboard.
+type exportedAddrScores struct {
+	Version int                                     `json:"v"`
+	Peers   map[string]map[string]exportedAddrScore `json:"p"`
+}
+
+type exportedAddrScore struct {
+	Successes int   `json:"s,omitempty"`
+	Failures  int   `json:"f,omitempty"`
+	RTT       int64 `json:"r,omitempty"`
+	// LastFailure is in nanoseconds since the epoch.
+	LastFailure int64 `json:"l,omitempty"`
+}
+
+// Export writes the scoreboard to w so it can be restored with Import (e.g.,
+// after a restart).
+func (sb *AddrScoreboard) Export(w io.Writer) error {
+	sb.lock.Lock()
+	out := exportedAddrScores{
+		Version: addrScoresVersion,
+		Peers:   make(map[string]map[string]exportedAddrScore, len(sb.entries)),
+	}
+	for p, ps := range sb.entries {
+		addrs := make(map[string]exportedAddrScore, len(ps.addrs))
+		for a, s := range ps.addrs {
+			maddr, err := ma.NewMultiaddrBytes([]byte(a))
+			if err != nil {
+				continue
+			}
+			es := exportedAddrScore{
+				Successes: s.successes,
+				Failures:  s.failures,
+				RTT:       int64(s.rtt),
+			}
+			if s.failures > 0 {
+				es.LastFailure = s.lastFailure.UnixNano()
+			}
+			addrs[maddr.String()] = es
+		}
+		out.Peers[peer.IDB58Encode(p)] = addrs
+	}
+	sb.lock.Unlock()
+
+	return json.NewEncoder(w).Encode(&out)
+}
+
+// Import reads scores written by Export from r and merges them into the
+// scoreboard. Imported scores for addresses that are no longer known to the
+// peerstore are discarded the first time the swarm dials the peer.
+func (sb *AddrScoreboard) Import(r io.Reader) error {
+	var in exportedAddrScores
+	if err := json.NewDecoder(r).Decode(&in); err != nil {
+		return err
+	}
+	if in.Version != addrScoresVersion {
+		return fmt.Errorf("unsupported address scoreboard version: %d", in.Version)
+	}
+
+	type imported struct {
+		p      peer.ID
+		a      ma.Multiaddr
+		scores exportedAddrScore
+	}
+	var entries []imported
+	for pstr, addrs := range in.Peers {
+		p, err := peer.IDB58Decode(pstr)
+		if err != nil {
+			return err
+		}
+		for astr, es := range addrs {
+			a, err := ma.NewMultiaddr(astr)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, imported{p, a, es})
+		}
+	}
+
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	now := time.Now()
+	for _, e := range entries {
+		s := sb.score(e.p, e.a)
+		s.successes = e.scores.Successes
+		s.failures = e.scores.Failures
+		s.rtt = time.Duration(e.scores.RTT)
+		// Older exports don't say when the failures happened, start
+		// decaying them now.
+		s.lastFailure = now
+		if e.scores.LastFailure != 0 {
+			s.lastFailure = time.Unix(0, e.scores.LastFailure)
+		}
+		sb.entries[e.p].imported = true
+	}
+	return nil
+}
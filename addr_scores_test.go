@@ -0,0 +1,185 @@
+package swarm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	testutil "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// closedPortAddr returns a local address nobody is listening on.
+func closedPortAddr(t *testing.T) ma.Multiaddr {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr, err := manet.FromNetAddr(l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestAddrScoreboardExportImport(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	p := testutil.RandPeerIDFatal(t)
+	good := closedPortAddr(t)
+	bad := closedPortAddr(t)
+	stale := closedPortAddr(t)
+
+	sb := s1.AddrScoreboard()
+	sb.AddSuccess(p, good, 10*time.Millisecond)
+	sb.AddFailure(p, bad)
+	sb.AddFailure(p, bad)
+	sb.AddSuccess(p, stale, time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := sb.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.AddrScoreboard().Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := []ma.Multiaddr{bad, good}
+	s2.AddrScoreboard().SortAddrs(p, addrs)
+	if !addrs[0].Equal(good) || !addrs[1].Equal(bad) {
+		t.Fatalf("expected imported scores to rank %s first, got %s", good, addrs)
+	}
+
+	// The stale address isn't in the peerstore anymore so it should be
+	// dropped the first time we dial the peer.
+	s2.Peerstore().AddAddrs(p, []ma.Multiaddr{good, bad}, pstore.PermanentAddrTTL)
+	if _, err := s2.DialPeer(ctx, p); err == nil {
+		t.Fatal("dial should have failed")
+	}
+
+	buf.Reset()
+	if err := s2.AddrScoreboard().Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exported := buf.String()
+	if strings.Contains(exported, stale.String()) {
+		t.Fatal("stale address should have been dropped")
+	}
+	if !strings.Contains(exported, good.String()) {
+		t.Fatal("known address should have been kept")
+	}
+}
+
+func TestAddrScoreboardImportVersion(t *testing.T) {
+	ctx := context.Background()
+	s := makeSwarms(ctx, t, 1)[0]
+	defer s.Close()
+
+	data, err := json.Marshal(map[string]interface{}{"v": 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddrScoreboard().Import(bytes.NewReader(data)); err == nil {
+		t.Fatal("importing an unknown version should fail")
+	}
+}
+
+func TestAddrScoreFailuresDecay(t *testing.T) {
+	ctx := context.Background()
+	s := makeSwarms(ctx, t, 1)[0]
+	defer s.Close()
+
+	const halfLife = 50 * time.Millisecond
+	sb := s.AddrScoreboard()
+	sb.SetFailureHalfLife(halfLife)
+
+	p := testutil.RandPeerIDFatal(t)
+	bad, other := closedPortAddr(t), closedPortAddr(t)
+	for i := 0; i < 3; i++ {
+		sb.AddFailure(p, bad)
+	}
+
+	addrs := []ma.Multiaddr{bad, other}
+	sb.SortAddrs(p, addrs)
+	if !addrs[0].Equal(other) {
+		t.Fatalf("expected the failing address to be tried last, got %s", addrs)
+	}
+
+	// 3 failures are forgotten after two half-lives.
+	time.Sleep(2*halfLife + 10*time.Millisecond)
+	addrs = []ma.Multiaddr{bad, other}
+	sb.SortAddrs(p, addrs)
+	if !addrs[0].Equal(bad) {
+		t.Fatalf("expected the failures to have decayed, got %s", addrs)
+	}
+}
+
+func TestAddrScoreboardMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	s := makeSwarms(ctx, t, 1)[0]
+	defer s.Close()
+
+	const max = 3
+	sb := s.AddrScoreboard()
+	sb.SetMaxEntries(max)
+
+	bad, other := closedPortAddr(t), closedPortAddr(t)
+	peers := make([]peer.ID, 2*max)
+	for i := range peers {
+		peers[i] = testutil.RandPeerIDFatal(t)
+		sb.AddFailure(peers[i], bad)
+	}
+	// scoring an old peer again makes it recent.
+	sb.AddFailure(peers[max], bad)
+	sb.AddFailure(peers[0], bad)
+
+	// forgotten peers' addresses keep their order.
+	remembered := map[peer.ID]bool{peers[0]: true, peers[max]: true, peers[2*max-1]: true}
+	for _, p := range peers {
+		addrs := []ma.Multiaddr{bad, other}
+		sb.SortAddrs(p, addrs)
+		if got := addrs[0].Equal(other); got != remembered[p] {
+			t.Fatalf("expected %s to be remembered: %t", p, remembered[p])
+		}
+	}
+}
+
+func TestAddrScoreboardMaxAddrsPerPeer(t *testing.T) {
+	ctx := context.Background()
+	s := makeSwarms(ctx, t, 1)[0]
+	defer s.Close()
+
+	sb := s.AddrScoreboard()
+	sb.SetMaxAddrsPerPeer(2)
+
+	p := testutil.RandPeerIDFatal(t)
+	a1, a2, a3, other := closedPortAddr(t), closedPortAddr(t), closedPortAddr(t), closedPortAddr(t)
+	sb.AddFailure(p, a1)
+	sb.AddFailure(p, a2)
+	sb.AddFailure(p, a3)
+
+	// a1 was scored first, it's forgotten.
+	addrs := []ma.Multiaddr{a1, other}
+	sb.SortAddrs(p, addrs)
+	if !addrs[0].Equal(a1) {
+		t.Fatalf("expected the least recently scored address to be forgotten, got %s", addrs)
+	}
+	for _, a := range []ma.Multiaddr{a2, a3} {
+		addrs := []ma.Multiaddr{a, other}
+		sb.SortAddrs(p, addrs)
+		if !addrs[0].Equal(other) {
+			t.Fatalf("expected the failures of %s to be remembered, got %s", a, addrs)
+		}
+	}
+}
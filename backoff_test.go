@@ -0,0 +1,272 @@
+package swarm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+)
+
+func TestDialBackoffMaxEntries(t *testing.T) {
+	defer func(base time.Duration) { BackoffBase = base }(BackoffBase)
+
+	const max = 10
+	var db DialBackoff
+	db.SetMaxEntries(max)
+
+	peerN := func(i int) peer.ID { return peer.ID(fmt.Sprintf("peer%d", i)) }
+
+	// these are the least recently backed off, evicted first.
+	BackoffBase = time.Millisecond
+	for i := 0; i < max; i++ {
+		db.AddBackoff(peerN(i))
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	BackoffBase = time.Minute
+	for i := max; i < 3*max; i++ {
+		db.AddBackoff(peerN(i))
+		if n := len(db.entries); n > max {
+			t.Fatalf("expected at most %d entries, got %d", max, n)
+		}
+		if n := db.lru.Len(); n != len(db.entries) {
+			t.Fatalf("lru has %d entries, map has %d", n, len(db.entries))
+		}
+	}
+
+	// the most recently backed off peers are retained.
+	for i := 2 * max; i < 3*max; i++ {
+		if !db.Backoff(peerN(i)) {
+			t.Fatalf("expected %s to still be backed off", peerN(i))
+		}
+	}
+
+	// backing off an old peer again makes it recent.
+	db.AddBackoff(peerN(2 * max))
+	db.AddBackoff(peerN(3 * max))
+	if !db.Backoff(peerN(2 * max)) {
+		t.Fatal("expected a re-added peer to be retained")
+	}
+	if db.Backoff(peerN(2*max + 1)) {
+		t.Fatal("expected the least recently backed off peer to be evicted")
+	}
+
+	db.Clear(peerN(3 * max))
+	if n := db.lru.Len(); n != len(db.entries) || n != max-1 {
+		t.Fatalf("expected %d entries after clearing one, got %d (lru %d)", max-1, len(db.entries), n)
+	}
+}
+
+func TestDialBackoffExpiredNotEvicted(t *testing.T) {
+	var db DialBackoff
+	db.SetBase(time.Millisecond)
+	db.SetCoef(time.Second)
+
+	a, b := peer.ID("a"), peer.ID("b")
+	db.AddBackoff(a)
+	time.Sleep(10 * time.Millisecond)
+	if db.Backoff(a) {
+		t.Fatal("expected a's backoff to have expired")
+	}
+
+	// backing off b doesn't forget a, a's escalation continues.
+	db.AddBackoff(b)
+	db.AddBackoff(a)
+	bp := db.entries[a]
+	if bp.tries != 2 {
+		t.Fatalf("expected a second try for a, got %d", bp.tries)
+	}
+}
+
+func TestBackoffSweep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewSwarm(ctx, peer.ID("self"), pstoremem.NewPeerstore(), nil,
+		WithBackoffBase(time.Millisecond),
+		WithBackoffMax(20*time.Millisecond),
+	)
+	defer s.Close()
+
+	for i := 0; i < 5; i++ {
+		s.backf.AddBackoff(peer.ID(fmt.Sprintf("peer%d", i)))
+	}
+	numEntries := func() int {
+		s.backf.lock.Lock()
+		defer s.backf.lock.Unlock()
+		return len(s.backf.entries)
+	}
+	if n := numEntries(); n != 5 {
+		t.Fatalf("expected 5 entries, got %d", n)
+	}
+
+	s.SetBackoffSweepInterval(10 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for numEntries() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected expired entries to be swept, %d left", numEntries())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// recently backed off peers are kept even once their backoff expired.
+	s.backf.SetMax(time.Minute)
+	s.backf.AddBackoff(peer.ID("recent"))
+	time.Sleep(50 * time.Millisecond)
+	if n := numEntries(); n != 1 {
+		t.Fatalf("expected the recent entry to be kept, got %d entries", n)
+	}
+}
+
+func TestDialBackoffExportImport(t *testing.T) {
+	var db DialBackoff
+	db.AddBackoff(peer.ID("a"))
+	db.AddBackoff(peer.ID("b"))
+	db.AddBackoff(peer.ID("b"))
+
+	records := db.Export()
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[0].Peer != "a" || records[1].Peer != "b" || records[1].Tries != 2 {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	records = append(records, BackoffRecord{Peer: "expired", Tries: 3, Until: time.Now().Add(-time.Second)})
+
+	var restored DialBackoff
+	restored.Import(records)
+	for _, p := range []peer.ID{"a", "b"} {
+		if !restored.Backoff(p) {
+			t.Fatalf("expected %s to be backed off", p)
+		}
+	}
+	if restored.Backoff("expired") {
+		t.Fatal("expired records shouldn't be imported")
+	}
+	if n := len(restored.entries); n != 2 {
+		t.Fatalf("expected 2 entries, got %d", n)
+	}
+	if bp := restored.entries["b"]; bp.tries != 2 || !bp.until.Equal(records[1].Until) {
+		t.Fatalf("expected b's state to be restored, got %d tries until %s", bp.tries, bp.until)
+	}
+}
+
+func TestBackoffConfigPerSwarm(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := NewSwarm(ctx, peer.ID("s1"), pstoremem.NewPeerstore(), nil,
+		WithBackoffBase(time.Millisecond),
+		WithBackoffCoef(time.Millisecond),
+		WithBackoffMax(5*time.Millisecond),
+	)
+	defer s1.Close()
+	s2 := NewSwarm(ctx, peer.ID("s2"), pstoremem.NewPeerstore(), nil,
+		WithBackoffBase(time.Hour),
+	)
+	defer s2.Close()
+
+	// changing the defaults doesn't affect existing swarms.
+	defer func(base time.Duration) { BackoffBase = base }(BackoffBase)
+	BackoffBase = time.Nanosecond
+
+	p := peer.ID("remote")
+	for i := 0; i < 3; i++ {
+		s1.Backoff().AddBackoff(p)
+		s2.Backoff().AddBackoff(p)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if s1.Backoff().Backoff(p) {
+		t.Fatal("s1's backoff should be capped at 5ms")
+	}
+	if !s2.Backoff().Backoff(p) {
+		t.Fatal("s2 should still be backing off")
+	}
+}
+
+func TestDialBackoffPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewSwarm(ctx, peer.ID("self"), pstoremem.NewPeerstore(), nil, WithBackoffBase(time.Minute))
+	defer s.Close()
+
+	for _, p := range []peer.ID{"a", "b", "c"} {
+		s.backf.AddBackoff(p)
+	}
+	s.backf.Import([]BackoffRecord{{Peer: "expiring", Tries: 1, Until: time.Now().Add(20 * time.Millisecond)}})
+	time.Sleep(50 * time.Millisecond)
+
+	peers := s.BackedOffPeers()
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	if len(peers) != 3 || peers[0] != "a" || peers[1] != "b" || peers[2] != "c" {
+		t.Fatalf("expected peers a, b and c, got %v", peers)
+	}
+}
+
+func TestDialBackoffResetTries(t *testing.T) {
+	var db DialBackoff
+	db.SetBase(time.Second)
+	db.SetCoef(time.Minute)
+	db.SetMax(time.Hour)
+
+	p := peer.ID("a")
+	for i := 0; i < 5; i++ {
+		db.AddBackoff(p)
+	}
+	bp := db.entries[p]
+	if d := bp.until.Sub(bp.last); d != time.Second+16*time.Minute {
+		t.Fatalf("expected a %s backoff, got %s", time.Second+16*time.Minute, d)
+	}
+
+	until := bp.until
+	db.ResetTries(p)
+	if bp.tries != 0 || !bp.until.Equal(until) {
+		t.Fatalf("expected no tries until %s, got %d tries until %s", until, bp.tries, bp.until)
+	}
+
+	// the next failure only incurs the base backoff, then escalates again.
+	db.AddBackoff(p)
+	if d := bp.until.Sub(bp.last); d != time.Second {
+		t.Fatalf("expected a %s backoff, got %s", time.Second, d)
+	}
+	db.AddBackoff(p)
+	if d := bp.until.Sub(bp.last); d != time.Second+time.Minute {
+		t.Fatalf("expected a %s backoff, got %s", time.Second+time.Minute, d)
+	}
+
+	// unknown peers are left alone.
+	db.ResetTries(peer.ID("b"))
+	if db.Backoff(peer.ID("b")) {
+		t.Fatal("b shouldn't be backed off")
+	}
+}
+
+func TestDialBackoffFloor(t *testing.T) {
+	var db DialBackoff
+	db.SetBase(time.Second)
+	db.SetCoef(time.Second)
+	db.SetMax(5 * time.Second)
+	db.SetFloor(10 * time.Second)
+
+	p := peer.ID("a")
+	db.AddBackoff(p)
+	bp := db.entries[p]
+	if d := bp.until.Sub(bp.last); d != 10*time.Second {
+		t.Fatalf("expected the first backoff to be raised to the floor, got %s", d)
+	}
+	db.ResetTries(p)
+	db.AddBackoff(p)
+	if d := bp.until.Sub(bp.last); d != 10*time.Second {
+		t.Fatalf("expected the floor to apply after resetting tries, got %s", d)
+	}
+
+	// above the floor, the backoff escalates as usual.
+	db.SetFloor(0)
+	db.AddBackoff(p)
+	if d := bp.until.Sub(bp.last); d != 2*time.Second {
+		t.Fatalf("expected a 2s backoff, got %s", d)
+	}
+}
@@ -1,6 +1,8 @@
 package swarm
 
 import (
+	"sort"
+
 	peer "github.com/libp2p/go-libp2p-peer"
 	ma "github.com/multiformats/go-multiaddr"
 )
@@ -19,3 +21,51 @@ type BestConn interface {
 type BestDest interface {
 	BestDestSelect(peer.ID, []ma.Multiaddr) []ma.Multiaddr
 }
+
+// AddrDialOrder is called with the addresses of a peer we're about to dial,
+// after they've been filtered and ranked, and returns them in the order in
+// which they should be dialed. It may also drop addresses. Addresses it
+// wasn't given are ignored. If it returns no (given) addresses, the swarm
+// dials the addresses it was given.
+type AddrDialOrder func(peer.ID, []ma.Multiaddr) []ma.Multiaddr
+
+// AddressFamilyPreference tells the swarm which IP address family to dial
+// first when a peer has both IPv4 and IPv6 addresses.
+type AddressFamilyPreference int
+
+const (
+	// NoPreference dials addresses in the order they're ranked in.
+	NoPreference AddressFamilyPreference = iota
+	// PreferIPv6 dials IPv6 addresses before IPv4 addresses.
+	PreferIPv6
+	// PreferIPv4 dials IPv4 addresses before IPv6 addresses.
+	PreferIPv4
+)
+
+// sortAddrs stably sorts addrs so that addresses of the preferred family come
+// first. Other addresses are kept, in their original order.
+func (pref AddressFamilyPreference) sortAddrs(addrs []ma.Multiaddr) {
+	if pref == NoPreference {
+		return
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return pref.prefers(addrs[i]) && !pref.prefers(addrs[j])
+	})
+}
+
+// prefers returns true if a is of the preferred family.
+func (pref AddressFamilyPreference) prefers(a ma.Multiaddr) bool {
+	switch pref {
+	case PreferIPv6:
+		return isFamily(a, ma.P_IP6)
+	case PreferIPv4:
+		return isFamily(a, ma.P_IP4)
+	default:
+		return false
+	}
+}
+
+func isFamily(a ma.Multiaddr, code int) bool {
+	protos := a.Protocols()
+	return len(protos) > 0 && protos[0].Code == code
+}
@@ -0,0 +1,94 @@
+package swarm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	transport "github.com/libp2p/go-libp2p-transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// stubListener pretends to listen on addr.
+type stubListener struct {
+	transport.Listener
+	addr ma.Multiaddr
+}
+
+func (l *stubListener) Multiaddr() ma.Multiaddr { return l.addr }
+
+func (l *stubListener) Close() error { return nil }
+
+func TestDialAddrRejectsOwnAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewSwarm(ctx, peer.ID("self"), pstoremem.NewPeerstore(), nil)
+	defer s.Close()
+
+	// A QUIC address isn't filtered out by filterKnownUndialables.
+	own := ma.StringCast("/ip4/127.0.0.1/udp/4001/quic")
+	s.listeners.Lock()
+	s.listeners.m[&stubListener{addr: own}] = struct{}{}
+	s.listeners.cacheEOL = time.Time{}
+	s.listeners.Unlock()
+
+	if _, err := s.dialAddr(ctx, peer.ID("spoofer"), own); err != ErrDialToSelf {
+		t.Fatalf("expected %s, got %v", ErrDialToSelf, err)
+	}
+	other := ma.StringCast("/ip4/127.0.0.1/udp/4002/quic")
+	if _, err := s.dialAddr(ctx, peer.ID("spoofer"), other); err != ErrNoTransport {
+		t.Fatalf("expected %s, got %v", ErrNoTransport, err)
+	}
+}
+
+// anonTransport dials connections without a remote peer.
+type anonTransport struct {
+	transport.Transport
+	closed chan struct{}
+}
+
+type anonConn struct {
+	transport.Conn
+	closed chan struct{}
+}
+
+func (c *anonConn) RemotePeer() peer.ID { return "" }
+
+func (c *anonConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func (t *anonTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	return &anonConn{closed: t.closed}, nil
+}
+
+func (t *anonTransport) CanDial(addr ma.Multiaddr) bool { return true }
+
+func (t *anonTransport) Proxy() bool { return false }
+
+func (t *anonTransport) Protocols() []int { return []int{ma.P_QUIC} }
+
+func TestDialAddrNoRemotePeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewSwarm(ctx, peer.ID("self"), pstoremem.NewPeerstore(), nil)
+	defer s.Close()
+
+	tpt := &anonTransport{closed: make(chan struct{})}
+	if err := s.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := ma.StringCast("/ip4/127.0.0.1/udp/4001/quic")
+	if _, err := s.dialAddr(ctx, peer.ID("remote"), addr); err != ErrNoRemotePeer {
+		t.Fatalf("expected %s, got %v", ErrNoRemotePeer, err)
+	}
+	select {
+	case <-tpt.closed:
+	default:
+		t.Fatal("expected the connection to be closed")
+	}
+}
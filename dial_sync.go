@@ -3,13 +3,30 @@ package swarm
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 
+	logging "github.com/ipfs/go-log"
 	peer "github.com/libp2p/go-libp2p-peer"
 )
 
 // DialFunc is the type of function expected by DialSync.
 type DialFunc func(context.Context, peer.ID) (*Conn, error)
 
+// DialSyncer synchronizes dials to peers. The swarm uses one to make sure
+// concurrent dials to the same peer are coalesced into a single dial.
+//
+// DialSync is the default implementation.
+type DialSyncer interface {
+	// DialLock dials the given peer (or joins an in-progress dial to that
+	// peer) and waits for the dial to complete.
+	DialLock(ctx context.Context, p peer.ID) (*Conn, error)
+
+	// CancelDial cancels all in-progress dials to the given peer.
+	CancelDial(p peer.ID)
+}
+
+var _ DialSyncer = (*DialSync)(nil)
+
 // NewDialSync constructs a new DialSync
 func NewDialSync(dfn DialFunc) *DialSync {
 	return &DialSync{
@@ -24,6 +41,33 @@ type DialSync struct {
 	dials    map[peer.ID]*activeDial
 	dialsLk  sync.Mutex
 	dialFunc DialFunc
+
+	// counters, see DialSyncStats.
+	acquisitions int64
+	waits        int64
+	handoffs     int64
+}
+
+// DialSyncStats is a snapshot of a DialSync's counters. Many waits per
+// acquisition mean callers are piling up on dials to the same peers.
+type DialSyncStats struct {
+	// Acquisitions is the number of DialLock calls that started a dial.
+	Acquisitions int64
+	// Waits is the number of DialLock calls that joined a dial already in
+	// progress.
+	Waits int64
+	// Handoffs is the number of times a caller that joined a dial got its
+	// result, rather than giving up first.
+	Handoffs int64
+}
+
+// Stats returns a snapshot of the DialSync's counters.
+func (ds *DialSync) Stats() DialSyncStats {
+	return DialSyncStats{
+		Acquisitions: atomic.LoadInt64(&ds.acquisitions),
+		Waits:        atomic.LoadInt64(&ds.waits),
+		Handoffs:     atomic.LoadInt64(&ds.handoffs),
+	}
 }
 
 type activeDial struct {
@@ -39,10 +83,15 @@ type activeDial struct {
 	ds *DialSync
 }
 
-func (ad *activeDial) wait(ctx context.Context) (*Conn, error) {
+// wait waits for the dial to complete. joined is set if the caller joined a
+// dial started by someone else.
+func (ad *activeDial) wait(ctx context.Context, joined bool) (*Conn, error) {
 	defer ad.decref()
 	select {
 	case <-ad.waitch:
+		if joined {
+			atomic.AddInt64(&ad.ds.handoffs, 1)
+		}
 		return ad.conn, ad.err
 	case <-ctx.Done():
 		return nil, ctx.Err()
@@ -82,13 +131,18 @@ func (ad *activeDial) start(ctx context.Context) {
 	ad.cancel()
 }
 
-func (ds *DialSync) getActiveDial(p peer.ID) *activeDial {
+// getActiveDial returns the in-progress dial to p, starting one if needed.
+// joined is set if the dial was already in progress.
+func (ds *DialSync) getActiveDial(ctx context.Context, p peer.ID) (actd *activeDial, joined bool) {
 	ds.dialsLk.Lock()
 	defer ds.dialsLk.Unlock()
 
-	actd, ok := ds.dials[p]
-	if !ok {
-		adctx, cancel := context.WithCancel(context.Background())
+	actd, joined = ds.dials[p]
+	if joined {
+		atomic.AddInt64(&ds.waits, 1)
+	} else {
+		atomic.AddInt64(&ds.acquisitions, 1)
+		adctx, cancel := context.WithCancel(dialContext(ctx))
 		actd = &activeDial{
 			id:     p,
 			cancel: cancel,
@@ -103,13 +157,46 @@ func (ds *DialSync) getActiveDial(p peer.ID) *activeDial {
 	// increase ref count before dropping dialsLk
 	actd.incref()
 
-	return actd
+	return actd, joined
 }
 
 // DialLock initiates a dial to the given peer if there are none in progress
 // then waits for the dial to that peer to complete.
+//
+// Canceling ctx only stops this caller from waiting. The dial itself keeps
+// going as long as another caller is waiting on it, and is canceled once the
+// last one gives up.
 func (ds *DialSync) DialLock(ctx context.Context, p peer.ID) (*Conn, error) {
-	return ds.getActiveDial(p).wait(ctx)
+	ad, joined := ds.getActiveDial(ctx, p)
+	return ad.wait(ctx, joined)
+}
+
+// dialContext returns the context for a dial started by a caller with the
+// given context. The dial outlives the caller so it doesn't inherit the
+// caller's deadline or cancellation, only its dial ID, dial counts (see
+// DialPeerWithReport), dial priority, dial hints, whether it wants a new
+// connection and log metadata.
+func dialContext(ctx context.Context) context.Context {
+	dctx := context.Background()
+	if id := dialID(ctx); id != 0 {
+		dctx = context.WithValue(dctx, dialIDKey{}, id)
+	}
+	if dc := countsFromContext(ctx); dc != nil {
+		dctx = context.WithValue(dctx, dialCountsKey{}, dc)
+	}
+	if prio := dialPriority(ctx); prio != DialPriorityNormal {
+		dctx = WithDialPriority(dctx, prio)
+	}
+	if hints := DialHintsFromContext(ctx); hints != nil {
+		dctx = WithDialHints(dctx, hints)
+	}
+	if wantsNewConn(ctx) {
+		dctx = withNewConn(dctx)
+	}
+	if md, err := logging.MetadataFromContext(ctx); err == nil {
+		dctx = logging.ContextWithLoggable(dctx, md)
+	}
+	return dctx
 }
 
 // CancelDial cancels all in-progress dials to the given peer.
@@ -0,0 +1,66 @@
+package swarm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	testutil "github.com/libp2p/go-testutil"
+)
+
+// fakeDialSyncer is a DialSyncer that doesn't dial anything. Instead, it calls
+// dial (if set) or blocks until the context is canceled.
+type fakeDialSyncer struct {
+	dial     func(context.Context, peer.ID) (*Conn, error)
+	calls    int
+	canceled []peer.ID
+}
+
+func (fds *fakeDialSyncer) DialLock(ctx context.Context, p peer.ID) (*Conn, error) {
+	fds.calls++
+	if fds.dial != nil {
+		return fds.dial(ctx, p)
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (fds *fakeDialSyncer) CancelDial(p peer.ID) {
+	fds.canceled = append(fds.canceled, p)
+}
+
+func TestFakeDialSyncer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewSwarm(ctx, testutil.RandPeerIDFatal(t), pstoremem.NewPeerstore(), nil)
+	defer s.Close()
+
+	fds := new(fakeDialSyncer)
+	s.setDialSyncer(fds)
+
+	p := testutil.RandPeerIDFatal(t)
+
+	// A slow dial should respect the context.
+	dctx, dcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer dcancel()
+	if _, err := s.DialPeer(dctx, p); err != context.DeadlineExceeded {
+		t.Fatal("expected the dial to time out, got:", err)
+	}
+
+	// Errors from the syncer should be returned as is.
+	errDial := errors.New("injected failure")
+	fds.dial = func(context.Context, peer.ID) (*Conn, error) {
+		return nil, errDial
+	}
+	if _, err := s.DialPeer(ctx, p); err != errDial {
+		t.Fatal("expected the injected error, got:", err)
+	}
+
+	if fds.calls != 2 {
+		t.Fatalf("expected the syncer to be called twice, got %d calls", fds.calls)
+	}
+}
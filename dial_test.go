@@ -2,20 +2,36 @@ package swarm_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"net"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	writer "github.com/ipfs/go-log/writer"
 	addrutil "github.com/libp2p/go-addr-util"
+	csms "github.com/libp2p/go-conn-security-multistream"
+	insecure "github.com/libp2p/go-conn-security/insecure"
+	metrics "github.com/libp2p/go-libp2p-metrics"
+	inet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 	transport "github.com/libp2p/go-libp2p-transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	tcp "github.com/libp2p/go-tcp-transport"
 	testutil "github.com/libp2p/go-testutil"
 	ci "github.com/libp2p/go-testutil/ci"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr-net"
+	msmux "github.com/whyrusleeping/go-smux-multistream"
+	yamux "github.com/whyrusleeping/go-smux-yamux"
 
 	. "github.com/libp2p/go-libp2p-swarm"
 )
@@ -480,3 +496,1971 @@ func TestDialBackoffClears(t *testing.T) {
 		t.Log("correctly cleared backoff")
 	}
 }
+
+// delayedTransport delays every dial by a fixed duration before handing off to
+// the wrapped transport.
+type delayedTransport struct {
+	transport.Transport
+	delay time.Duration
+}
+
+func (dt *delayedTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	select {
+	case <-time.After(dt.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return dt.Transport.Dial(ctx, raddr, p)
+}
+
+// genSwarmWithTransport constructs a swarm whose TCP transport is wrapped with
+// the given function. If listen is set, the swarm listens on a random local
+// port.
+func genSwarmWithTransport(ctx context.Context, tb testing.TB, listen bool, wrap func(transport.Transport) transport.Transport) *Swarm {
+	p, err := testutil.RandPeerNetParams()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	ps := pstoremem.NewPeerstore()
+	ps.AddPubKey(p.ID, p.PubKey)
+	ps.AddPrivKey(p.ID, p.PrivKey)
+	s := NewSwarm(ctx, p.ID, ps, metrics.NewBandwidthCounter())
+
+	if err := s.AddTransport(wrap(tcp.NewTCPTransport(swarmt.GenUpgrader(s)))); err != nil {
+		tb.Fatal(err)
+	}
+
+	if listen {
+		if err := s.Listen(p.Addr); err != nil {
+			tb.Fatal(err)
+		}
+		s.Peerstore().AddAddrs(p.ID, s.ListenAddresses(), pstore.PermanentAddrTTL)
+	}
+	return s
+}
+
+// makeDialOnlySwarmWithTransport constructs a dial-only swarm whose TCP
+// transport is wrapped with the given function.
+func makeDialOnlySwarmWithTransport(ctx context.Context, t *testing.T, wrap func(transport.Transport) transport.Transport) *Swarm {
+	return genSwarmWithTransport(ctx, t, false, wrap)
+}
+
+func TestDialLatency(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	const delay = 200 * time.Millisecond
+	s1 := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		return &delayedTransport{Transport: tpt, delay: delay}
+	})
+	defer s1.Close()
+
+	swarms := makeSwarms(ctx, t, 1)
+	defer closeSwarms(swarms)
+	s2 := swarms[0]
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	c, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latency := c.(*Conn).DialLatency()
+	if latency < delay || latency > delay+time.Second {
+		t.Fatalf("expected dial latency of about %s, got %s", delay, latency)
+	}
+
+	// wait for the inbound side to register the connection.
+	for i := 0; len(s2.ConnsToPeer(s1.LocalPeer())) == 0; i++ {
+		if i > 100 {
+			t.Fatal("inbound connection never showed up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, c := range s2.ConnsToPeer(s1.LocalPeer()) {
+		if l := c.(*Conn).DialLatency(); l != 0 {
+			t.Fatalf("expected zero dial latency on inbound conn, got %s", l)
+		}
+	}
+}
+
+// circuitCode is the multiaddr code of the p2p-circuit (relay) protocol.
+const circuitCode = 290
+
+func init() {
+	if ma.ProtocolWithCode(circuitCode).Code == 0 {
+		err := ma.AddProtocol(ma.Protocol{
+			Name:  "p2p-circuit",
+			Code:  circuitCode,
+			VCode: ma.CodeToVarint(circuitCode),
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// hangingRelayTransport is a proxy transport whose dials never succeed. It
+// reports when a dial starts and when a dial is canceled.
+type hangingRelayTransport struct {
+	dialing  chan struct{}
+	canceled chan struct{}
+}
+
+func newHangingRelayTransport() *hangingRelayTransport {
+	return &hangingRelayTransport{
+		dialing:  make(chan struct{}, 1),
+		canceled: make(chan struct{}, 1),
+	}
+}
+
+func (rt *hangingRelayTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	rt.dialing <- struct{}{}
+	<-ctx.Done()
+	rt.canceled <- struct{}{}
+	return nil, ctx.Err()
+}
+
+func (rt *hangingRelayTransport) CanDial(addr ma.Multiaddr) bool {
+	return true
+}
+
+func (rt *hangingRelayTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	panic("unimplemented")
+}
+
+func (rt *hangingRelayTransport) Proxy() bool {
+	return true
+}
+
+func (rt *hangingRelayTransport) Protocols() []int {
+	return []int{circuitCode}
+}
+
+func TestDirectConnCancelsRelayDial(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	relay := newHangingRelayTransport()
+	if err := s1.AddTransport(relay); err != nil {
+		t.Fatal(err)
+	}
+
+	s1.Peerstore().AddAddr(s2.LocalPeer(), ma.StringCast("/p2p-circuit"), pstore.PermanentAddrTTL)
+	s2.Peerstore().AddAddrs(s1.LocalPeer(), s1.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	type result struct {
+		c   inet.Conn
+		err error
+	}
+	resch := make(chan result, 1)
+	go func() {
+		c, err := s1.DialPeer(ctx, s2.LocalPeer())
+		resch <- result{c, err}
+	}()
+
+	select {
+	case <-relay.dialing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay dial never started")
+	}
+
+	// a direct connection from the other side should supersede the relay dial.
+	if _, err := s2.DialPeer(ctx, s1.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-relay.canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay dial should have been canceled")
+	}
+
+	res := <-resch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.c.(*Conn).Stat().Direction != inet.DirInbound {
+		t.Fatal("expected to get the direct inbound connection")
+	}
+}
+
+func TestRelayedConnKeepsDirectDial(t *testing.T) {
+	// the fake relay connects directly, the target would take both
+	// connections for a simultaneous open.
+	defer func(w time.Duration) { SimultaneousOpenWindow = w }(SimultaneousOpenWindow)
+	SimultaneousOpenWindow = 0
+
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	var ct *circuitTransport
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		ct = newCircuitTransport(tpt)
+		return &delayedTransport{Transport: tpt, delay: 500 * time.Millisecond}
+	})
+	defer s.Close()
+	ct.proxied = true
+	if err := s.AddTransport(ct); err != nil {
+		t.Fatal(err)
+	}
+	ct.peers[target.LocalPeer()] = target
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	events, cancel := s.SubscribeDials()
+	defer cancel()
+
+	type result struct {
+		c   inet.Conn
+		err error
+	}
+	resch := make(chan result, 1)
+	go func() {
+		c, err := s.DialPeer(ctx, target.LocalPeer())
+		resch <- result{c, err}
+	}()
+
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("direct dial never started")
+	}
+
+	// a relayed connection shouldn't cancel the direct dial.
+	relayed, err := s.DialPeerViaRelay(ctx, target.LocalPeer(), testutil.RandPeerIDFatal(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-resch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.c == relayed || res.c.(*Conn).Stat().Direction != inet.DirOutbound {
+		t.Fatal("expected to get the direct connection")
+	}
+}
+
+func BenchmarkDialPeerAlreadyConnected(b *testing.B) {
+	ctx := context.Background()
+	noWrap := func(tpt transport.Transport) transport.Transport { return tpt }
+
+	s1 := genSwarmWithTransport(ctx, b, false, noWrap)
+	defer s1.Close()
+	s2 := genSwarmWithTransport(ctx, b, true, noWrap)
+	defer s2.Close()
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDialAny(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	unreachable := testutil.RandPeerIDFatal(t)
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr, err := manet.FromNetAddr(l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	s1.Peerstore().AddAddr(unreachable, closedAddr, pstore.PermanentAddrTTL)
+
+	noAddrs := testutil.RandPeerIDFatal(t)
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	c, err := s1.DialAny(ctx, []peer.ID{unreachable, s2.LocalPeer(), noAddrs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RemotePeer() != s2.LocalPeer() {
+		t.Fatalf("expected a connection to %s, got one to %s", s2.LocalPeer(), c.RemotePeer())
+	}
+
+	if _, err := s1.DialAny(ctx, []peer.ID{unreachable, noAddrs}); err == nil {
+		t.Fatal("dialing only unreachable peers should have failed")
+	}
+}
+
+// recordingTransport records the addresses it's asked to dial.
+type recordingTransport struct {
+	transport.Transport
+
+	lk     sync.Mutex
+	dialed []ma.Multiaddr
+}
+
+func (rt *recordingTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	rt.lk.Lock()
+	rt.dialed = append(rt.dialed, raddr)
+	rt.lk.Unlock()
+	return rt.Transport.Dial(ctx, raddr, p)
+}
+
+func TestAddrDialOrder(t *testing.T) {
+	// Only allow one dial at a time so dials happen in order.
+	t.Setenv("LIBP2P_SWARM_FD_LIMIT", "1")
+	ctx := context.Background()
+
+	rt := new(recordingTransport)
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		rt.Transport = tpt
+		return rt
+	})
+	defer s.Close()
+
+	p := testutil.RandPeerIDFatal(t)
+	for i := 0; i < 3; i++ {
+		_, addr, l := newSilentPeer(t)
+		l.Close()
+		s.Peerstore().AddAddr(p, addr, pstore.PermanentAddrTTL)
+	}
+
+	var expected []ma.Multiaddr
+	s.SetAddrDialOrder(func(_ peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+		reversed := make([]ma.Multiaddr, len(addrs))
+		for i, a := range addrs {
+			reversed[len(addrs)-1-i] = a
+		}
+		expected = reversed
+		return reversed
+	})
+
+	if _, err := s.DialPeer(ctx, p); err == nil {
+		t.Fatal("dial should have failed")
+	}
+
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+	if len(rt.dialed) != len(expected) {
+		t.Fatalf("expected %d dials, got %d", len(expected), len(rt.dialed))
+	}
+	for i := range expected {
+		if !rt.dialed[i].Equal(expected[i]) {
+			t.Fatalf("expected dials in order %s, got %s", expected, rt.dialed)
+		}
+	}
+}
+
+func TestAddrDialOrderOnlyGivenAddrs(t *testing.T) {
+	// Only allow one dial at a time so dials happen in order.
+	t.Setenv("LIBP2P_SWARM_FD_LIMIT", "1")
+	ctx := context.Background()
+
+	rt := new(recordingTransport)
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		rt.Transport = tpt
+		return rt
+	})
+	defer s.Close()
+
+	p := testutil.RandPeerIDFatal(t)
+	var addrs []ma.Multiaddr
+	for i := 0; i < 3; i++ {
+		_, addr, l := newSilentPeer(t)
+		l.Close()
+		addrs = append(addrs, addr)
+	}
+	s.Peerstore().AddAddrs(p, addrs[:2], pstore.PermanentAddrTTL)
+
+	// addrs[2] isn't one of the peer's addresses, and addrs[1] is repeated.
+	s.SetAddrDialOrder(func(peer.ID, []ma.Multiaddr) []ma.Multiaddr {
+		return []ma.Multiaddr{addrs[2], addrs[1], addrs[1], addrs[0]}
+	})
+
+	if _, err := s.DialPeer(ctx, p); err == nil {
+		t.Fatal("dial should have failed")
+	}
+
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+	expected := []ma.Multiaddr{addrs[1], addrs[0]}
+	if len(rt.dialed) != len(expected) {
+		t.Fatalf("expected dials to %s, got %s", expected, rt.dialed)
+	}
+	for i := range expected {
+		if !rt.dialed[i].Equal(expected[i]) {
+			t.Fatalf("expected dials to %s, got %s", expected, rt.dialed)
+		}
+	}
+}
+
+// flakyTransport fails the first `failures` dials and then hands off to the
+// wrapped transport.
+type flakyTransport struct {
+	transport.Transport
+
+	lk       sync.Mutex
+	failures int
+	dials    int
+}
+
+func (ft *flakyTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	ft.lk.Lock()
+	ft.dials++
+	fail := ft.dials <= ft.failures
+	ft.lk.Unlock()
+	if fail {
+		return nil, errors.New("flaky transport")
+	}
+	return ft.Transport.Dial(ctx, raddr, p)
+}
+
+func TestDialAttempts(t *testing.T) {
+	defer func(d time.Duration) { DialRetryDelay = d }(DialRetryDelay)
+	DialRetryDelay = 10 * time.Millisecond
+
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	dial := func(attempts int) (*flakyTransport, error) {
+		ft := &flakyTransport{failures: 1}
+		s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+			ft.Transport = tpt
+			return ft
+		})
+		defer s.Close()
+		s.SetDialAttempts(attempts)
+		s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+		_, err := s.DialPeer(ctx, target.LocalPeer())
+		return ft, err
+	}
+
+	ft, err := dial(1)
+	if err == nil {
+		t.Fatal("dial should have failed without retries")
+	}
+	if ft.dials != 1 {
+		t.Fatalf("expected 1 dial, got %d", ft.dials)
+	}
+
+	ft, err = dial(2)
+	if err != nil {
+		t.Fatal("dial should have succeeded on the second attempt:", err)
+	}
+	if ft.dials != 2 {
+		t.Fatalf("expected 2 dials, got %d", ft.dials)
+	}
+}
+
+func TestDialAttemptsNotRetried(t *testing.T) {
+	ctx := context.Background()
+	s := makeSwarms(ctx, t, 1)[0]
+	defer s.Close()
+	s.SetDialAttempts(3)
+
+	// retrying won't help a peer we don't have any addresses for.
+	start := time.Now()
+	if _, err := s.DialPeer(ctx, testutil.RandPeerIDFatal(t)); err == nil {
+		t.Fatal("dial should have failed")
+	}
+	if time.Since(start) > DialRetryDelay {
+		t.Fatal("dial should not have been retried")
+	}
+}
+
+// dialGoroutines returns the number of goroutines still working on (or
+// waiting to report) a dial.
+func dialGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	return strings.Count(string(buf), "(*dialLimiter).executeDial") +
+		strings.Count(string(buf), "swarm.drainDialResults")
+}
+
+func TestDialAddrsNoLeakOnEarlyReturn(t *testing.T) {
+	const silentAddrs = 50
+
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	// the first address works, the rest hang.
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	for i := 0; i < silentAddrs; i++ {
+		_, addr, l := newSilentPeer(t)
+		defer l.Close()
+		s1.Peerstore().AddAddr(s2.LocalPeer(), addr, pstore.PermanentAddrTTL)
+	}
+
+	// other tests may still have dials in flight.
+	before := dialGoroutines()
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for dialGoroutines() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dial goroutines still running", dialGoroutines()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stubResolver resolves addresses from a fixed table.
+type stubResolver map[string][]ma.Multiaddr
+
+func (sr stubResolver) Resolve(ctx context.Context, maddr ma.Multiaddr) ([]ma.Multiaddr, error) {
+	addrs, ok := sr[maddr.String()]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func TestDialResolvesDNSAddrs(t *testing.T) {
+	ctx := context.Background()
+
+	rt := new(recordingTransport)
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		rt.Transport = tpt
+		return rt
+	})
+	defer s.Close()
+
+	p := testutil.RandPeerIDFatal(t)
+	var resolved []ma.Multiaddr
+	for i := 0; i < 2; i++ {
+		_, addr, l := newSilentPeer(t)
+		l.Close()
+		resolved = append(resolved, addr)
+	}
+	s.SetResolver(stubResolver{"/dns4/example.com/tcp/4001": resolved})
+	s.Peerstore().AddAddrs(p, []ma.Multiaddr{
+		ma.StringCast("/dns4/example.com/tcp/4001"),
+		ma.StringCast("/dns4/unknown.example.com/tcp/4001"),
+	}, pstore.PermanentAddrTTL)
+
+	if _, err := s.DialPeer(ctx, p); err == nil {
+		t.Fatal("dial should have failed")
+	}
+
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+	if len(rt.dialed) != len(resolved) {
+		t.Fatalf("expected %d dials, got %s", len(resolved), rt.dialed)
+	}
+	for _, a := range resolved {
+		found := false
+		for _, d := range rt.dialed {
+			if d.Equal(a) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("resolved address %s was never dialed (dialed: %s)", a, rt.dialed)
+		}
+	}
+}
+
+func TestDialNoAddresses(t *testing.T) {
+	ctx := context.Background()
+	s := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s.Close()
+
+	p := testutil.RandPeerIDFatal(t)
+	if _, err := s.DialPeer(ctx, p); !errors.Is(err, ErrNoAddresses) {
+		t.Fatalf("expected %s, got %v", ErrNoAddresses, err)
+	}
+
+	// link-local addresses and addresses we have no transport for are
+	// known but undialable.
+	p = testutil.RandPeerIDFatal(t)
+	s.Peerstore().AddAddrs(p, []ma.Multiaddr{
+		ma.StringCast("/ip6/fe80::1/tcp/4001"),
+		ma.StringCast("/ip4/1.2.3.4/udp/4001/quic"),
+	}, pstore.PermanentAddrTTL)
+	if _, err := s.DialPeer(ctx, p); !errors.Is(err, ErrNoGoodAddresses) {
+		t.Fatalf("expected %s, got %v", ErrNoGoodAddresses, err)
+	}
+}
+
+func TestAddrResolveHook(t *testing.T) {
+	ctx := context.Background()
+	s := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s.Close()
+
+	p := testutil.RandPeerIDFatal(t)
+	var resolved []ma.Multiaddr
+	for i := 0; i < 3; i++ {
+		_, addr, l := newSilentPeer(t)
+		l.Close()
+		resolved = append(resolved, addr)
+	}
+	dnsAddr := ma.StringCast("/dns4/example.com/tcp/4001")
+	s.SetResolver(stubResolver{dnsAddr.String(): resolved})
+
+	var lk sync.Mutex
+	got := make(map[string][]ma.Multiaddr)
+	s.SetAddrResolveHook(func(original ma.Multiaddr, addrs []ma.Multiaddr) {
+		lk.Lock()
+		defer lk.Unlock()
+		got[original.String()] = addrs
+	})
+	s.Peerstore().AddAddrs(p, []ma.Multiaddr{
+		dnsAddr,
+		ma.StringCast("/dns4/unknown.example.com/tcp/4001"),
+	}, pstore.PermanentAddrTTL)
+
+	if _, err := s.DialPeer(ctx, p); err == nil {
+		t.Fatal("dial should have failed")
+	}
+
+	lk.Lock()
+	defer lk.Unlock()
+	if len(got) != 1 {
+		t.Fatalf("expected the hook to be called for the resolved address only, got %v", got)
+	}
+	addrs := got[dnsAddr.String()]
+	if len(addrs) != len(resolved) {
+		t.Fatalf("expected %s to resolve to %s, got %s", dnsAddr, resolved, addrs)
+	}
+	for i, a := range resolved {
+		if !addrs[i].Equal(a) {
+			t.Fatalf("expected %s to resolve to %s, got %s", dnsAddr, resolved, addrs)
+		}
+	}
+}
+
+func TestDefaultDialTimeout(t *testing.T) {
+	ctx := context.Background()
+	s := makeSwarms(ctx, t, 1)[0]
+	defer s.Close()
+
+	hangingPeer := func() peer.ID {
+		p, addr, l := newSilentPeer(t)
+		go acceptAndHang(l)
+		t.Cleanup(func() { l.Close() })
+		s.Peerstore().AddAddr(p, addr, pstore.PermanentAddrTTL)
+		return p
+	}
+
+	timeDial := func(ctx context.Context, p peer.ID) time.Duration {
+		start := time.Now()
+		if _, err := s.DialPeer(ctx, p); err == nil {
+			t.Fatal("dial to hanging peer should have failed")
+		}
+		return time.Since(start)
+	}
+
+	// the swarm's timeout is well below the per-address dial timeout.
+	s.SetDefaultDialTimeout(200 * time.Millisecond)
+	if d := timeDial(ctx, hangingPeer()); d < 200*time.Millisecond || d > transport.DialTimeout/2 {
+		t.Fatalf("expected the dial to time out after ~200ms, took %s", d)
+	}
+
+	// a sooner deadline on the caller's context wins.
+	s.SetDefaultDialTimeout(transport.DialTimeout / 2)
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if d := timeDial(cctx, hangingPeer()); d > 250*time.Millisecond {
+		t.Fatalf("expected the caller's deadline to apply, took %s", d)
+	}
+}
+
+func TestPauseDialing(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s1, s2, s3 := swarms[0], swarms[1], swarms[2]
+
+	for _, s := range []*Swarm{s2, s3} {
+		s1.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), pstore.PermanentAddrTTL)
+	}
+	c, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s1.PauseDialing()
+
+	// existing connections keep working.
+	if c2, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil || c2 != c {
+		t.Fatal("expected to get the existing connection while paused", err)
+	}
+	if _, err := s1.DialPeer(ctx, s3.LocalPeer()); err != ErrDialingPaused {
+		t.Fatal("expected ErrDialingPaused, got", err)
+	}
+	if s1.Connectedness(s3.LocalPeer()) == inet.Connected {
+		t.Fatal("shouldn't have connected while paused")
+	}
+
+	s1.ResumeDialing()
+	if _, err := s1.DialPeer(ctx, s3.LocalPeer()); err != nil {
+		t.Fatal("dial should succeed after resuming:", err)
+	}
+}
+
+func TestAddressFamilyPreference(t *testing.T) {
+	// Only allow one dial at a time so dials happen in order.
+	t.Setenv("LIBP2P_SWARM_FD_LIMIT", "1")
+	ctx := context.Background()
+
+	p := testutil.RandPeerIDFatal(t)
+	v4 := []ma.Multiaddr{
+		ma.StringCast("/ip4/127.0.0.1/tcp/1"),
+		ma.StringCast("/ip4/127.0.0.1/tcp/2"),
+	}
+	v6 := []ma.Multiaddr{
+		ma.StringCast("/ip6/::1/tcp/1"),
+		ma.StringCast("/ip6/::1/tcp/2"),
+	}
+
+	for _, tc := range []struct {
+		pref     AddressFamilyPreference
+		expected []ma.Multiaddr
+	}{
+		{PreferIPv6, append(append([]ma.Multiaddr{}, v6...), v4...)},
+		{PreferIPv4, append(append([]ma.Multiaddr{}, v4...), v6...)},
+	} {
+		rt := new(recordingTransport)
+		s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+			rt.Transport = tpt
+			return rt
+		})
+		s.SetAddressFamilyPreference(tc.pref)
+
+		// interleave the families.
+		for i := range v4 {
+			s.Peerstore().AddAddr(p, v4[i], pstore.PermanentAddrTTL)
+			s.Peerstore().AddAddr(p, v6[i], pstore.PermanentAddrTTL)
+		}
+
+		if _, err := s.DialPeer(ctx, p); err == nil {
+			t.Fatal("dial should have failed")
+		}
+		s.Close()
+
+		rt.lk.Lock()
+		if len(rt.dialed) != len(tc.expected) {
+			t.Fatalf("expected %d dials, got %s", len(tc.expected), rt.dialed)
+		}
+		// the order within a family is up to the peerstore, only check
+		// the families.
+		for i, a := range rt.dialed {
+			if a.Protocols()[0].Code != tc.expected[i].Protocols()[0].Code {
+				t.Fatalf("preference %d: expected dial order %s, got %s", tc.pref, tc.expected, rt.dialed)
+			}
+		}
+		rt.lk.Unlock()
+	}
+}
+
+// slowTransport delays each dial by the next duration in delays.
+type slowTransport struct {
+	transport.Transport
+
+	lk     sync.Mutex
+	delays []time.Duration
+}
+
+func (st *slowTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	st.lk.Lock()
+	var delay time.Duration
+	if len(st.delays) > 0 {
+		delay, st.delays = st.delays[0], st.delays[1:]
+	}
+	st.lk.Unlock()
+	time.Sleep(delay)
+	return st.Transport.Dial(ctx, raddr, p)
+}
+
+func TestBestConnPrefersLowLatency(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	// the second dial is much slower than the first.
+	st := &slowTransport{delays: []time.Duration{0, 100 * time.Millisecond}}
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		st.Transport = tpt
+		return st
+	})
+	defer s.Close()
+
+	// force a second connection to the same peer.
+	s.SetMaxStreamsPerConn(1, StreamLimitNewConn)
+	s.SetMaxConnsPerPeer(2)
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+	for i := 0; i < 2; i++ {
+		if _, err := s.NewStream(ctx, target.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conns := s.ConnsToPeer(target.LocalPeer())
+	if len(conns) != 2 {
+		t.Fatalf("expected 2 conns to peer, got %d", len(conns))
+	}
+	fast, slow := conns[0].(*Conn), conns[1].(*Conn)
+	if fast.DialLatency() >= slow.DialLatency() {
+		t.Fatalf("expected the first conn to be faster: %s >= %s", fast.DialLatency(), slow.DialLatency())
+	}
+
+	s.SetMaxStreamsPerConn(0, StreamLimitFail)
+	ranked := s.RankedConnsToPeer(target.LocalPeer())
+	if len(ranked) != 2 || ranked[0] != fast || ranked[1] != slow {
+		t.Fatal("expected conns to be ranked by dial latency")
+	}
+
+	str, err := s.NewStream(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str.Conn() != fast {
+		t.Fatal("expected the new stream to be opened on the faster conn")
+	}
+}
+
+// genInsecureSwarm constructs a listening swarm without a private key that
+// secures its connections with the insecure (plaintext) transport.
+func genInsecureSwarm(ctx context.Context, t *testing.T) *Swarm {
+	p, err := testutil.RandPeerNetParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := pstoremem.NewPeerstore()
+	ps.AddPubKey(p.ID, p.PubKey)
+	s := NewSwarm(ctx, p.ID, ps, metrics.NewBandwidthCounter())
+
+	secMuxer := new(csms.SSMuxer)
+	secMuxer.AddTransport(insecure.ID, insecure.New(p.ID))
+	stMuxer := msmux.NewBlankTransport()
+	stMuxer.AddTransport("/yamux/1.0.0", yamux.DefaultTransport)
+	upgrader := &tptu.Upgrader{
+		Secure:  secMuxer,
+		Muxer:   stMuxer,
+		Filters: s.Filters,
+	}
+
+	if err := s.AddTransport(tcp.NewTCPTransport(upgrader)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen(p.Addr); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRequireEncryption(t *testing.T) {
+	ctx := context.Background()
+	s1, s2 := genInsecureSwarm(ctx, t), genInsecureSwarm(ctx, t)
+	defer closeSwarms([]*Swarm{s1, s2})
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	s1.SetRequireEncryption(true)
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != ErrInsecureDialRejected {
+		t.Fatalf("expected %q, got %v", ErrInsecureDialRejected, err)
+	}
+
+	s1.SetRequireEncryption(false)
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	// dials that don't go through DialPeer are rejected too.
+	s1.SetRequireEncryption(true)
+	if _, err := s1.RefreshConn(ctx, s2.LocalPeer()); err != ErrInsecureDialRejected {
+		t.Fatalf("expected %q, got %v", ErrInsecureDialRejected, err)
+	}
+	if n := len(s1.ConnsToPeer(s2.LocalPeer())); n != 1 {
+		t.Fatalf("expected the existing connection to be kept, got %d connections", n)
+	}
+	if _, err := s1.DialPeerViaRelay(ctx, s2.LocalPeer(), testutil.RandPeerIDFatal(t)); err != ErrInsecureDialRejected {
+		t.Fatalf("expected %q, got %v", ErrInsecureDialRejected, err)
+	}
+}
+
+var registerCircuit sync.Once
+
+// relayTransport is a fake circuit relay transport counting its dials, which
+// always fail.
+type relayTransport struct {
+	lk    sync.Mutex
+	dials int
+}
+
+func (rt *relayTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+	rt.dials++
+	return nil, errors.New("relay dials always fail")
+}
+
+func (rt *relayTransport) numDials() int {
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+	return rt.dials
+}
+
+func (rt *relayTransport) CanDial(addr ma.Multiaddr) bool { return true }
+
+func (rt *relayTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	return nil, errors.New("relay transport can't listen")
+}
+
+func (rt *relayTransport) Protocols() []int { return []int{290} }
+
+func (rt *relayTransport) Proxy() bool { return true }
+
+func TestRelayFallbackOnly(t *testing.T) {
+	registerCircuit.Do(func() {
+		// normally registered by the circuit relay transport.
+		ma.AddProtocol(ma.Protocol{Name: "p2p-circuit", Code: 290, VCode: ma.CodeToVarint(290)})
+	})
+
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	relayAddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/4001/p2p-circuit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(direct ma.Multiaddr) (*relayTransport, error) {
+		st := &slowTransport{delays: []time.Duration{200 * time.Millisecond}}
+		s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+			st.Transport = tpt
+			return st
+		})
+		defer s.Close()
+		rt := new(relayTransport)
+		if err := s.AddTransport(rt); err != nil {
+			t.Fatal(err)
+		}
+		s.SetRelayFallbackOnly(true, 5*time.Second)
+		s.Peerstore().AddAddrs(target.LocalPeer(), []ma.Multiaddr{relayAddr, direct}, pstore.PermanentAddrTTL)
+		_, err := s.DialPeer(ctx, target.LocalPeer())
+		return rt, err
+	}
+
+	// a slow but working direct address wins without touching the relay.
+	rt, err := dial(target.ListenAddresses()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := rt.numDials(); n != 0 {
+		t.Fatalf("expected no relay dials, got %d", n)
+	}
+
+	// once the direct address fails, we fall back to the relay right away.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr, err := manet.FromNetAddr(l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	start := time.Now()
+	if rt, err = dial(deadAddr); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if n := rt.numDials(); n != 1 {
+		t.Fatalf("expected 1 relay dial, got %d", n)
+	}
+	if time.Since(start) >= 5*time.Second {
+		t.Fatal("should have fallen back without waiting for the window")
+	}
+}
+
+func TestDialFallback(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	var calls int32
+	s1.SetDialFallback(func(ctx context.Context, p peer.ID) ([]ma.Multiaddr, error) {
+		atomic.AddInt32(&calls, 1)
+		if p != s2.LocalPeer() {
+			return nil, errors.New("unknown peer")
+		}
+		return s2.ListenAddresses(), nil
+	})
+
+	// we don't know any of s2's addresses.
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected the fallback to be called once, got %d", n)
+	}
+}
+
+func TestDialFallbackLoop(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	var calls int32
+	fallbackErr := make(chan error, 1)
+	s1.SetDialFallback(func(ctx context.Context, p peer.ID) ([]ma.Multiaddr, error) {
+		atomic.AddInt32(&calls, 1)
+		_, err := s1.DialPeer(ctx, p)
+		fallbackErr <- err
+		return nil, err
+	})
+
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if err := <-fallbackErr; err != ErrDialFallbackLoop {
+		t.Fatalf("expected %q from the fallback, got %v", ErrDialFallbackLoop, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected the fallback to be called once, got %d", n)
+	}
+}
+
+func TestDialIDInLogEvents(t *testing.T) {
+	ctx := context.Background()
+	s1 := makeDialOnlySwarm(ctx, t)
+	defer s1.Close()
+
+	// a peer whose only address refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr, err := manet.FromNetAddr(l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	p := testutil.RandPeerIDFatal(t)
+	s1.Peerstore().AddAddr(p, deadAddr, pstore.PermanentAddrTTL)
+
+	r, w := io.Pipe()
+	writer.WriterGroup.AddWriter(w)
+	defer w.Close()
+
+	events := make(chan map[string]interface{}, 100)
+	go func() {
+		dec := json.NewDecoder(r)
+		for {
+			var e map[string]interface{}
+			if err := dec.Decode(&e); err != nil {
+				return
+			}
+			events <- e
+		}
+	}()
+
+	// the first dial fails, the second one is backed off.
+	if _, err := s1.DialPeer(ctx, p); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if _, err := s1.DialPeer(ctx, p); err != ErrDialBackoff {
+		t.Fatalf("expected %q, got %v", ErrDialBackoff, err)
+	}
+
+	ids := make(map[string]interface{})
+	for len(ids) < 3 {
+		select {
+		case e := <-events:
+			switch name, _ := e["event"].(string); name {
+			case "swarmDialBackoffAdd", "swarmDialFailed", "swarmDialBackoff":
+				if _, ok := e["dialID"]; !ok {
+					t.Fatalf("event %s has no dial ID", name)
+				}
+				ids[name] = e["dialID"]
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for dial events, got %v", ids)
+		}
+	}
+
+	// swarmDialBackoffAdd is logged by the dial itself, swarmDialFailed by
+	// the DialPeer call that started it.
+	if ids["swarmDialBackoffAdd"] != ids["swarmDialFailed"] {
+		t.Fatalf("expected the same dial ID across the first dial, got %v", ids)
+	}
+	if ids["swarmDialBackoff"] == ids["swarmDialFailed"] {
+		t.Fatalf("expected a new dial ID for the second dial, got %v", ids)
+	}
+}
+
+func TestDialPeerWithReport(t *testing.T) {
+	// Only allow one dial at a time so the bad addresses are all tried first.
+	t.Setenv("LIBP2P_SWARM_FD_LIMIT", "1")
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	good := s2.ListenAddresses()[0]
+	s1.Peerstore().AddAddr(s2.LocalPeer(), good, pstore.PermanentAddrTTL)
+	for i := 0; i < 3; i++ {
+		_, addr, l := newSilentPeer(t)
+		l.Close()
+		s1.Peerstore().AddAddr(s2.LocalPeer(), addr, pstore.PermanentAddrTTL)
+	}
+	s1.SetAddrDialOrder(func(_ peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+		var ordered []ma.Multiaddr
+		for _, a := range addrs {
+			if !a.Equal(good) {
+				ordered = append(ordered, a)
+			}
+		}
+		return append(ordered, good)
+	})
+
+	c, report, err := s1.DialPeerWithReport(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil {
+		t.Fatal("expected a connection")
+	}
+	if report.AttemptedAddrs != 4 || report.FailedAddrs != 3 {
+		t.Fatalf("expected 4 attempted and 3 failed addresses, got %+v", report)
+	}
+
+	// we're connected now so there's nothing to dial.
+	_, report, err = s1.DialPeerWithReport(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report != (DialReport{}) {
+		t.Fatalf("expected an empty report, got %+v", report)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s1, s2, s3 := swarms[0], swarms[1], swarms[2]
+
+	unreachable, addr, l := newSilentPeer(t)
+	l.Close()
+	s1.Peerstore().AddAddr(unreachable, addr, pstore.PermanentAddrTTL)
+	noAddrs := testutil.RandPeerIDFatal(t)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	s1.Peerstore().AddAddrs(s3.LocalPeer(), s3.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	peers := []peer.ID{s2.LocalPeer(), unreachable, s3.LocalPeer(), noAddrs}
+	errs := s1.Bootstrap(ctx, peers)
+	if len(errs) != len(peers) {
+		t.Fatalf("expected %d results, got %d", len(peers), len(errs))
+	}
+	for i, ok := range []bool{true, false, true, false} {
+		if ok && errs[i] != nil {
+			t.Fatalf("dial to %s failed: %s", peers[i], errs[i])
+		}
+		if !ok && errs[i] == nil {
+			t.Fatalf("dial to %s should have failed", peers[i])
+		}
+	}
+	for _, p := range []peer.ID{s2.LocalPeer(), s3.LocalPeer()} {
+		if s1.Connectedness(p) != inet.Connected {
+			t.Fatalf("should be connected to %s", p)
+		}
+	}
+
+	// the unreachable peer is backed off now.
+	errs = s1.Bootstrap(ctx, []peer.ID{unreachable, s2.LocalPeer()})
+	if errs[0] != ErrDialBackoff {
+		t.Fatalf("expected %s, got %v", ErrDialBackoff, errs[0])
+	}
+	if errs[1] != nil {
+		t.Fatal(errs[1])
+	}
+}
+
+// ip4Transport claims the /ip4 protocol so it can dial the same addresses as
+// the TCP transport it wraps.
+type ip4Transport struct {
+	recordingTransport
+}
+
+func (t *ip4Transport) Protocols() []int { return []int{ma.P_IP4} }
+
+func TestTransportSelector(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	var tcpTpt transport.Transport
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		tcpTpt = tpt
+		return tpt
+	})
+	defer s.Close()
+	second := &ip4Transport{recordingTransport{Transport: tcpTpt}}
+	if err := s.AddTransport(second); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := target.ListenAddresses()[0]
+	if s.TransportForDialing(addr) != tcpTpt {
+		t.Fatal("expected the TCP transport by default")
+	}
+
+	// pick the transport we registered second.
+	var candidates []transport.Transport
+	s.SetTransportSelector(func(_ ma.Multiaddr, c []transport.Transport) transport.Transport {
+		candidates = c
+		return second
+	})
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s.DialPeer(ctx, target.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 || candidates[0] != second || candidates[1] != tcpTpt {
+		t.Fatalf("expected both transports as candidates, got %v", candidates)
+	}
+
+	second.lk.Lock()
+	defer second.lk.Unlock()
+	if len(second.dialed) != 1 {
+		t.Fatalf("expected the selected transport to dial once, got %d dials", len(second.dialed))
+	}
+}
+
+func TestDialContinuesAfterFirstCallerCancels(t *testing.T) {
+	ctx := context.Background()
+	s1 := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		return &delayedTransport{Transport: tpt, delay: 200 * time.Millisecond}
+	})
+	defer s1.Close()
+
+	swarms := makeSwarms(ctx, t, 1)
+	defer closeSwarms(swarms)
+	s2 := swarms[0]
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	// The first caller starts the dial and gives up half way through.
+	ctx1, cancel1 := context.WithCancel(ctx)
+	first := make(chan error, 1)
+	go func() {
+		_, err := s1.DialPeer(ctx1, s2.LocalPeer())
+		first <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	second := make(chan error, 1)
+	go func() {
+		_, err := s1.DialPeer(ctx, s2.LocalPeer())
+		second <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel1()
+
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("expected the first caller to be canceled, got %v", err)
+	}
+	// The second caller takes over the dial.
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	if s1.Connectedness(s2.LocalPeer()) != inet.Connected {
+		t.Fatal("expected to be connected")
+	}
+}
+
+func TestBestConnPrefersDirectInbound(t *testing.T) {
+	// the fake relay connects directly, the target would take both
+	// connections for a simultaneous open.
+	defer func(w time.Duration) { SimultaneousOpenWindow = w }(SimultaneousOpenWindow)
+	SimultaneousOpenWindow = 0
+
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	var ct *circuitTransport
+	s := genSwarmWithTransport(ctx, t, true, func(tpt transport.Transport) transport.Transport {
+		ct = newCircuitTransport(tpt)
+		return tpt
+	})
+	defer s.Close()
+	ct.proxied = true
+	if err := s.AddTransport(ct); err != nil {
+		t.Fatal(err)
+	}
+	ct.peers[target.LocalPeer()] = target
+
+	// a direct inbound connection, without dial latency.
+	target.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := target.DialPeer(ctx, s.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(s.ConnsToPeer(target.LocalPeer())) == 0; i++ {
+		if i > 500 {
+			t.Fatal("expected an inbound connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// and an outbound relayed one.
+	relayed, err := s.DialPeerViaRelay(ctx, target.LocalPeer(), testutil.RandPeerIDFatal(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranked := s.RankedConnsToPeer(target.LocalPeer())
+	if len(ranked) != 2 {
+		t.Fatalf("expected 2 conns to peer, got %d", len(ranked))
+	}
+	if ranked[0].Stat().Direction != inet.DirInbound || ranked[1] != relayed {
+		t.Fatal("expected the direct inbound connection to rank before the relayed one")
+	}
+	// DialPeer picks the best connection without ranking them all.
+	if c, err := s.DialPeer(ctx, target.LocalPeer()); err != nil || c != ranked[0] {
+		t.Fatalf("expected DialPeer to return the best connection, got %v (%v)", c, err)
+	}
+}
+
+const pCircuit = 290
+
+// circuitTransport is a fake p2p-circuit transport. Instead of going through
+// the relay, it connects directly to the peer registered for the dialed peer.
+// If proxied is set, its connections look relayed.
+type circuitTransport struct {
+	tcp     transport.Transport
+	proxied bool
+
+	lk     sync.Mutex
+	dialed []ma.Multiaddr
+	peers  map[peer.ID]*Swarm
+}
+
+// relayedConn is a connection made through a circuitTransport.
+type relayedConn struct {
+	transport.Conn
+	t transport.Transport
+}
+
+func (c *relayedConn) Transport() transport.Transport { return c.t }
+
+func newCircuitTransport(tcp transport.Transport) *circuitTransport {
+	if ma.ProtocolWithCode(pCircuit).Code == 0 {
+		err := ma.AddProtocol(ma.Protocol{Name: "p2p-circuit", Code: pCircuit, VCode: ma.CodeToVarint(pCircuit)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	return &circuitTransport{tcp: tcp, peers: make(map[peer.ID]*Swarm)}
+}
+
+func (ct *circuitTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	ct.lk.Lock()
+	ct.dialed = append(ct.dialed, raddr)
+	s := ct.peers[p]
+	ct.lk.Unlock()
+	if s == nil {
+		return nil, errors.New("unknown peer")
+	}
+	c, err := ct.tcp.Dial(ctx, s.ListenAddresses()[0], s.LocalPeer())
+	if err != nil || !ct.proxied {
+		return c, err
+	}
+	return &relayedConn{Conn: c, t: ct}, nil
+}
+
+func (ct *circuitTransport) CanDial(addr ma.Multiaddr) bool { return true }
+
+func (ct *circuitTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func (ct *circuitTransport) Protocols() []int { return []int{pCircuit} }
+
+func (ct *circuitTransport) Proxy() bool { return true }
+
+func TestDialPeerViaRelay(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	relay, target, impostor := swarms[0], swarms[1], swarms[2]
+
+	var ct *circuitTransport
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		ct = newCircuitTransport(tpt)
+		return tpt
+	})
+	defer s.Close()
+	if err := s.AddTransport(ct); err != nil {
+		t.Fatal(err)
+	}
+	ct.peers[target.LocalPeer()] = target
+	ct.peers[relay.LocalPeer()] = impostor
+
+	c, err := s.DialPeerViaRelay(ctx, target.LocalPeer(), relay.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RemotePeer() != target.LocalPeer() {
+		t.Fatalf("expected a connection to %s, got %s", target.LocalPeer(), c.RemotePeer())
+	}
+	expected := ma.StringCast("/p2p/" + relay.LocalPeer().Pretty() + "/p2p-circuit/p2p/" + target.LocalPeer().Pretty())
+	ct.lk.Lock()
+	if len(ct.dialed) != 1 || !ct.dialed[0].Equal(expected) {
+		t.Fatalf("expected to dial %s, dialed %s", expected, ct.dialed)
+	}
+	ct.lk.Unlock()
+
+	// the transport connects us to the wrong peer.
+	if _, err := s.DialPeerViaRelay(ctx, relay.LocalPeer(), target.LocalPeer()); err == nil {
+		t.Fatal("expected the connection to the wrong peer to be rejected")
+	}
+	if len(s.ConnsToPeer(impostor.LocalPeer())) != 0 {
+		t.Fatal("shouldn't have kept the connection to the wrong peer")
+	}
+}
+
+func TestCancelDial(t *testing.T) {
+	ctx := context.Background()
+	s1 := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		return &delayedTransport{Transport: tpt, delay: 5 * time.Second}
+	})
+	defer s1.Close()
+
+	swarms := makeSwarms(ctx, t, 1)
+	defer closeSwarms(swarms)
+	s2 := swarms[0]
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := s1.DialPeer(ctx, s2.LocalPeer())
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	s1.CancelDial(s2.LocalPeer())
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != ErrDialCanceled {
+				t.Fatalf("expected %s, got %v", ErrDialCanceled, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the dial to be canceled")
+		}
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("canceling the dial took %s", d)
+	}
+	if s1.Backoff().Backoff(s2.LocalPeer()) {
+		t.Fatal("shouldn't back off from a peer whose dial was canceled")
+	}
+}
+
+func TestDialBackoffClock(t *testing.T) {
+	clk := swarmt.NewManualClock(time.Now())
+	db := new(DialBackoff)
+	db.SetClock(clk)
+	db.SetBase(time.Second)
+	db.SetCoef(time.Second)
+	db.SetMax(time.Minute)
+
+	p := peer.ID("p")
+	db.AddBackoff(p)
+	if !db.Backoff(p) {
+		t.Fatal("expected to back off")
+	}
+	clk.Advance(time.Second)
+	if db.Backoff(p) {
+		t.Fatal("expected the first backoff to expire after the base")
+	}
+
+	// base + coef * 1^2
+	db.AddBackoff(p)
+	clk.Advance(time.Second)
+	if !db.Backoff(p) {
+		t.Fatal("expected the second backoff to last longer")
+	}
+	clk.Advance(time.Second)
+	if db.Backoff(p) {
+		t.Fatal("expected the second backoff to have expired")
+	}
+
+	db.AddBackoff(p)
+	db.Clear(p)
+	if db.Backoff(p) {
+		t.Fatal("expected no backoff after clearing it")
+	}
+}
+
+func TestSwarmClock(t *testing.T) {
+	ctx := context.Background()
+	s := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s.Close()
+	clk := swarmt.NewManualClock(time.Now())
+	s.SetClock(clk)
+
+	p := peer.ID("p")
+	s.Backoff().AddBackoff(p)
+	if len(s.BackedOffPeers()) != 1 {
+		t.Fatal("expected to back off from the peer")
+	}
+	clk.Advance(BackoffBase)
+	if len(s.BackedOffPeers()) != 0 {
+		t.Fatal("expected the backoff to have expired")
+	}
+}
+
+// hintRecordingTransport records the dial hints it's given.
+type hintRecordingTransport struct {
+	transport.Transport
+
+	lk    sync.Mutex
+	hints []DialHints
+}
+
+func (ht *hintRecordingTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	ht.lk.Lock()
+	ht.hints = append(ht.hints, DialHintsFromContext(ctx))
+	ht.lk.Unlock()
+	return ht.Transport.Dial(ctx, raddr, p)
+}
+
+func TestDialHints(t *testing.T) {
+	ctx := context.Background()
+	ht := new(hintRecordingTransport)
+	s1 := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		ht.Transport = tpt
+		return ht
+	})
+	defer s1.Close()
+
+	swarms := makeSwarms(ctx, t, 1)
+	defer closeSwarms(swarms)
+	s2 := swarms[0]
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	hints := DialHints{"role": "relay", "qos": "bulk"}
+	if _, err := s1.DialPeer(WithDialHints(ctx, hints), s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	ht.lk.Lock()
+	defer ht.lk.Unlock()
+	if len(ht.hints) == 0 {
+		t.Fatal("expected the transport to dial")
+	}
+	for _, h := range ht.hints {
+		if len(h) != 2 || h["role"] != "relay" || h["qos"] != "bulk" {
+			t.Fatalf("expected %v, got %v", hints, h)
+		}
+	}
+}
+
+func TestRefreshConn(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+	s2.SetStreamHandler(func(s inet.Stream) {})
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	old, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	str, err := old.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// backoff doesn't apply.
+	s1.Backoff().AddBackoff(s2.LocalPeer())
+	c, err := s1.RefreshConn(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == old {
+		t.Fatal("expected a new connection")
+	}
+
+	// new streams use the new connection while the old one drains.
+	str2, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str2.Conn() != c {
+		t.Fatal("expected the new stream to use the new connection")
+	}
+	str2.Reset()
+	if old.(*Conn).IsClosed() {
+		t.Fatal("the old connection should stay open until its streams close")
+	}
+	str.Reset()
+	deadline := time.Now().Add(5 * time.Second)
+	for !old.(*Conn).IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the old connection to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a failed refresh keeps the existing connection.
+	s1.Peerstore().ClearAddrs(s2.LocalPeer())
+	if _, err := s1.RefreshConn(ctx, s2.LocalPeer()); err == nil {
+		t.Fatal("expected the refresh to fail without addresses")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if c.(*Conn).IsClosed() {
+		t.Fatal("shouldn't close the connection when the refresh fails")
+	}
+}
+
+func TestDryRunDial(t *testing.T) {
+	ctx := context.Background()
+	s := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s.Close()
+	s.SetAddressFamilyPreference(PreferIPv6)
+	if err := s.AddAddrFilter("/ip4/10.0.0.0/ipcidr/8"); err != nil {
+		t.Fatal(err)
+	}
+
+	p := testutil.RandPeerIDFatal(t)
+	s.Peerstore().AddAddrs(p, []ma.Multiaddr{
+		ma.StringCast("/ip4/1.2.3.4/tcp/1"),
+		ma.StringCast("/ip4/10.0.0.1/tcp/2"),     // filtered
+		ma.StringCast("/ip4/1.2.3.4/udp/3/quic"), // no transport
+		ma.StringCast("/ip6/fe80::1/tcp/4"),      // link-local
+		ma.StringCast("/ip6/2001:db8::1/tcp/5"),
+	}, pstore.PermanentAddrTTL)
+
+	plan, err := s.DryRunDial(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/ip6/2001:db8::1/tcp/5", "/ip4/1.2.3.4/tcp/1"}
+	if len(plan.Addrs) != len(expected) || len(plan.Fallback) != 0 {
+		t.Fatalf("expected to dial %s, got %+v", expected, plan)
+	}
+	for i, pd := range plan.Addrs {
+		if pd.Addr.String() != expected[i] || pd.Transport != "tcp" {
+			t.Fatalf("expected to dial %s over tcp at position %d, got %s over %s", expected[i], i, pd.Addr, pd.Transport)
+		}
+	}
+
+	if n := s.DialStats().Dials; n != 0 {
+		t.Fatalf("expected no dials, got %d", n)
+	}
+
+	if _, err := s.DryRunDial(ctx, testutil.RandPeerIDFatal(t)); err == nil {
+		t.Fatal("expected an error for a peer without addresses")
+	}
+}
+
+func TestMaxDialAddrs(t *testing.T) {
+	ctx := context.Background()
+	rt := new(recordingTransport)
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		rt.Transport = tpt
+		return rt
+	})
+	defer s.Close()
+	s.SetMaxDialAddrs(5)
+
+	p := testutil.RandPeerIDFatal(t)
+	for i := 0; i < 50; i++ {
+		s.Peerstore().AddAddr(p, closedPortAddr(t), pstore.PermanentAddrTTL)
+	}
+	var ranked []ma.Multiaddr
+	s.SetAddrDialOrder(func(_ peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+		ranked = addrs
+		return addrs
+	})
+
+	if _, err := s.DialPeer(ctx, p); err == nil {
+		t.Fatal("dial should have failed")
+	}
+
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+	if len(rt.dialed) != 5 {
+		t.Fatalf("expected 5 dials, got %d", len(rt.dialed))
+	}
+	top := make(map[string]bool)
+	for _, a := range ranked[:5] {
+		top[a.String()] = true
+	}
+	for _, a := range rt.dialed {
+		if !top[a.String()] {
+			t.Fatalf("dialed %s which isn't one of the 5 best addresses %s", a, ranked[:5])
+		}
+	}
+}
+
+func TestRandomizeAddrOrder(t *testing.T) {
+	ctx := context.Background()
+	s := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s.Close()
+	s.SetAddressFamilyPreference(PreferIPv6)
+	s.SetRandomizeAddrOrder(true)
+
+	p := testutil.RandPeerIDFatal(t)
+	best := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+	v6 := ma.StringCast("/ip6/2001:db8::1/tcp/2")
+	ties := []ma.Multiaddr{
+		ma.StringCast("/ip4/1.2.3.5/tcp/3"),
+		ma.StringCast("/ip4/1.2.3.6/tcp/4"),
+		ma.StringCast("/ip4/1.2.3.7/tcp/5"),
+		ma.StringCast("/ip4/1.2.3.8/tcp/6"),
+	}
+	s.Peerstore().AddAddrs(p, append([]ma.Multiaddr{best, v6}, ties...), pstore.PermanentAddrTTL)
+	s.AddrScoreboard().AddSuccess(p, best, time.Millisecond)
+
+	orders := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		plan, err := s.DryRunDial(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.Addrs) != 2+len(ties) {
+			t.Fatalf("expected to dial %d addresses, got %+v", 2+len(ties), plan)
+		}
+		// the family preference and scores still come first.
+		if !plan.Addrs[0].Addr.Equal(v6) || !plan.Addrs[1].Addr.Equal(best) {
+			t.Fatalf("expected %s and %s first, got %+v", v6, best, plan.Addrs)
+		}
+		var order []string
+		for _, pd := range plan.Addrs[2:] {
+			order = append(order, pd.Addr.String())
+		}
+		orders[strings.Join(order, " ")] = true
+	}
+	if len(orders) < 2 {
+		t.Fatalf("expected equally ranked addresses to be shuffled, always got %v", orders)
+	}
+}
+
+func TestDialSyncStats(t *testing.T) {
+	ctx := context.Background()
+	s1 := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		return &delayedTransport{Transport: tpt, delay: 200 * time.Millisecond}
+	})
+	defer s1.Close()
+
+	swarms := makeSwarms(ctx, t, 1)
+	defer closeSwarms(swarms)
+	s2 := swarms[0]
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s1.DialPeer(ctx, s2.LocalPeer())
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := s1.DialSyncStats()
+	if stats.Acquisitions != 1 || stats.Waits != callers-1 || stats.Handoffs != callers-1 {
+		t.Fatalf("expected one dial and %d waits handed its result, got %+v", callers-1, stats)
+	}
+}
+
+func TestPerPeerDialTimeout(t *testing.T) {
+	ctx := context.Background()
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		return &delayedTransport{Transport: tpt, delay: 300 * time.Millisecond}
+	})
+	defer s.Close()
+	s.SetDefaultDialTimeout(150 * time.Millisecond)
+
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	lan, distant := swarms[0].LocalPeer(), swarms[1].LocalPeer()
+	for _, remote := range swarms {
+		s.Peerstore().AddAddrs(remote.LocalPeer(), remote.ListenAddresses(), pstore.PermanentAddrTTL)
+	}
+	s.SetDialTimeout(lan, 50*time.Millisecond)
+	s.SetDialTimeout(distant, 5*time.Second)
+
+	start := time.Now()
+	if _, err := s.DialPeer(ctx, lan); err == nil {
+		t.Fatal("expected the dial to time out")
+	}
+	if d := time.Since(start); d >= 150*time.Millisecond {
+		t.Fatalf("expected the dial to fail fast, took %s", d)
+	}
+	if _, err := s.DialPeer(ctx, distant); err != nil {
+		t.Fatalf("expected the longer timeout to let the dial through: %s", err)
+	}
+
+	// clearing the override restores the swarm's default.
+	s.SetDialTimeout(distant, 0)
+	s.ClosePeer(distant)
+	if _, err := s.DialPeer(ctx, distant); err == nil {
+		t.Fatal("expected the dial to time out")
+	}
+}
+
+// hedgedTransport records when it starts dialing each address and stalls the
+// dials to the slow one.
+type hedgedTransport struct {
+	transport.Transport
+	slow ma.Multiaddr
+
+	lk     sync.Mutex
+	starts map[string]time.Time
+}
+
+func (ht *hedgedTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	ht.lk.Lock()
+	ht.starts[raddr.String()] = time.Now()
+	ht.lk.Unlock()
+	if raddr.Equal(ht.slow) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return ht.Transport.Dial(ctx, raddr, p)
+}
+
+func TestDialHedgeDelay(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+	if err := target.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	addrs := target.ListenAddresses()
+	if len(addrs) != 2 {
+		t.Fatalf("expected two listen addresses, got %s", addrs)
+	}
+	slow, fast := addrs[0], addrs[1]
+
+	ht := &hedgedTransport{slow: slow, starts: make(map[string]time.Time)}
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		ht.Transport = tpt
+		return ht
+	})
+	defer s.Close()
+	hedge := 100 * time.Millisecond
+	s.SetDialHedgeDelay(hedge)
+	// dial the slow address first.
+	s.SetAddrDialOrder(func(peer.ID, []ma.Multiaddr) []ma.Multiaddr {
+		return []ma.Multiaddr{slow, fast}
+	})
+	s.Peerstore().AddAddrs(target.LocalPeer(), addrs, pstore.PermanentAddrTTL)
+
+	c, err := s.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.RemoteMultiaddr().Equal(fast) {
+		t.Fatalf("expected the fast address to win, got %s", c.RemoteMultiaddr())
+	}
+
+	ht.lk.Lock()
+	defer ht.lk.Unlock()
+	slowStart, ok1 := ht.starts[slow.String()]
+	fastStart, ok2 := ht.starts[fast.String()]
+	if !ok1 || !ok2 {
+		t.Fatalf("expected both addresses to be dialed, got %v", ht.starts)
+	}
+	if d := fastStart.Sub(slowStart); d < hedge {
+		t.Fatalf("expected the fast address to be dialed after the hedge delay, was dialed after %s", d)
+	}
+}
+
+func TestDialSettersWhileDialing(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s1.SetDialAttempts(1 + i%2)
+			s1.SetMaxDialAddrs(i % 3)
+			s1.SetDefaultDialTimeout(time.Minute)
+			s1.SetRequireEncryption(i%2 == 0)
+			s1.SetAddrDialOrder(nil)
+			s1.SetAddressFamilyPreference(NoPreference)
+			s1.SetDialHedgeDelay(time.Duration(i%2) * time.Millisecond)
+			s1.SetDialFallback(nil)
+			s1.SetTransportSelector(nil)
+			s1.SetDialLocalAddr(nil)
+			s1.SetConnSocketOpts(&ConnSocketOpts{})
+			s1.SetRandomizeAddrOrder(i%2 == 0)
+			s1.SetConnDeadline(0)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		if _, err := s1.NewStream(ctx, s2.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range s1.ConnsToPeer(s2.LocalPeer()) {
+			c.Close()
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -4,8 +4,10 @@ require (
 	github.com/ipfs/go-log v0.0.1
 	github.com/jbenet/goprocess v0.0.0-20160826012719-b497e2f366b8
 	github.com/libp2p/go-addr-util v0.0.1
+	github.com/libp2p/go-conn-security v0.0.1
 	github.com/libp2p/go-conn-security-multistream v0.0.1
 	github.com/libp2p/go-libp2p-crypto v0.0.1
+	github.com/libp2p/go-libp2p-interface-pnet v0.0.1
 	github.com/libp2p/go-libp2p-loggables v0.0.1
 	github.com/libp2p/go-libp2p-metrics v0.0.1
 	github.com/libp2p/go-libp2p-net v0.0.1
@@ -20,6 +22,7 @@ require (
 	github.com/libp2p/go-tcp-transport v0.0.1
 	github.com/libp2p/go-testutil v0.0.1
 	github.com/multiformats/go-multiaddr v0.0.1
+	github.com/multiformats/go-multiaddr-dns v0.0.1
 	github.com/multiformats/go-multiaddr-net v0.0.1
 	github.com/whyrusleeping/go-smux-multistream v2.0.2+incompatible
 	github.com/whyrusleeping/go-smux-yamux v2.0.8+incompatible
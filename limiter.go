@@ -14,9 +14,10 @@ import (
 )
 
 type dialResult struct {
-	Conn transport.Conn
-	Addr ma.Multiaddr
-	Err  error
+	Conn    transport.Conn
+	Addr    ma.Multiaddr
+	Err     error
+	Latency time.Duration
 }
 
 type dialJob struct {
@@ -24,12 +25,33 @@ type dialJob struct {
 	peer peer.ID
 	ctx  context.Context
 	resp chan dialResult
+
+	// priority orders the job in the limiter's waitlists, see
+	// WithDialPriority.
+	priority DialPriority
+
+	// consumesFd is set when the job is added to the limiter.
+	consumesFd bool
 }
 
 func (dj *dialJob) cancelled() bool {
 	return dj.ctx.Err() != nil
 }
 
+// drop reports that the job was dropped without being dialed. The response
+// channel is expected to have room for one result per job (see
+// Swarm.dialAddrs), so this never blocks.
+func (dj *dialJob) drop() {
+	err := dj.ctx.Err()
+	if err == nil {
+		err = context.Canceled
+	}
+	select {
+	case dj.resp <- dialResult{Addr: dj.addr, Err: err}:
+	default:
+	}
+}
+
 func (dj *dialJob) dialTimeout() time.Duration {
 	timeout := transport.DialTimeout
 	if lowTimeoutFilters.AddrBlocked(dj.addr) {
@@ -46,32 +68,62 @@ type dialLimiter struct {
 	fdLimit     int
 	waitingOnFd []*dialJob
 
-	dialFunc dialfunc
+	// dials that don't consume file descriptors get their own, more
+	// generous, limit.
+	nonFdConsuming int
+	nonFdLimit     int
+	waitingOnNonFd []*dialJob
+
+	dialFunc   dialfunc
+	consumesFd func(ma.Multiaddr) bool
+
+	// active holds the dials currently running.
+	active map[*dialJob]struct{}
 
 	activePerPeer      map[peer.ID]int
 	perPeerLimit       int
+	perPeerOverrides   map[peer.ID]int
 	waitingOnPeerLimit map[peer.ID][]*dialJob
 }
 
+// enqueue adds dj to the given waitlist, after the jobs with the same or a
+// higher priority.
+func enqueue(waiting []*dialJob, dj *dialJob) []*dialJob {
+	i := len(waiting)
+	for i > 0 && waiting[i-1].priority < dj.priority {
+		i--
+	}
+	waiting = append(waiting, nil)
+	copy(waiting[i+1:], waiting[i:])
+	waiting[i] = dj
+	return waiting
+}
+
 type dialfunc func(context.Context, peer.ID, ma.Multiaddr) (transport.Conn, error)
 
-func newDialLimiter(df dialfunc) *dialLimiter {
+func newDialLimiter(df dialfunc, consumesFd func(ma.Multiaddr) bool) *dialLimiter {
 	fd := ConcurrentFdDials
 	if env := os.Getenv("LIBP2P_SWARM_FD_LIMIT"); env != "" {
 		if n, err := strconv.ParseInt(env, 10, 32); err == nil {
 			fd = int(n)
 		}
 	}
-	return newDialLimiterWithParams(df, fd, DefaultPerPeerRateLimit)
+	dl := newDialLimiterWithParams(df, fd, DefaultPerPeerRateLimit)
+	dl.consumesFd = consumesFd
+	return dl
 }
 
 func newDialLimiterWithParams(df dialfunc, fdLimit, perPeerLimit int) *dialLimiter {
 	return &dialLimiter{
 		fdLimit:            fdLimit,
+		nonFdLimit:         ConcurrentNonFdDials,
 		perPeerLimit:       perPeerLimit,
+		perPeerOverrides:   make(map[peer.ID]int),
 		waitingOnPeerLimit: make(map[peer.ID][]*dialJob),
 		activePerPeer:      make(map[peer.ID]int),
+		active:             make(map[*dialJob]struct{}),
 		dialFunc:           df,
+		consumesFd:         addrutil.IsFDCostlyTransport,
 	}
 }
 
@@ -80,25 +132,40 @@ func newDialLimiterWithParams(df dialfunc, fdLimit, perPeerLimit int) *dialLimit
 func (dl *dialLimiter) freeFDToken() {
 	log.Debugf("[limiter] freeing FD token; waiting: %d; consuming: %d", len(dl.waitingOnFd), dl.fdConsuming)
 	dl.fdConsuming--
+	dl.scheduleWaiting(&dl.waitingOnFd, &dl.fdConsuming)
+}
+
+// freeNonFDToken is like freeFDToken, but for dials that don't consume file
+// descriptors.
+func (dl *dialLimiter) freeNonFDToken() {
+	log.Debugf("[limiter] freeing non-FD token; waiting: %d; consuming: %d", len(dl.waitingOnNonFd), dl.nonFdConsuming)
+	dl.nonFdConsuming--
+	dl.scheduleWaiting(&dl.waitingOnNonFd, &dl.nonFdConsuming)
+}
 
-	for len(dl.waitingOnFd) > 0 {
-		next := dl.waitingOnFd[0]
-		dl.waitingOnFd[0] = nil // clear out memory
-		dl.waitingOnFd = dl.waitingOnFd[1:]
+// scheduleWaiting starts the first non-cancelled dialJob in the given
+// waitlist, taking a token for it.
+func (dl *dialLimiter) scheduleWaiting(waiting *[]*dialJob, consuming *int) {
+	for len(*waiting) > 0 {
+		next := (*waiting)[0]
+		(*waiting)[0] = nil // clear out memory
+		*waiting = (*waiting)[1:]
 
-		if len(dl.waitingOnFd) == 0 {
+		if len(*waiting) == 0 {
 			// clear out memory.
-			dl.waitingOnFd = nil
+			*waiting = nil
 		}
 
 		// Skip over canceled dials instead of queuing up a goroutine.
 		if next.cancelled() {
+			next.drop()
 			dl.freePeerToken(next)
 			continue
 		}
-		dl.fdConsuming++
+		*consuming++
 
 		// we already have activePerPeer token at this point so we can just dial
+		dl.active[next] = struct{}{}
 		go dl.executeDial(next)
 		return
 	}
@@ -113,8 +180,14 @@ func (dl *dialLimiter) freePeerToken(dj *dialJob) {
 		delete(dl.activePerPeer, dj.peer)
 	}
 
-	waitlist := dl.waitingOnPeerLimit[dj.peer]
-	for len(waitlist) > 0 {
+	dl.scheduleWaitingOnPeer(dj.peer)
+}
+
+// scheduleWaitingOnPeer starts dials waiting on peer p's limit until the limit
+// is reached again.
+func (dl *dialLimiter) scheduleWaitingOnPeer(p peer.ID) {
+	waitlist := dl.waitingOnPeerLimit[p]
+	for len(waitlist) > 0 && dl.activePerPeer[p] < dl.peerLimit(p) {
 		next := waitlist[0]
 		waitlist[0] = nil // clear out memory
 		waitlist = waitlist[1:]
@@ -126,33 +199,60 @@ func (dl *dialLimiter) freePeerToken(dj *dialJob) {
 		}
 
 		if next.cancelled() {
+			next.drop()
 			continue
 		}
 
 		dl.activePerPeer[next.peer]++ // just kidding, we still want this token
 
 		dl.addCheckFdLimit(next)
-		return
 	}
 }
 
+// peerLimit returns the maximum number of concurrent dials to peer p.
+func (dl *dialLimiter) peerLimit(p peer.ID) int {
+	if limit, ok := dl.perPeerOverrides[p]; ok {
+		return limit
+	}
+	return dl.perPeerLimit
+}
+
+// setPeerLimit overrides the maximum number of concurrent dials to peer p. A
+// limit <= 0 restores the default.
+func (dl *dialLimiter) setPeerLimit(p peer.ID, limit int) {
+	dl.lk.Lock()
+	defer dl.lk.Unlock()
+
+	if limit <= 0 {
+		delete(dl.perPeerOverrides, p)
+	} else {
+		dl.perPeerOverrides[p] = limit
+	}
+
+	// the limit may have been raised.
+	dl.scheduleWaitingOnPeer(p)
+}
+
 func (dl *dialLimiter) finishedDial(dj *dialJob) {
 	dl.lk.Lock()
 	defer dl.lk.Unlock()
 
-	if addrutil.IsFDCostlyTransport(dj.addr) {
+	delete(dl.active, dj)
+	if dj.consumesFd {
 		dl.freeFDToken()
+	} else {
+		dl.freeNonFDToken()
 	}
 
 	dl.freePeerToken(dj)
 }
 
 func (dl *dialLimiter) addCheckFdLimit(dj *dialJob) {
-	if addrutil.IsFDCostlyTransport(dj.addr) {
+	if dj.consumesFd {
 		if dl.fdConsuming >= dl.fdLimit {
 			log.Debugf("[limiter] blocked dial waiting on FD token; peer: %s; addr: %s; consuming: %d; "+
 				"limit: %d; waiting: %d", dj.peer, dj.addr, dl.fdConsuming, dl.fdLimit, len(dl.waitingOnFd))
-			dl.waitingOnFd = append(dl.waitingOnFd, dj)
+			dl.waitingOnFd = enqueue(dl.waitingOnFd, dj)
 			return
 		}
 
@@ -160,20 +260,28 @@ func (dl *dialLimiter) addCheckFdLimit(dj *dialJob) {
 			dj.peer, dj.addr, dl.fdConsuming)
 		// take token
 		dl.fdConsuming++
+	} else {
+		if dl.nonFdConsuming >= dl.nonFdLimit {
+			log.Debugf("[limiter] blocked dial waiting on non-FD token; peer: %s; addr: %s; consuming: %d; "+
+				"limit: %d; waiting: %d", dj.peer, dj.addr, dl.nonFdConsuming, dl.nonFdLimit, len(dl.waitingOnNonFd))
+			dl.waitingOnNonFd = enqueue(dl.waitingOnNonFd, dj)
+			return
+		}
+		dl.nonFdConsuming++
 	}
 
 	log.Debugf("[limiter] executing dial; peer: %s; addr: %s; FD consuming: %d; waiting: %d",
 		dj.peer, dj.addr, dl.fdConsuming, len(dl.waitingOnFd))
+	dl.active[dj] = struct{}{}
 	go dl.executeDial(dj)
 }
 
 func (dl *dialLimiter) addCheckPeerLimit(dj *dialJob) {
-	if dl.activePerPeer[dj.peer] >= dl.perPeerLimit {
+	if limit := dl.peerLimit(dj.peer); dl.activePerPeer[dj.peer] >= limit {
 		log.Debugf("[limiter] blocked dial waiting on peer limit; peer: %s; addr: %s; active: %d; "+
-			"peer limit: %d; waiting: %d", dj.peer, dj.addr, dl.activePerPeer[dj.peer], dl.perPeerLimit,
+			"peer limit: %d; waiting: %d", dj.peer, dj.addr, dl.activePerPeer[dj.peer], limit,
 			len(dl.waitingOnPeerLimit[dj.peer]))
-		wlist := dl.waitingOnPeerLimit[dj.peer]
-		dl.waitingOnPeerLimit[dj.peer] = append(wlist, dj)
+		dl.waitingOnPeerLimit[dj.peer] = enqueue(dl.waitingOnPeerLimit[dj.peer], dj)
 		return
 	}
 	dl.activePerPeer[dj.peer]++
@@ -189,12 +297,16 @@ func (dl *dialLimiter) AddDialJob(dj *dialJob) {
 	defer dl.lk.Unlock()
 
 	log.Debugf("[limiter] adding a dial job through limiter: %v", dj.addr)
+	dj.consumesFd = dl.consumesFd(dj.addr)
 	dl.addCheckPeerLimit(dj)
 }
 
 func (dl *dialLimiter) clearAllPeerDials(p peer.ID) {
 	dl.lk.Lock()
 	defer dl.lk.Unlock()
+	for _, dj := range dl.waitingOnPeerLimit[p] {
+		dj.drop()
+	}
 	delete(dl.waitingOnPeerLimit, p)
 	log.Debugf("[limiter] clearing all peer dials: %v", p)
 	// NB: the waitingOnFd list doesn't need to be cleaned out here, we will
@@ -202,24 +314,82 @@ func (dl *dialLimiter) clearAllPeerDials(p peer.ID) {
 	// point
 }
 
+// pendingDials returns the running dials followed by the queued ones. Dials
+// that have been canceled but not yet dropped from their queue are skipped.
+func (dl *dialLimiter) pendingDials() []PendingDial {
+	dl.lk.Lock()
+	defer dl.lk.Unlock()
+
+	var pending []PendingDial
+	for dj := range dl.active {
+		pending = append(pending, PendingDial{Peer: dj.peer, Addr: dj.addr, Queue: DialActive})
+	}
+	queued := func(q DialQueue, waiting []*dialJob) {
+		pos := 0
+		for _, dj := range waiting {
+			if dj.cancelled() {
+				continue
+			}
+			pending = append(pending, PendingDial{Peer: dj.peer, Addr: dj.addr, Queue: q, Position: pos})
+			pos++
+		}
+	}
+	for _, waiting := range dl.waitingOnPeerLimit {
+		queued(DialWaitingOnPeerLimit, waiting)
+	}
+	queued(DialWaitingOnFdLimit, dl.waitingOnFd)
+	queued(DialWaitingOnNonFdLimit, dl.waitingOnNonFd)
+	return pending
+}
+
+// stats returns a snapshot of the limiter's usage.
+func (dl *dialLimiter) stats() LimiterStats {
+	dl.lk.Lock()
+	defer dl.lk.Unlock()
+
+	waitingOnPeer := 0
+	for _, waiting := range dl.waitingOnPeerLimit {
+		waitingOnPeer += len(waiting)
+	}
+	return LimiterStats{
+		FdDials:            dl.fdConsuming,
+		FdLimit:            dl.fdLimit,
+		WaitingOnFd:        len(dl.waitingOnFd),
+		NonFdDials:         dl.nonFdConsuming,
+		NonFdLimit:         dl.nonFdLimit,
+		WaitingOnNonFd:     len(dl.waitingOnNonFd),
+		WaitingOnPeerLimit: waitingOnPeer,
+	}
+}
+
 // executeDial calls the dialFunc, and reports the result through the response
 // channel when finished. Once the response is sent it also releases all tokens
 // it held during the dial.
+//
+// The address's dial timeout (see dialJob.dialTimeout) only starts now, once
+// the job has been dequeued, so time spent waiting on the limits doesn't eat
+// into it. The job's context doesn't carry the DialPeer deadlines: it's
+// canceled once every caller waiting on the dial has given up (see
+// DialSync.DialLock), e.g. because its deadline passed.
 func (dl *dialLimiter) executeDial(j *dialJob) {
 	defer dl.finishedDial(j)
 	if j.cancelled() {
+		j.drop()
 		return
 	}
 
 	dctx, cancel := context.WithTimeout(j.ctx, j.dialTimeout())
 	defer cancel()
 
+	start := time.Now()
 	con, err := dl.dialFunc(dctx, j.peer, j.addr)
+	latency := time.Since(start)
 	select {
-	case j.resp <- dialResult{Conn: con, Addr: j.addr, Err: err}:
+	case j.resp <- dialResult{Conn: con, Addr: j.addr, Err: err, Latency: latency}:
 	case <-j.ctx.Done():
 		if err == nil {
 			con.Close()
 		}
+		j.drop()
 	}
 }
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	peer "github.com/libp2p/go-libp2p-peer"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
 	transport "github.com/libp2p/go-libp2p-transport"
 	ma "github.com/multiformats/go-multiaddr"
 	mafmt "github.com/whyrusleeping/mafmt"
@@ -386,3 +387,292 @@ func TestFDLimitUnderflow(t *testing.T) {
 		t.Fatalf("l.fdConsuming < 0")
 	}
 }
+
+// fdFreeTransport is a mock udp transport whose dials don't consume file
+// descriptors.
+type fdFreeTransport struct{}
+
+func (ft *fdFreeTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	panic("unimplemented")
+}
+
+func (ft *fdFreeTransport) CanDial(addr ma.Multiaddr) bool {
+	return true
+}
+
+func (ft *fdFreeTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	panic("unimplemented")
+}
+
+func (ft *fdFreeTransport) Proxy() bool {
+	return false
+}
+
+func (ft *fdFreeTransport) Protocols() []int {
+	return []int{ma.P_UDP}
+}
+
+func (ft *fdFreeTransport) ConsumesFd() bool {
+	return false
+}
+
+func TestFdFreeDialsNotFdLimited(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewSwarm(ctx, peer.ID("local"), pstoremem.NewPeerstore(), nil)
+	defer s.Close()
+	if err := s.AddTransport(new(fdFreeTransport)); err != nil {
+		t.Fatal(err)
+	}
+
+	hang := make(chan struct{})
+	defer close(hang)
+	df := func(ctx context.Context, p peer.ID, a ma.Multiaddr) (transport.Conn, error) {
+		if mafmt.TCP.Matches(a) {
+			<-hang
+			return nil, fmt.Errorf("test bad dial")
+		}
+		return transport.Conn(nil), nil
+	}
+
+	l := newDialLimiterWithParams(df, 1, 10)
+	l.consumesFd = s.dialConsumesFd
+
+	resch := make(chan dialResult)
+	pid := peer.ID("testpeer")
+
+	// use up the only fd token.
+	tryDialAddrs(ctx, l, pid, []ma.Multiaddr{addrWithPort(t, 1), addrWithPort(t, 2)}, resch)
+	tryDialAddrs(ctx, l, pid, []ma.Multiaddr{mustAddr(t, "/ip4/127.0.0.1/udp/1234")}, resch)
+
+	select {
+	case r := <-resch:
+		if r.Err != nil {
+			t.Fatal("expected fd-free dial to succeed:", r.Err)
+		}
+		if !mafmt.UDP.Matches(r.Addr) {
+			t.Fatal("expected the fd-free dial to complete first, got", r.Addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fd-free dial was blocked by the fd limit")
+	}
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.fdConsuming != 1 || len(l.waitingOnFd) != 1 {
+		t.Fatalf("expected 1 fd dial in progress and 1 waiting, got %d and %d", l.fdConsuming, len(l.waitingOnFd))
+	}
+}
+
+func TestPerPeerLimitOverride(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	var lk sync.Mutex
+	active, maxActive := 0, 0
+	df := func(ctx context.Context, p peer.ID, a ma.Multiaddr) (transport.Conn, error) {
+		lk.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		lk.Unlock()
+
+		<-hang
+
+		lk.Lock()
+		active--
+		lk.Unlock()
+		return nil, fmt.Errorf("test bad dial")
+	}
+
+	l := newDialLimiterWithParams(df, ConcurrentFdDials, 3)
+	pid := peer.ID("testpeer")
+	l.setPeerLimit(pid, 1)
+
+	var addrs []ma.Multiaddr
+	for i := 1; i <= 5; i++ {
+		addrs = append(addrs, addrWithPort(t, i))
+	}
+	resch := make(chan dialResult, len(addrs))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tryDialAddrs(ctx, l, pid, addrs, resch)
+
+	waitActive := func(expected int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			lk.Lock()
+			a := active
+			lk.Unlock()
+			if a == expected {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d active dials, got %d", expected, a)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		// make sure no extra dials sneak in.
+		time.Sleep(20 * time.Millisecond)
+		lk.Lock()
+		defer lk.Unlock()
+		if active != expected {
+			t.Fatalf("expected %d active dials, got %d", expected, active)
+		}
+	}
+
+	waitActive(1)
+
+	// finish a dial, the next one should take its place.
+	hang <- struct{}{}
+	<-resch
+	waitActive(1)
+
+	// clearing the override restores the default limit.
+	l.setPeerLimit(pid, 0)
+	waitActive(3)
+
+	lk.Lock()
+	defer lk.Unlock()
+	if maxActive != 3 {
+		t.Fatalf("expected at most 3 concurrent dials, got %d", maxActive)
+	}
+}
+
+func TestPendingDials(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	l := newDialLimiterWithParams(hangDialFunc(hang), 2, 3)
+
+	bads := []ma.Multiaddr{addrWithPort(t, 1), addrWithPort(t, 2), addrWithPort(t, 3), addrWithPort(t, 4)}
+	pidA, pidB := peer.ID("testpeer1"), peer.ID("testpeer2")
+
+	ctx := context.Background()
+	resch := make(chan dialResult, 5)
+
+	// A takes both FD tokens, queues one dial on the FD limit and one on its
+	// peer limit. B queues behind A on the FD limit.
+	tryDialAddrs(ctx, l, pidA, bads, resch)
+	tryDialAddrs(ctx, l, pidB, bads[:1], resch)
+
+	type key struct {
+		peer  peer.ID
+		queue DialQueue
+		pos   int
+	}
+	expected := map[key]int{
+		{pidA, DialActive, 0}:             2,
+		{pidA, DialWaitingOnFdLimit, 0}:   1,
+		{pidA, DialWaitingOnPeerLimit, 0}: 1,
+		{pidB, DialWaitingOnFdLimit, 1}:   1,
+	}
+	actual := make(map[key]int)
+	for _, pd := range l.pendingDials() {
+		actual[key{pd.Peer, pd.Queue, pd.Position}]++
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+	for k, n := range expected {
+		if actual[k] != n {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+	}
+}
+
+func TestDialPriority(t *testing.T) {
+	for _, perPeer := range []bool{false, true} {
+		hang := make(chan struct{})
+		l := newDialLimiterWithParams(hangDialFunc(hang), 1, 1)
+		if !perPeer {
+			// only the fd limit applies.
+			l.perPeerLimit = 100
+		}
+
+		peerFor := func(i int) peer.ID {
+			if perPeer {
+				return peer.ID("testpeer")
+			}
+			return peer.ID(fmt.Sprintf("testpeer%d", i))
+		}
+
+		resch := make(chan dialResult, 4)
+		ctx, cancel := context.WithCancel(context.Background())
+		for i, prio := range []DialPriority{DialPriorityNormal, DialPriorityLow, DialPriorityNormal, DialPriorityHigh} {
+			l.AddDialJob(&dialJob{
+				ctx:      ctx,
+				peer:     peerFor(i),
+				addr:     addrWithPort(t, i+1),
+				resp:     resch,
+				priority: prio,
+			})
+		}
+
+		// the first dial is running, the others wait.
+		for _, port := range []int{1, 4, 3, 2} {
+			hang <- struct{}{}
+			select {
+			case r := <-resch:
+				if !r.Addr.Equal(addrWithPort(t, port)) {
+					t.Fatalf("perPeer=%t: expected the dial to port %d to finish, got %s", perPeer, port, r.Addr)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for dial completion")
+			}
+		}
+		cancel()
+	}
+}
+
+func TestLimiterTimeoutStartsWhenDequeued(t *testing.T) {
+	defer func(d time.Duration) { DialTimeoutLocal = d }(DialTimeoutLocal)
+	DialTimeoutLocal = 300 * time.Millisecond
+	queued := 200 * time.Millisecond
+
+	var lk sync.Mutex
+	budgets := make(map[string]time.Duration)
+	df := func(ctx context.Context, p peer.ID, a ma.Multiaddr) (transport.Conn, error) {
+		deadline, _ := ctx.Deadline()
+		lk.Lock()
+		budgets[a.String()] = time.Until(deadline)
+		lk.Unlock()
+		time.Sleep(queued)
+		return nil, fmt.Errorf("test bad dial")
+	}
+	budget := func(a ma.Multiaddr) time.Duration {
+		lk.Lock()
+		defer lk.Unlock()
+		return budgets[a.String()]
+	}
+	l := newDialLimiterWithParams(df, 1, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// local addresses get DialTimeoutLocal, the second one waits on the
+	// first for the fd limit.
+	addrs := []ma.Multiaddr{mustAddr(t, "/ip4/192.168.0.1/tcp/1"), mustAddr(t, "/ip4/192.168.0.2/tcp/2")}
+	res := make(chan dialResult, len(addrs))
+	tryDialAddrs(ctx, l, peer.ID("testpeer"), addrs, res)
+	for range addrs {
+		<-res
+	}
+
+	for _, a := range addrs {
+		if b := budget(a); b <= DialTimeoutLocal-queued/2 {
+			t.Fatalf("expected %s to get its full %s dial timeout, got %s", a, DialTimeoutLocal, b)
+		}
+	}
+
+	// the peer's deadline still caps the dial.
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	a := mustAddr(t, "/ip4/192.168.0.3/tcp/3")
+	tryDialAddrs(short, l, peer.ID("testpeer"), []ma.Multiaddr{a}, res)
+	<-res
+	if b := budget(a); b > 50*time.Millisecond {
+		t.Fatalf("expected the peer's deadline to cap the dial, got %s", b)
+	}
+}
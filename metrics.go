@@ -0,0 +1,197 @@
+package swarm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	transport "github.com/libp2p/go-libp2p-transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DialStats is a snapshot of the swarm's dial counters.
+type DialStats struct {
+	// Dials is the number of peer dials attempted.
+	Dials int64
+	// Successes is the number of peer dials that succeeded.
+	Successes int64
+	// Failures is the number of peer dials that failed.
+	Failures int64
+	// Backoffs is the number of peer dials rejected due to backoff.
+	Backoffs int64
+	// DialsToSelf is the number of attempts to dial ourselves.
+	DialsToSelf int64
+}
+
+// TransportDialStats is a snapshot of the outcomes of the dials made over a
+// single transport.
+type TransportDialStats struct {
+	Success int
+	Fail    int
+}
+
+// dialMetrics tracks the outcomes of the swarm's dials.
+//
+// The peer level counters are updated atomically, the per-transport counters
+// are guarded by a lock.
+type dialMetrics struct {
+	dials       int64
+	successes   int64
+	failures    int64
+	backoffs    int64
+	dialsToSelf int64
+
+	transports struct {
+		sync.Mutex
+		m map[string]*transportDialStats
+	}
+}
+
+type transportDialStats struct {
+	success int64
+	fail    int64
+}
+
+// transportName returns a human readable name for the given transport. We use
+// the name of the first protocol it handles (e.g., "tcp").
+func transportName(t transport.Transport) string {
+	protocols := t.Protocols()
+	if len(protocols) == 0 {
+		return fmt.Sprintf("%T", t)
+	}
+	name := ma.ProtocolWithCode(protocols[0]).Name
+	if name == "" {
+		name = fmt.Sprintf("unknown (%d)", protocols[0])
+	}
+	return name
+}
+
+// recordTransportDial records the outcome of a single dial over the given
+// transport.
+func (ds *dialMetrics) recordTransportDial(t transport.Transport, err error) {
+	name := transportName(t)
+
+	ds.transports.Lock()
+	defer ds.transports.Unlock()
+	if ds.transports.m == nil {
+		ds.transports.m = make(map[string]*transportDialStats)
+	}
+	ts, ok := ds.transports.m[name]
+	if !ok {
+		ts = new(transportDialStats)
+		ds.transports.m[name] = ts
+	}
+	if err != nil {
+		ts.fail++
+	} else {
+		ts.success++
+	}
+}
+
+// DialSyncStats returns a snapshot of the counters of the swarm's dial
+// synchronization. It's empty if the swarm's DialSyncer doesn't keep any
+// (i.e., doesn't have a Stats method like DialSync's).
+func (s *Swarm) DialSyncStats() DialSyncStats {
+	if ds, ok := s.dsync.(interface{ Stats() DialSyncStats }); ok {
+		return ds.Stats()
+	}
+	return DialSyncStats{}
+}
+
+// DialStats returns a snapshot of the swarm's dial counters.
+func (s *Swarm) DialStats() DialStats {
+	return DialStats{
+		Dials:       atomic.LoadInt64(&s.dstats.dials),
+		Successes:   atomic.LoadInt64(&s.dstats.successes),
+		Failures:    atomic.LoadInt64(&s.dstats.failures),
+		Backoffs:    atomic.LoadInt64(&s.dstats.backoffs),
+		DialsToSelf: atomic.LoadInt64(&s.dstats.dialsToSelf),
+	}
+}
+
+// TransportDialStats returns a snapshot of the outcomes of the swarm's address
+// dials, keyed by transport (named after the first protocol it handles, e.g.,
+// "tcp").
+func (s *Swarm) TransportDialStats() map[string]TransportDialStats {
+	s.dstats.transports.Lock()
+	defer s.dstats.transports.Unlock()
+
+	stats := make(map[string]TransportDialStats, len(s.dstats.transports.m))
+	for name, ts := range s.dstats.transports.m {
+		stats[name] = TransportDialStats{
+			Success: int(ts.success),
+			Fail:    int(ts.fail),
+		}
+	}
+	return stats
+}
+
+// WriteMetrics writes the swarm's dial and connection metrics to w in the
+// OpenMetrics text exposition format (which Prometheus can scrape).
+//
+// This doesn't depend on any metrics library. Users that already have one
+// should hook into the swarm's notifications instead.
+func (s *Swarm) WriteMetrics(w io.Writer) error {
+	var buf bytes.Buffer
+
+	writeFamily := func(name, typ, help string) {
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, typ)
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, help)
+	}
+
+	counters := []struct {
+		name, help string
+		v          *int64
+	}{
+		{"libp2p_swarm_dials", "Number of peer dials attempted.", &s.dstats.dials},
+		{"libp2p_swarm_dial_successes", "Number of peer dials that succeeded.", &s.dstats.successes},
+		{"libp2p_swarm_dial_failures", "Number of peer dials that failed.", &s.dstats.failures},
+		{"libp2p_swarm_dial_backoffs", "Number of peer dials rejected due to backoff.", &s.dstats.backoffs},
+		{"libp2p_swarm_dials_to_self", "Number of attempts to dial ourselves.", &s.dstats.dialsToSelf},
+	}
+	for _, c := range counters {
+		writeFamily(c.name, "counter", c.help)
+		fmt.Fprintf(&buf, "%s_total %d\n", c.name, atomic.LoadInt64(c.v))
+	}
+
+	var inbound, outbound int
+	s.conns.RLock()
+	for _, cs := range s.conns.m {
+		for _, c := range cs {
+			if c.stat.Direction == inet.DirInbound {
+				inbound++
+			} else {
+				outbound++
+			}
+		}
+	}
+	s.conns.RUnlock()
+
+	writeFamily("libp2p_swarm_connections", "gauge", "Number of open connections.")
+	fmt.Fprintf(&buf, "libp2p_swarm_connections{direction=\"inbound\"} %d\n", inbound)
+	fmt.Fprintf(&buf, "libp2p_swarm_connections{direction=\"outbound\"} %d\n", outbound)
+
+	s.dstats.transports.Lock()
+	names := make([]string, 0, len(s.dstats.transports.m))
+	for name := range s.dstats.transports.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeFamily("libp2p_swarm_transport_dials", "counter", "Number of address dials by transport and outcome.")
+	for _, name := range names {
+		ts := s.dstats.transports.m[name]
+		fmt.Fprintf(&buf, "libp2p_swarm_transport_dials_total{transport=%q,outcome=\"success\"} %d\n", name, ts.success)
+		fmt.Fprintf(&buf, "libp2p_swarm_transport_dials_total{transport=%q,outcome=\"failure\"} %d\n", name, ts.fail)
+	}
+	s.dstats.transports.Unlock()
+
+	buf.WriteString("# EOF\n")
+
+	_, err := buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,183 @@
+package swarm_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	transport "github.com/libp2p/go-libp2p-transport"
+	testutil "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+func parseMetrics(t *testing.T, s *Swarm) map[string]string {
+	var buf bytes.Buffer
+	if err := s.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "# EOF\n") {
+		t.Fatal("metrics should end with an EOF marker")
+	}
+
+	metrics := make(map[string]string)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			t.Fatalf("malformed metric line: %q", line)
+		}
+		metrics[line[:i]] = line[i+1:]
+	}
+	return metrics
+}
+
+func TestWriteMetrics(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	// one successful dial
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	// one failed dial to a closed port, followed by a backed off dial.
+	dead := testutil.RandPeerIDFatal(t)
+	s1.Peerstore().AddAddr(dead, closedPortAddr(t), pstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, dead); err == nil {
+		t.Fatal("dial to a closed port should have failed")
+	}
+	if _, err := s1.DialPeer(ctx, dead); err != ErrDialBackoff {
+		t.Fatalf("expected dial backoff, got: %v", err)
+	}
+
+	metrics := parseMetrics(t, s1)
+	for name, expected := range map[string]string{
+		"libp2p_swarm_dials_total":                                              "2",
+		"libp2p_swarm_dial_successes_total":                                     "1",
+		"libp2p_swarm_dial_failures_total":                                      "1",
+		"libp2p_swarm_dial_backoffs_total":                                      "1",
+		`libp2p_swarm_connections{direction="outbound"}`:                        "1",
+		`libp2p_swarm_connections{direction="inbound"}`:                         "0",
+		`libp2p_swarm_transport_dials_total{transport="tcp",outcome="success"}`: "1",
+		`libp2p_swarm_transport_dials_total{transport="tcp",outcome="failure"}`: "1",
+	} {
+		if v, ok := metrics[name]; !ok {
+			t.Errorf("missing metric %s", name)
+		} else if v != expected {
+			t.Errorf("expected %s to be %s, got %s", name, expected, v)
+		}
+	}
+}
+
+func TestDialStats(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s1, s2, s3 := swarms[0], swarms[1], swarms[2]
+
+	for _, s := range []*Swarm{s2, s3} {
+		s1.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), pstore.PermanentAddrTTL)
+		if _, err := s1.DialPeer(ctx, s.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dead := testutil.RandPeerIDFatal(t)
+	s1.Peerstore().AddAddr(dead, closedPortAddr(t), pstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, dead); err == nil {
+		t.Fatal("dial to a closed port should have failed")
+	}
+	if _, err := s1.DialPeer(ctx, dead); err != ErrDialBackoff {
+		t.Fatalf("expected dial backoff, got: %v", err)
+	}
+	if _, err := s1.DialPeer(ctx, s1.LocalPeer()); err != ErrDialToSelf {
+		t.Fatalf("expected dial to self error, got: %v", err)
+	}
+
+	expected := DialStats{
+		Dials:       3,
+		Successes:   2,
+		Failures:    1,
+		Backoffs:    1,
+		DialsToSelf: 1,
+	}
+	if stats := s1.DialStats(); stats != expected {
+		t.Fatalf("expected dial stats %+v, got %+v", expected, stats)
+	}
+}
+
+// failingTransport is a transport for udp addresses whose dials always fail.
+type failingTransport struct{}
+
+func (ft *failingTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	return nil, errors.New("failing transport")
+}
+
+func (ft *failingTransport) CanDial(addr ma.Multiaddr) bool {
+	return true
+}
+
+func (ft *failingTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	panic("unimplemented")
+}
+
+func (ft *failingTransport) Proxy() bool {
+	return false
+}
+
+func (ft *failingTransport) Protocols() []int {
+	return []int{ma.P_UDP}
+}
+
+func TestTransportDialStats(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	if err := s1.AddTransport(new(failingTransport)); err != nil {
+		t.Fatal(err)
+	}
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	dead := testutil.RandPeerIDFatal(t)
+	s1.Peerstore().AddAddrs(dead, []ma.Multiaddr{
+		ma.StringCast("/ip4/127.0.0.1/udp/1234"),
+		ma.StringCast("/ip4/127.0.0.1/udp/1235"),
+	}, pstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, dead); err == nil {
+		t.Fatal("dial over the failing transport should have failed")
+	}
+
+	expected := map[string]TransportDialStats{
+		"tcp": {Success: 1},
+		"udp": {Fail: 2},
+	}
+	stats := s1.TransportDialStats()
+	if len(stats) != len(expected) {
+		t.Fatalf("expected stats for %d transports, got %v", len(expected), stats)
+	}
+	for name, e := range expected {
+		if stats[name] != e {
+			t.Errorf("expected %s stats %+v, got %+v", name, e, stats[name])
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package swarm
+
+import "time"
+
+// Option configures a Swarm when it's constructed, see NewSwarm. Unlike the
+// package level variables (BackoffBase, DefaultPerPeerRateLimit, ...), options
+// only affect the swarm they're passed to.
+type Option func(*Swarm)
+
+// WithPerPeerDialLimit sets the number of addresses of a peer dialed
+// concurrently, overriding DefaultPerPeerRateLimit. It can still be
+// overridden per peer with SetPerPeerDialLimit.
+func WithPerPeerDialLimit(n int) Option {
+	return func(s *Swarm) {
+		s.limiter.perPeerLimit = n
+	}
+}
+
+// WithBackoffBase sets the base amount of time to backoff from a peer we
+// failed to dial, overriding BackoffBase.
+func WithBackoffBase(d time.Duration) Option {
+	return func(s *Swarm) {
+		s.backf.SetBase(d)
+	}
+}
+
+// WithBackoffCoef sets the backoff coefficient, overriding BackoffCoef.
+func WithBackoffCoef(d time.Duration) Option {
+	return func(s *Swarm) {
+		s.backf.SetCoef(d)
+	}
+}
+
+// WithBackoffMax sets the maximum time to backoff from a peer, overriding
+// BackoffMax.
+func WithBackoffMax(d time.Duration) Option {
+	return func(s *Swarm) {
+		s.backf.SetMax(d)
+	}
+}
+
+// WithBackoffFloor sets the minimum time to backoff from a peer, overriding
+// BackoffFloor.
+func WithBackoffFloor(d time.Duration) Option {
+	return func(s *Swarm) {
+		s.backf.SetFloor(d)
+	}
+}
+
+// WithDialTimeout sets the default timeout for a call to DialPeer, see
+// SetDefaultDialTimeout.
+func WithDialTimeout(d time.Duration) Option {
+	return func(s *Swarm) {
+		s.SetDefaultDialTimeout(d)
+	}
+}
+
+// WithConnDeadline sets the lifetime of every connection, see
+// SetConnDeadline.
+func WithConnDeadline(d time.Duration) Option {
+	return func(s *Swarm) {
+		s.SetConnDeadline(d)
+	}
+}
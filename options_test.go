@@ -0,0 +1,57 @@
+package swarm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+)
+
+func TestOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1 := NewSwarm(ctx, peer.ID("s1"), pstoremem.NewPeerstore(), nil,
+		WithPerPeerDialLimit(2),
+		WithBackoffBase(time.Hour),
+		WithDialTimeout(time.Second),
+	)
+	defer s1.Close()
+	s2 := NewSwarm(ctx, peer.ID("s2"), pstoremem.NewPeerstore(), nil,
+		WithPerPeerDialLimit(5),
+		WithBackoffBase(time.Millisecond),
+	)
+	defer s2.Close()
+	s3 := NewSwarm(ctx, peer.ID("s3"), pstoremem.NewPeerstore(), nil)
+	defer s3.Close()
+
+	p := peer.ID("remote")
+	for _, c := range []struct {
+		s       *Swarm
+		limit   int
+		timeout time.Duration
+	}{
+		{s1, 2, time.Second},
+		{s2, 5, 0},
+		{s3, DefaultPerPeerRateLimit, 0},
+	} {
+		if l := c.s.limiter.peerLimit(p); l != c.limit {
+			t.Fatalf("%s: expected a per peer dial limit of %d, got %d", c.s.LocalPeer(), c.limit, l)
+		}
+		if d := c.s.defaultDialTimeout(); d != c.timeout {
+			t.Fatalf("%s: expected a dial timeout of %s, got %s", c.s.LocalPeer(), c.timeout, d)
+		}
+	}
+
+	s1.Backoff().AddBackoff(p)
+	s2.Backoff().AddBackoff(p)
+	time.Sleep(10 * time.Millisecond)
+	if !s1.Backoff().Backoff(p) {
+		t.Fatal("s1 should still be backing off")
+	}
+	if s2.Backoff().Backoff(p) {
+		t.Fatal("s2's backoff should have expired")
+	}
+}
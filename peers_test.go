@@ -70,3 +70,198 @@ func TestPeers(t *testing.T) {
 	test(s1)
 	test(s2)
 }
+
+func TestConnsSnapshot(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s1, s2, s3 := swarms[0], swarms[1], swarms[2]
+
+	for _, s := range []*Swarm{s2, s3} {
+		s1.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), pstore.PermanentAddrTTL)
+		if _, err := s1.DialPeer(ctx, s.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conns := s1.Conns()
+	if len(conns) != 2 {
+		t.Fatalf("expected 2 conns, got %d", len(conns))
+	}
+	for _, s := range []*Swarm{s2, s3} {
+		cs := s1.ConnsToPeer(s.LocalPeer())
+		if len(cs) != 1 {
+			t.Fatalf("expected 1 conn to %s, got %d", s.LocalPeer(), len(cs))
+		}
+		if cs[0].RemotePeer() != s.LocalPeer() {
+			t.Fatalf("conn to %s is connected to %s", s.LocalPeer(), cs[0].RemotePeer())
+		}
+	}
+
+	// closing a connection shouldn't affect snapshots we've already taken.
+	if err := s1.ClosePeer(s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 2 {
+		t.Fatal("snapshot changed after closing a connection")
+	}
+	if len(s1.Conns()) != 1 {
+		t.Fatalf("expected 1 conn after closing, got %d", len(s1.Conns()))
+	}
+	if len(s1.ConnsToPeer(s2.LocalPeer())) != 0 {
+		t.Fatal("expected no conns to closed peer")
+	}
+}
+
+func TestNumStreams(t *testing.T) {
+	const streamCount = 3
+
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	ic, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ic.(*Conn)
+
+	streams := make([]inet.Stream, streamCount)
+	for i := range streams {
+		if streams[i], err = c.NewStream(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := c.NumStreams(); n != streamCount {
+		t.Fatalf("expected %d streams on conn, got %d", streamCount, n)
+	}
+	if n := s1.NumStreamsToPeer(s2.LocalPeer()); n != streamCount {
+		t.Fatalf("expected %d streams to peer, got %d", streamCount, n)
+	}
+
+	streams[0].Reset()
+	if n := c.NumStreams(); n != streamCount-1 {
+		t.Fatalf("expected %d streams on conn after reset, got %d", streamCount-1, n)
+	}
+	if n := s1.NumStreamsToPeer(s2.LocalPeer()); n != streamCount-1 {
+		t.Fatalf("expected %d streams to peer after reset, got %d", streamCount-1, n)
+	}
+	if n := s1.NumStreamsToPeer(s1.LocalPeer()); n != 0 {
+		t.Fatalf("expected no streams to unknown peer, got %d", n)
+	}
+}
+
+func TestClosePeer(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	// force a second connection to the same peer.
+	s1.SetMaxStreamsPerConn(1, StreamLimitNewConn)
+	s1.SetMaxConnsPerPeer(2)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	for i := 0; i < 2; i++ {
+		if _, err := s1.NewStream(ctx, s2.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(s1.ConnsToPeer(s2.LocalPeer())); n != 2 {
+		t.Fatalf("expected 2 conns to peer, got %d", n)
+	}
+
+	s1.Backoff().AddBackoff(s2.LocalPeer())
+	if err := s1.ClosePeer(s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(s1.ConnsToPeer(s2.LocalPeer())); n != 0 {
+		t.Fatalf("expected no conns to peer after ClosePeer, got %d", n)
+	}
+	if s1.Connectedness(s2.LocalPeer()) == inet.Connected {
+		t.Fatal("peer still reported as connected")
+	}
+	if s1.Backoff().Backoff(s2.LocalPeer()) {
+		t.Fatal("ClosePeer should have cleared the peer's backoff")
+	}
+}
+
+func TestConnectedness(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+	p := s2.LocalPeer()
+
+	expect := func(expected inet.Connectedness) {
+		t.Helper()
+		if c := s1.Connectedness(p); c != expected {
+			t.Fatalf("expected connectedness %d, got %d", expected, c)
+		}
+	}
+
+	expect(inet.NotConnected)
+
+	s1.Peerstore().AddAddrs(p, s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	expect(inet.CanConnect)
+
+	if _, err := s1.DialPeer(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	expect(inet.Connected)
+
+	if err := s1.ClosePeer(p); err != nil {
+		t.Fatal(err)
+	}
+	expect(inet.CanConnect)
+
+	// we still know addresses we could dial while backing off.
+	s1.Backoff().AddBackoff(p)
+	expect(inet.CanConnect)
+
+	s1.Peerstore().ClearAddrs(p)
+	expect(inet.CannotConnect)
+
+	s1.Backoff().Clear(p)
+	expect(inet.NotConnected)
+}
+
+func TestPeersDeduplicated(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 4)
+	defer closeSwarms(swarms)
+	s := swarms[0]
+
+	// one stream per connection gives us two connections to the first peer.
+	s.SetMaxStreamsPerConn(1, StreamLimitNewConn)
+	s.SetMaxConnsPerPeer(2)
+	for _, remote := range swarms[1:] {
+		remote.SetStreamHandler(func(inet.Stream) {})
+		s.Peerstore().AddAddrs(remote.LocalPeer(), remote.ListenAddresses(), pstore.PermanentAddrTTL)
+		if _, err := s.NewStream(ctx, remote.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.NewStream(ctx, swarms[1].LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.ConnsToPeer(swarms[1].LocalPeer())); n != 2 {
+		t.Fatalf("expected two connections to the first peer, got %d", n)
+	}
+
+	peers := make(map[peer.ID]int)
+	for _, p := range s.Peers() {
+		peers[p]++
+	}
+	if len(peers) != 3 || len(s.Peers()) != 3 {
+		t.Fatalf("expected three peers, got %v", s.Peers())
+	}
+	for _, remote := range swarms[1:] {
+		if peers[remote.LocalPeer()] != 1 {
+			t.Fatalf("expected %s once, got %v", remote.LocalPeer(), s.Peers())
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -19,6 +21,7 @@ import (
 	transport "github.com/libp2p/go-libp2p-transport"
 	filter "github.com/libp2p/go-maddr-filter"
 	ma "github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
 	mafilter "github.com/whyrusleeping/multiaddr-filter"
 )
 
@@ -38,6 +41,16 @@ var ErrSwarmClosed = errors.New("swarm closed")
 // transport is misbehaving.
 var ErrAddrFiltered = errors.New("address filtered")
 
+// ErrRedundantConn is returned when an inbound connection is closed because
+// we already have a connection to the peer that we initiated at the same time
+// and that both sides agreed to keep.
+var ErrRedundantConn = errors.New("redundant connection closed")
+
+// SimultaneousOpenWindow is how recently a connection must have been opened
+// for a connection to the same peer in the other direction to be treated as
+// a simultaneous open (see Swarm.addConn).
+var SimultaneousOpenWindow = 5 * time.Second
+
 // Swarm is a connection muxer, allowing connections to other peers to
 // be opened and closed, while still using the same Chan for all
 // communication. The Chan sends/receives Messages, which note the
@@ -53,10 +66,19 @@ type Swarm struct {
 	conns struct {
 		sync.RWMutex
 		m map[peer.ID][]*Conn
+
+		// pinned holds the connections new streams go to, see PinConn.
+		pinned map[peer.ID]*Conn
 	}
 
 	listeners struct {
 		sync.RWMutex
+
+		// cached result of InterfaceListenAddresses, reset whenever the
+		// set of listeners changes.
+		ifaceListenAddrs []ma.Multiaddr
+		cacheEOL         time.Time
+
 		m map[transport.Listener]struct{}
 	}
 
@@ -65,47 +87,199 @@ type Swarm struct {
 		m map[inet.Notifiee]struct{}
 	}
 
+	notifiees struct {
+		sync.RWMutex
+		m map[Notifiee]struct{}
+	}
+	// number of connections to each peer whose disconnect notifications
+	// haven't fired yet, see PeerNotifiee.
+	peerConns connCounts
+
 	transports struct {
 		sync.RWMutex
 		m map[int]transport.Transport
+
+		// configuration passed to AddTransportWithConfig.
+		cfgs map[transport.Transport]TransportConfig
 	}
+	// raw connections under upgraded ones, see TrackUpgrader.
+	netConns netConns
+
+	// transport settings, they may change while we're dialing.
+	transportCfg struct {
+		sync.RWMutex
+		selector     TransportSelector
+		localAddr    ma.Multiaddr
+		sockOpts     *ConnSocketOpts
+		connDeadline time.Duration
+	}
+
+	recoverTransportPanics bool
 
 	// new connection and stream handlers
 	connh   atomic.Value
 	streamh atomic.Value
 
 	// dialing helpers
-	dsync   *DialSync
+	dsync   DialSyncer
 	backf   DialBackoff
 	limiter *dialLimiter
+	dstats  dialMetrics
+
+	addrScores AddrScoreboard
+
+	streamLimits struct {
+		sync.RWMutex
+		maxStreamsPerConn int
+		maxConnsPerPeer   int
+		policy            StreamLimitPolicy
+	}
+
+	streamOpens struct {
+		sync.RWMutex
+		sem chan struct{}
+	}
+
+	// streamFrees.ch is closed when an outbound stream or a connection
+	// closes, see StreamLimitBlock.
+	streamFrees struct {
+		sync.Mutex
+		ch chan struct{}
+	}
+
+	dialSubs struct {
+		sync.RWMutex
+		m map[chan DialEvent]struct{}
+	}
+
+	dialTraces struct {
+		sync.RWMutex
+		m map[peer.ID]map[*DialTrace]struct{}
+	}
+
+	connLimit struct {
+		sync.RWMutex
+		maxConns  int
+		score     ConnScorer
+		protected map[peer.ID]struct{}
+	}
+
+	peerFilter struct {
+		sync.RWMutex
+		allowlistOnly bool
+		allowed       map[peer.ID]struct{}
+		blocked       map[peer.ID]struct{}
+	}
+
+	reconnect struct {
+		sync.Mutex
+		threshold float64
+		last      map[peer.ID]time.Time
+	}
+
+	keepalive struct {
+		sync.RWMutex
+		cfg ConnKeepalive
+	}
+
+	backoffSweep struct {
+		sync.Mutex
+		stop chan struct{}
+	}
+
+	connAge struct {
+		sync.Mutex
+		stop chan struct{}
+	}
 
 	// filters for addresses that shouldnt be dialed (or accepted)
-	Filters *filter.Filters
+	//
+	// Use SetAddrFilters to replace them while the swarm is running,
+	// filtersLk guards the swap.
+	Filters   *filter.Filters
+	filtersLk sync.RWMutex
 
 	bestConn BestConn
 	bestDest BestDest
+	resolver Resolver
+
+	// dial settings, they may change while we're dialing.
+	dialCfg struct {
+		sync.RWMutex
+		attempts           int
+		maxAddrs           int
+		defaultTimeout     time.Duration
+		requireEncryption  bool
+		addrOrder          AddrDialOrder
+		familyPref         AddressFamilyPreference
+		randomizeAddrOrder bool
+		hedgeDelay         time.Duration
+		fallback           DialFallback
+	}
+
+	// addrResolveHook is called with the results of resolver, see
+	// SetAddrResolveHook.
+	addrResolveHook AddrResolveHook
+
+	addrRand struct {
+		sync.Mutex
+		r *rand.Rand
+	}
+
+	// per-peer overrides of the dial timeout, see SetDialTimeout.
+	dialTimeouts struct {
+		sync.RWMutex
+		m map[peer.ID]time.Duration
+	}
+
+	// dialPaused is non-zero while dialing is paused (see PauseDialing).
+	dialPaused int32
+
+	relayFallbackOnly   bool
+	relayFallbackWindow time.Duration
+
+	// draining is non-zero once CloseGracefully has been called.
+	draining      int32
+	dialsInFlight int64
+
+	inbound        inboundLimiter
+	gater          ConnGater
+	postSecureHook func(*Conn) error
+	observedAddr   func(*Conn) ma.Multiaddr
 
 	proc goprocess.Process
 	ctx  context.Context
 	bwc  metrics.Reporter
 }
 
-// NewSwarm constructs a Swarm
-func NewSwarm(ctx context.Context, local peer.ID, peers pstore.Peerstore, bwc metrics.Reporter) *Swarm {
+// NewSwarm constructs a Swarm. Options override the package level defaults
+// for this swarm only.
+func NewSwarm(ctx context.Context, local peer.ID, peers pstore.Peerstore, bwc metrics.Reporter, opts ...Option) *Swarm {
 	s := &Swarm{
 		local:   local,
 		peers:   peers,
 		bwc:     bwc,
 		Filters: filter.NewFilters(),
+
+		resolver: madns.DefaultResolver,
 	}
+	s.dialCfg.attempts = DialAttempts
 
 	s.conns.m = make(map[peer.ID][]*Conn)
 	s.listeners.m = make(map[transport.Listener]struct{})
 	s.transports.m = make(map[int]transport.Transport)
 	s.notifs.m = make(map[inet.Notifiee]struct{})
+	s.notifiees.m = make(map[Notifiee]struct{})
+	s.reconnect.last = make(map[peer.ID]time.Time)
+	s.peerFilter.allowed = make(map[peer.ID]struct{})
+	s.peerFilter.blocked = make(map[peer.ID]struct{})
 
 	s.dsync = NewDialSync(s.doDial)
-	s.limiter = newDialLimiter(s.dialAddr)
+	s.limiter = newDialLimiter(s.dialAddr, s.dialConsumesFd)
+	s.backf.cfg = defaultBackoffConfig()
+	for _, opt := range opts {
+		opt(s)
+	}
 	s.proc = goprocessctx.WithContextAndTeardown(ctx, s.teardown)
 	s.ctx = goprocessctx.OnClosingContext(s.proc)
 
@@ -160,31 +334,115 @@ func (s *Swarm) AddAddrFilter(f string) error {
 		return err
 	}
 
-	s.Filters.AddDialFilter(m)
+	s.addrFilters().AddDialFilter(m)
 	return nil
 }
 
+// SetAddrFilters atomically replaces the swarm's address filters. Dials that
+// have already filtered their addresses keep using the filters that were
+// current at the time, new dials and connections use f.
+//
+// Upgraders configured with the previous filters (see
+// go-libp2p-transport-upgrader) keep using them.
+func (s *Swarm) SetAddrFilters(f *filter.Filters) {
+	s.filtersLk.Lock()
+	defer s.filtersLk.Unlock()
+	s.Filters = f
+}
+
+// addrFilters returns the swarm's current address filters.
+func (s *Swarm) addrFilters() *filter.Filters {
+	s.filtersLk.RLock()
+	defer s.filtersLk.RUnlock()
+	return s.Filters
+}
+
+// setDialSyncer replaces the swarm's dial synchronization. It's meant for
+// injecting faults in tests and must be called before the swarm is used.
+func (s *Swarm) setDialSyncer(ds DialSyncer) {
+	s.dsync = ds
+}
+
 // Process returns the Process of the swarm
 func (s *Swarm) Process() goprocess.Process {
 	return s.proc
 }
 
-func (s *Swarm) addConn(tc transport.Conn, dir inet.Direction) (*Conn, error) {
+// addConn wraps and registers a new transport connection. dialLatency is the
+// time it took to dial the connection and should be zero for inbound
+// connections.
+func (s *Swarm) addConn(tc transport.Conn, dir inet.Direction, dialLatency time.Duration) (*Conn, error) {
 	// The underlying transport (or the dialer) *should* filter it's own
 	// connections but we should double check anyways.
 	raddr := tc.RemoteMultiaddr()
-	if s.Filters.AddrBlocked(raddr) {
+	if s.addrFilters().AddrBlocked(raddr) {
 		tc.Close()
 		return nil, ErrAddrFiltered
 	}
 
 	p := tc.RemotePeer()
+	if s.peerBlocked(p) {
+		tc.Close()
+		return nil, ErrPeerBlocked
+	}
+
+	if s.gater != nil && !s.gater.InterceptSecured(dir, p, tc) {
+		tc.Close()
+		return nil, ErrGaterDisallowedConnection
+	}
+
+	// Wrap the connection.
+	stat := inet.Stat{Direction: dir}
+	c := &Conn{
+		conn:        tc,
+		swarm:       s,
+		stat:        stat,
+		dialLatency: dialLatency,
+		opened:      time.Now(),
+		tracked:     s.trackedConnFor(tc),
+	}
+	if cc, ok := tc.(CompressedConn); ok {
+		c.compressed = cc.Compressed()
+	}
+	c.streams.m = make(map[*Stream]struct{})
+	c.quality.v = 1
+
+	// Drop redundant connections before they change any state.
+	s.conns.RLock()
+	winner, _ := s.resolveSimultaneousOpen(c)
+	s.conns.RUnlock()
+	if winner != nil {
+		return s.dropRedundantConn(c, winner)
+	}
+
+	if err := s.applyConnDeadline(c); err != nil {
+		tc.Close()
+		return nil, err
+	}
+
+	if s.postSecureHook != nil {
+		if err := s.postSecureHook(c); err != nil {
+			tc.Close()
+			return nil, err
+		}
+	}
+
+	if !s.makeRoomForConn(dir) {
+		tc.Close()
+		return nil, ErrTooManyConns
+	}
 
 	// Add the public key.
 	if pk := tc.RemotePublicKey(); pk != nil {
 		s.peers.AddPubKey(p, pk)
 	}
 
+	if s.observedAddr != nil {
+		if addr := s.observedAddr(c); addr != nil {
+			s.peers.AddAddr(p, addr, pstore.RecentlyConnectedAddrTTL)
+		}
+	}
+
 	// Clear any backoffs
 	s.backf.Clear(p)
 
@@ -197,15 +455,24 @@ func (s *Swarm) addConn(tc transport.Conn, dir inet.Direction) (*Conn, error) {
 		return nil, ErrSwarmClosed
 	}
 
-	// Wrap and register the connection.
-	stat := inet.Stat{Direction: dir}
-	c := &Conn{
-		conn:  tc,
-		swarm: s,
-		stat:  stat,
+	// Check again, a connection may have been added in the mean time.
+	winner, redundant := s.resolveSimultaneousOpen(c)
+	if winner != nil {
+		s.conns.Unlock()
+		return s.dropRedundantConn(c, winner)
 	}
-	c.streams.m = make(map[*Stream]struct{})
+
+	// makeRoomForConn doesn't hold the lock, concurrent inbound connections
+	// may have taken the room it made.
+	if dir == inet.DirInbound && s.overConnLimitLocked(len(redundant)) {
+		s.conns.Unlock()
+		tc.Close()
+		return nil, ErrTooManyConns
+	}
+
+	// Register the connection.
 	s.conns.m[p] = append(s.conns.m[p], c)
+	s.peerConns.add(p)
 
 	// Add two swarm refs:
 	// * One will be decremented after the close notifications fire in Conn.doClose
@@ -219,14 +486,32 @@ func (s *Swarm) addConn(tc transport.Conn, dir inet.Direction) (*Conn, error) {
 
 	// We have a connection now. Cancel all other in-progress dials.
 	// This should be fast, no reason to wait till later.
-	s.dsync.CancelDial(p)
+	//
+	// Relayed connections are the exception: an in-progress dial may still
+	// yield a direct connection which we'd much rather use. So are inbound
+	// connections if our dial would win a simultaneous open.
+	if !c.relayed() && (dir == inet.DirOutbound || s.simultaneousOpenWinner(p) == inet.DirInbound) {
+		s.dsync.CancelDial(p)
+	}
 
 	s.notifyAll(func(f inet.Notifiee) {
 		f.Connected(s, c)
 	})
+	s.notifyNotifiees(func(n Notifiee) {
+		n.Connected(s, c)
+	})
 	c.notifyLk.Unlock()
 
+	// Closing fires the Disconnected notifications.
+	for _, old := range redundant {
+		log.Debugf("closing redundant connection to %s", p)
+		old.Close()
+	}
+
 	c.start()
+	if ka := s.connKeepalive(); ka.Interval > 0 {
+		go c.keepalive(ka)
+	}
 
 	// TODO: Get rid of this. We use it for identify but that happen much
 	// earlier (really, inside the transport and, if not then, during the
@@ -238,6 +523,51 @@ func (s *Swarm) addConn(tc transport.Conn, dir inet.Direction) (*Conn, error) {
 	return c, nil
 }
 
+// resolveSimultaneousOpen resolves simultaneous opens: if we've just opened a
+// direct connection to the peer in the other direction, we keep the one
+// initiated by the peer with the smaller ID. Both sides make the same choice.
+//
+// If c loses, it returns the connection that wins. Otherwise, it returns the
+// connections c wins against. s.conns must be locked.
+func (s *Swarm) resolveSimultaneousOpen(c *Conn) (winner *Conn, redundant []*Conn) {
+	if c.relayed() {
+		return nil, nil
+	}
+	p, dir := c.RemotePeer(), c.stat.Direction
+	winnerDir := s.simultaneousOpenWinner(p)
+	for _, old := range s.conns.m[p] {
+		if old.relayed() || old.conn.IsClosed() || old.stat.Direction == dir ||
+			c.opened.Sub(old.opened) > SimultaneousOpenWindow {
+			continue
+		}
+		if dir != winnerDir {
+			return old, nil
+		}
+		redundant = append(redundant, old)
+	}
+	return nil, redundant
+}
+
+// simultaneousOpenWinner returns the direction of the connection to p we keep
+// on a simultaneous open.
+func (s *Swarm) simultaneousOpenWinner(p peer.ID) inet.Direction {
+	if s.local < p {
+		return inet.DirOutbound
+	}
+	return inet.DirInbound
+}
+
+// dropRedundantConn closes c, which lost a simultaneous open to winner.
+func (s *Swarm) dropRedundantConn(c, winner *Conn) (*Conn, error) {
+	c.conn.Close()
+	log.Debugf("closing redundant connection to %s", c.RemotePeer())
+	if c.stat.Direction == inet.DirOutbound {
+		// we did get a connection to the peer.
+		return winner, nil
+	}
+	return nil, ErrRedundantConn
+}
+
 // Peerstore returns this swarms internal Peerstore.
 func (s *Swarm) Peerstore() pstore.Peerstore {
 	return s.peers
@@ -253,6 +583,50 @@ func (s *Swarm) Close() error {
 	return s.proc.Close()
 }
 
+// drainPollInterval is how often CloseGracefully checks for in-flight dials.
+const drainPollInterval = 10 * time.Millisecond
+
+// CloseGracefully stops the Swarm after letting in-flight work finish.
+//
+// It immediately stops accepting new inbound connections and new dials, waits
+// for in-flight dials to finish and then closes every connection gracefully
+// (see Conn.CloseGracefully) before closing the swarm. If ctx is done before
+// that, the swarm is closed forcefully and ctx's error is returned.
+func (s *Swarm) CloseGracefully(ctx context.Context) error {
+	atomic.StoreInt32(&s.draining, 1)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.dialsInFlight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range s.Conns() {
+		wg.Add(1)
+		go func(c inet.Conn) {
+			defer wg.Done()
+			c.(*Conn).CloseGracefully(ctx)
+		}(c)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		s.Close()
+		return err
+	}
+	return s.Close()
+}
+
+func (s *Swarm) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
 // TODO: We probably don't need the conn handlers.
 
 // SetConnHandler assigns the handler for new connections.
@@ -288,8 +662,90 @@ func (s *Swarm) SetBestDest(bd BestDest) {
 	s.bestDest = bd
 }
 
-// NewStream creates a new stream on any available connection to peer, dialing
-// if necessary.
+// SetDialAttempts sets the number of times the swarm tries to dial a peer
+// (re-trying the peer's whole address set) before giving up. The default is
+// DialAttempts.
+func (s *Swarm) SetDialAttempts(n int) {
+	s.dialCfg.Lock()
+	defer s.dialCfg.Unlock()
+	s.dialCfg.attempts = n
+}
+
+// dialAttempts returns the number of times to try dialing a peer, at least 1.
+func (s *Swarm) dialAttempts() int {
+	s.dialCfg.RLock()
+	defer s.dialCfg.RUnlock()
+	if s.dialCfg.attempts < 1 {
+		return 1
+	}
+	return s.dialCfg.attempts
+}
+
+// SetMaxDialAddrs limits the number of addresses dialed when dialing a peer
+// to the n best ones (see SetAddrDialOrder), bounding the work wasted on peers
+// advertising many bad addresses. A limit of 0 (the default) means no limit.
+func (s *Swarm) SetMaxDialAddrs(n int) {
+	s.dialCfg.Lock()
+	defer s.dialCfg.Unlock()
+	s.dialCfg.maxAddrs = n
+}
+
+func (s *Swarm) maxDialAddrs() int {
+	s.dialCfg.RLock()
+	defer s.dialCfg.RUnlock()
+	return s.dialCfg.maxAddrs
+}
+
+// SetDefaultDialTimeout sets the default timeout for a single call to
+// DialPeer on this swarm, overriding the global inet.DialPeerTimeout. Pass 0
+// to use the global default again. A sooner deadline on the caller's context
+// still applies.
+func (s *Swarm) SetDefaultDialTimeout(d time.Duration) {
+	s.dialCfg.Lock()
+	defer s.dialCfg.Unlock()
+	s.dialCfg.defaultTimeout = d
+}
+
+func (s *Swarm) defaultDialTimeout() time.Duration {
+	s.dialCfg.RLock()
+	defer s.dialCfg.RUnlock()
+	return s.dialCfg.defaultTimeout
+}
+
+// SetAddressFamilyPreference sets which IP address family to dial first when
+// a peer has both IPv4 and IPv6 addresses. Addresses of the other family are
+// still dialed.
+func (s *Swarm) SetAddressFamilyPreference(pref AddressFamilyPreference) {
+	s.dialCfg.Lock()
+	defer s.dialCfg.Unlock()
+	s.dialCfg.familyPref = pref
+}
+
+func (s *Swarm) familyPref() AddressFamilyPreference {
+	s.dialCfg.RLock()
+	defer s.dialCfg.RUnlock()
+	return s.dialCfg.familyPref
+}
+
+// SetAddrDialOrder sets the function used to order (or filter) a peer's
+// addresses right before dialing them. It runs before BestDest.
+func (s *Swarm) SetAddrDialOrder(f AddrDialOrder) {
+	s.dialCfg.Lock()
+	defer s.dialCfg.Unlock()
+	s.dialCfg.addrOrder = f
+}
+
+func (s *Swarm) addrDialOrder() AddrDialOrder {
+	s.dialCfg.RLock()
+	defer s.dialCfg.RUnlock()
+	return s.dialCfg.addrOrder
+}
+
+// NewStream creates a new stream on the best available connection to peer
+// (see RankedConnsToPeer), dialing if necessary. Like DialPeer, it fails with
+// ErrDialBackoff if we recently failed to dial the peer. If the connections
+// to the peer are full, it applies the stream limit policy (see
+// SetMaxStreamsPerConn).
 func (s *Swarm) NewStream(ctx context.Context, p peer.ID) (inet.Stream, error) {
 	log.Debugf("[%s] opening stream to peer [%s]", s.local, p)
 
@@ -305,11 +761,25 @@ func (s *Swarm) NewStream(ctx context.Context, p peer.ID) (inet.Stream, error) {
 	//
 	// TODO: Try all connections even if we get an error opening a stream on
 	// a non-closed connection.
-	dials := 0
+	dials, attempts := 0, s.dialAttempts()
 	for {
+		// Get the channel before looking at the connections so we don't
+		// miss a stream closing in between.
+		var freed <-chan struct{}
+		if s.streamLimitPolicy() == StreamLimitBlock {
+			freed = s.streamFreed()
+		}
+
 		c := s.bestConnToPeer(p)
 		if c == nil {
-			if dials >= DialAttempts {
+			// All of our connections may be full.
+			if conns := s.numLiveConnsToPeer(p); conns > 0 && !s.canOpenConnForStreams(conns) {
+				if err := waitStreamFreed(ctx, freed); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if dials >= attempts {
 				return nil, errors.New("max dial attempts exceeded")
 			}
 			dials++
@@ -320,21 +790,44 @@ func (s *Swarm) NewStream(ctx context.Context, p peer.ID) (inet.Stream, error) {
 				return nil, err
 			}
 		}
-		s, err := c.NewStream()
+		str, err := c.newStream(ctx)
 		if err != nil {
 			if c.conn.IsClosed() {
 				continue
 			}
+			// Someone else took the last stream on c.
+			if err == ErrTooManyStreams && freed != nil {
+				if err := waitStreamFreed(ctx, freed); err != nil {
+					return nil, err
+				}
+				continue
+			}
 			return nil, err
 		}
-		return s, nil
+		return str, nil
+	}
+}
+
+// waitStreamFreed waits for freed to be closed (see Swarm.streamFreed) or for
+// ctx to end. A nil freed means we mustn't wait: it returns ErrTooManyStreams.
+func waitStreamFreed(ctx context.Context, freed <-chan struct{}) error {
+	if freed == nil {
+		return ErrTooManyStreams
+	}
+	select {
+	case <-freed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 // ConnsToPeer returns all the live connections to peer.
+//
+// The returned slice is a snapshot; it won't reflect connections opened or
+// closed after this call returns. It's sorted oldest to newest, use
+// RankedConnsToPeer to get the connections sorted best to worst.
 func (s *Swarm) ConnsToPeer(p peer.ID) []inet.Conn {
-	// TODO: Consider sorting the connection list best to worst. Currently,
-	// it's sorted oldest to newest.
 	s.conns.RLock()
 	defer s.conns.RUnlock()
 	conns := s.conns.m[p]
@@ -345,32 +838,186 @@ func (s *Swarm) ConnsToPeer(p peer.ID) []inet.Conn {
 	return output
 }
 
-// bestConnToPeer returns the best connection to peer.
-func (s *Swarm) bestConnToPeer(p peer.ID) *Conn {
-	// Selects the best connection we have to the peer.
-	// TODO: Prefer some transports over others. Currently, we just select
-	// the newest non-closed connection with the most streams.
+// numLiveConnsToPeer returns the number of non-closed connections to peer.
+func (s *Swarm) numLiveConnsToPeer(p peer.ID) int {
 	s.conns.RLock()
 	defer s.conns.RUnlock()
 
-	var best *Conn
-	bestLen := 0
+	var n int
 	for _, c := range s.conns.m[p] {
-		if c.conn.IsClosed() {
-			// We *will* garbage collect this soon anyways.
-			continue
+		if !c.conn.IsClosed() {
+			n++
 		}
-		c.streams.Lock()
-		cLen := len(c.streams.m)
-		c.streams.Unlock()
+	}
+	return n
+}
+
+// NumStreamsToPeer returns the number of open streams across all live
+// connections to peer.
+func (s *Swarm) NumStreamsToPeer(p peer.ID) int {
+	s.conns.RLock()
+	defer s.conns.RUnlock()
+
+	var n int
+	for _, c := range s.conns.m[p] {
+		n += c.NumStreams()
+	}
+	return n
+}
+
+// bestConnToPeer returns the best connection to peer (see RankedConnsToPeer).
+// It's on the DialPeer hot path so, unlike rankConnsToPeer, it picks the best
+// connection in a single pass without allocating.
+func (s *Swarm) bestConnToPeer(p peer.ID) *Conn {
+	threshold := s.reconnectThreshold()
+	streamLimit := s.maxStreamsPerConn()
 
-		if cLen >= bestLen {
-			best = c
-			bestLen = cLen
+	s.conns.RLock()
+	defer s.conns.RUnlock()
+	conns := s.conns.m[p]
+	pinned := s.conns.pinned[p]
+	var best connCandidate
+	for i, c := range conns {
+		cand, ok := newConnCandidate(c, len(conns)-i, threshold, streamLimit)
+		if ok && (best.c == nil || cand.better(best, pinned)) {
+			best = cand
 		}
+	}
+	return best.c
+}
 
+// RankedConnsToPeer returns the live connections to peer that can take new
+// streams (i.e., that aren't full or closing gracefully), best first. New
+// streams are opened on the first one.
+//
+// The pinned connection (see PinConn) comes first. Then, connections that
+// haven't degraded (see SetAutoReconnectOnDegradation) come first, then
+// direct connections before relayed ones, then connections with a lower dial
+// latency, then connections with more streams and, finally, newer
+// connections. Inbound connections have no dial latency and rank after
+// outbound ones, but direct inbound connections still rank before relayed
+// ones.
+func (s *Swarm) RankedConnsToPeer(p peer.ID) []inet.Conn {
+	ranked := s.rankConnsToPeer(p)
+	output := make([]inet.Conn, len(ranked))
+	for i, c := range ranked {
+		output[i] = c
 	}
-	return best
+	return output
+}
+
+func (s *Swarm) rankConnsToPeer(p peer.ID) []*Conn {
+	// TODO: Prefer some transports over others.
+	threshold := s.reconnectThreshold()
+	streamLimit := s.maxStreamsPerConn()
+
+	s.conns.RLock()
+	conns := s.conns.m[p]
+	pinned := s.conns.pinned[p]
+	candidates := make([]connCandidate, 0, len(conns))
+	for i, c := range conns {
+		if cand, ok := newConnCandidate(c, len(conns)-i, threshold, streamLimit); ok {
+			candidates = append(candidates, cand)
+		}
+	}
+	s.conns.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].better(candidates[j], pinned)
+	})
+
+	ranked := make([]*Conn, len(candidates))
+	for i, cand := range candidates {
+		ranked[i] = cand.c
+	}
+	return ranked
+}
+
+// connCandidate is a connection that can take new streams, along with what
+// it's ranked on (see RankedConnsToPeer).
+type connCandidate struct {
+	c        *Conn
+	degraded bool
+	streams  int
+	age      int
+}
+
+// newConnCandidate returns c as a candidate for new streams, false if it
+// can't take any. age is c's position among its peer's connections, counting
+// from the newest (conns are sorted oldest to newest).
+func newConnCandidate(c *Conn, age int, threshold float64, streamLimit int) (connCandidate, bool) {
+	if c.conn.IsClosed() {
+		// We *will* garbage collect this soon anyways.
+		return connCandidate{}, false
+	}
+	c.streams.Lock()
+	cLen := len(c.streams.m)
+	outbound := c.streams.outbound
+	draining := c.streams.drained != nil
+	c.streams.Unlock()
+
+	if draining || streamsFull(outbound, streamLimit) {
+		return connCandidate{}, false
+	}
+	return connCandidate{
+		c:        c,
+		degraded: c.Quality() < threshold,
+		streams:  cLen,
+		age:      age,
+	}, true
+}
+
+// better returns true if a ranks before b.
+func (a connCandidate) better(b connCandidate, pinned *Conn) bool {
+	if (a.c == pinned) != (b.c == pinned) {
+		return a.c == pinned
+	}
+	if a.degraded != b.degraded {
+		return !a.degraded
+	}
+	if ar, br := a.c.relayed(), b.c.relayed(); ar != br {
+		return !ar
+	}
+	al, bl := a.c.DialLatency(), b.c.DialLatency()
+	if (al > 0) != (bl > 0) {
+		return al > 0
+	}
+	if al != bl {
+		return al < bl
+	}
+	if a.streams != b.streams {
+		return a.streams > b.streams
+	}
+	return a.age < b.age
+}
+
+// PinConn makes c the connection new streams to its peer are opened on, e.g.
+// the direct connection after a hole punch, whichever connection ranks best
+// otherwise (see RankedConnsToPeer). The pin only applies while c can take
+// new streams and is dropped when c closes. It's ignored by a custom BestConn
+// (see SetBestConn).
+//
+// Pinning a connection replaces the peer's previous pin.
+func (s *Swarm) PinConn(c *Conn) {
+	p := c.RemotePeer()
+	s.conns.Lock()
+	defer s.conns.Unlock()
+	for _, ci := range s.conns.m[p] {
+		if ci == c {
+			if s.conns.pinned == nil {
+				s.conns.pinned = make(map[peer.ID]*Conn)
+			}
+			s.conns.pinned[p] = c
+			return
+		}
+	}
+}
+
+// UnpinConn removes the pinned connection of peer p, if any. See PinConn.
+func (s *Swarm) UnpinConn(p peer.ID) {
+	s.conns.Lock()
+	defer s.conns.Unlock()
+	delete(s.conns.pinned, p)
 }
 
 // Wrapper for BestConn Interface
@@ -401,18 +1048,32 @@ func (s *Swarm) bestDestSelectWrapper(id peer.ID, addrs []ma.Multiaddr) []ma.Mul
 	return s.bestDest.BestDestSelect(id, addrs)
 }
 
-// Connectedness returns our "connectedness" state with the given peer.
+// Connectedness returns our "connectedness" state with the given peer:
+//
+// * inet.Connected if we have an open connection to the peer.
+// * inet.CanConnect if we know of addresses we could dial the peer on.
+// * inet.CannotConnect if we're backing off and know no usable address.
+// * inet.NotConnected otherwise.
 //
 // To check if we have an open connection, use `s.Connectedness(p) ==
 // inet.Connected`.
 func (s *Swarm) Connectedness(p peer.ID) inet.Connectedness {
-	if s.bestConnToPeer(p) != nil {
+	if s.numLiveConnsToPeer(p) > 0 {
 		return inet.Connected
 	}
+	if s.hasDialableAddr(p) {
+		return inet.CanConnect
+	}
+	if s.backf.Backoff(p) {
+		return inet.CannotConnect
+	}
 	return inet.NotConnected
 }
 
 // Conns returns a slice of all connections.
+//
+// Like ConnsToPeer, the returned slice is a snapshot. Use ConnsToPeer to only
+// list the connections to a single peer.
 func (s *Swarm) Conns() []inet.Conn {
 	s.conns.RLock()
 	defer s.conns.RUnlock()
@@ -426,8 +1087,37 @@ func (s *Swarm) Conns() []inet.Conn {
 	return conns
 }
 
-// ClosePeer closes all connections to the given peer.
+// Bandwidth is the number of bytes read (In) and written (Out).
+type Bandwidth struct {
+	In, Out uint64
+}
+
+// BandwidthByPeer returns the bytes read from and written to each connected
+// peer, summed over its open connections (see Conn.BandwidthStats).
+func (s *Swarm) BandwidthByPeer() map[peer.ID]Bandwidth {
+	s.conns.RLock()
+	defer s.conns.RUnlock()
+
+	bw := make(map[peer.ID]Bandwidth, len(s.conns.m))
+	for p, cs := range s.conns.m {
+		var b Bandwidth
+		for _, c := range cs {
+			in, out := c.BandwidthStats()
+			b.In += in
+			b.Out += out
+		}
+		bw[p] = b
+	}
+	return bw
+}
+
+// ClosePeer closes all connections to the given peer and clears its dial
+// backoff.
 func (s *Swarm) ClosePeer(p peer.ID) error {
+	// We're making a clean break, a later dial shouldn't be held back by
+	// earlier failures.
+	s.backf.Clear(p)
+
 	conns := s.ConnsToPeer(p)
 	switch len(conns) {
 	case 0:
@@ -456,7 +1146,42 @@ func (s *Swarm) ClosePeer(p peer.ID) error {
 	}
 }
 
-// Peers returns a copy of the set of peers swarm is connected to.
+// CloseConnsByProtocol closes every connection whose remote address uses the
+// protocol with the given code (e.g., ma.P_TCP), say to move peers off a
+// deprecated transport. It returns the number of connections closed.
+func (s *Swarm) CloseConnsByProtocol(code int) int {
+	var matching []*Conn
+	s.conns.RLock()
+	for _, cs := range s.conns.m {
+		for _, c := range cs {
+			if hasProtocol(c.RemoteMultiaddr(), code) {
+				matching = append(matching, c)
+			}
+		}
+	}
+	s.conns.RUnlock()
+
+	for _, c := range matching {
+		if err := c.Close(); err != nil {
+			log.Debugf("error closing connection %s: %s", c, err)
+		}
+	}
+	return len(matching)
+}
+
+// hasProtocol returns true if a uses the protocol with the given code.
+func hasProtocol(a ma.Multiaddr, code int) bool {
+	for _, p := range a.Protocols() {
+		if p.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Peers returns a copy of the set of peers swarm is connected to. Each peer
+// with at least one open connection appears once, however many connections
+// we have to it.
 func (s *Swarm) Peers() []peer.ID {
 	s.conns.RLock()
 	defer s.conns.RUnlock()
@@ -478,6 +1203,11 @@ func (s *Swarm) Backoff() *DialBackoff {
 	return &s.backf
 }
 
+// AddrScoreboard returns the AddrScoreboard object for this swarm.
+func (s *Swarm) AddrScoreboard() *AddrScoreboard {
+	return &s.addrScores
+}
+
 // notifyAll sends a signal to all Notifiees
 func (s *Swarm) notifyAll(notify func(inet.Notifiee)) {
 	var wg sync.WaitGroup
@@ -514,11 +1244,15 @@ func (s *Swarm) removeConn(c *Conn) {
 
 	s.conns.Lock()
 	defer s.conns.Unlock()
+	if s.conns.pinned[p] == c {
+		delete(s.conns.pinned, p)
+	}
 	cs := s.conns.m[p]
 	for i, ci := range cs {
 		if ci == c {
 			if len(cs) == 1 {
 				delete(s.conns.m, p)
+				s.forgetReconnect(p)
 			} else {
 				// NOTE: We're intentionally preserving order.
 				// This way, connections to a peer are always
@@ -1,6 +1,8 @@
 package swarm
 
 import (
+	"time"
+
 	addrutil "github.com/libp2p/go-addr-util"
 	ma "github.com/multiformats/go-multiaddr"
 )
@@ -16,9 +18,44 @@ func (s *Swarm) ListenAddresses() []ma.Multiaddr {
 	return addrs
 }
 
+// ifaceAddrsCacheDuration is how long the result of InterfaceListenAddresses
+// is cached for (unless the swarm's listeners change first).
+const ifaceAddrsCacheDuration = time.Minute
+
 // InterfaceListenAddresses returns a list of addresses at which this swarm
 // listens. It expands "any interface" addresses (/ip4/0.0.0.0, /ip6/::) to
 // use the known local interfaces.
+//
+// The result is cached for up to a minute as listing the local interfaces is
+// expensive.
 func (s *Swarm) InterfaceListenAddresses() ([]ma.Multiaddr, error) {
-	return addrutil.ResolveUnspecifiedAddresses(s.ListenAddresses(), nil)
+	s.listeners.RLock()
+	isEOL := time.Now().After(s.listeners.cacheEOL)
+	ifaceListenAddrs := s.listeners.ifaceListenAddrs
+	s.listeners.RUnlock()
+
+	if !isEOL {
+		return append([]ma.Multiaddr(nil), ifaceListenAddrs...), nil
+	}
+
+	s.listeners.Lock()
+	defer s.listeners.Unlock()
+
+	// someone else may have refreshed the cache in the mean time.
+	if time.Now().Before(s.listeners.cacheEOL) {
+		return append([]ma.Multiaddr(nil), s.listeners.ifaceListenAddrs...), nil
+	}
+
+	listenAddrs := make([]ma.Multiaddr, 0, len(s.listeners.m))
+	for l := range s.listeners.m {
+		listenAddrs = append(listenAddrs, l.Multiaddr())
+	}
+	ifaceListenAddrs, err := addrutil.ResolveUnspecifiedAddresses(listenAddrs, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.listeners.ifaceListenAddrs = ifaceListenAddrs
+	s.listeners.cacheEOL = time.Now().Add(ifaceAddrsCacheDuration)
+	return append([]ma.Multiaddr(nil), ifaceListenAddrs...), nil
 }
@@ -2,9 +2,12 @@ package swarm_test
 
 import (
 	"context"
+	"net"
 	"testing"
 
+	addrutil "github.com/libp2p/go-addr-util"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
+	transport "github.com/libp2p/go-libp2p-transport"
 	testutil "github.com/libp2p/go-testutil"
 	ma "github.com/multiformats/go-multiaddr"
 )
@@ -34,3 +37,92 @@ func TestDialBadAddrs(t *testing.T) {
 	test(m("/ip6/fe80::100"))              // link local
 	test(m("/ip4/127.0.0.1/udp/1234/utp")) // utp
 }
+
+func TestInterfaceListenAddressesCache(t *testing.T) {
+	ctx := context.Background()
+	s := makeSwarms(ctx, t, 1)[0]
+	defer s.Close()
+
+	before, err := s.InterfaceListenAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// adding a listener must invalidate the cache.
+	if err := s.Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")); err != nil {
+		t.Fatal(err)
+	}
+	after, err := s.InterfaceListenAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before)+1 {
+		t.Fatalf("expected %d interface addresses after listening, got %s", len(before)+1, after)
+	}
+}
+
+func BenchmarkInterfaceListenAddresses(b *testing.B) {
+	ctx := context.Background()
+	s := genSwarmWithTransport(ctx, b, false, func(tpt transport.Transport) transport.Transport { return tpt })
+	defer s.Close()
+	// listening on all interfaces is what makes resolving our addresses
+	// expensive.
+	if err := s.Listen(ma.StringCast("/ip4/0.0.0.0/tcp/0")); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.InterfaceListenAddresses(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := addrutil.ResolveUnspecifiedAddresses(s.ListenAddresses(), nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestExplainDialability(t *testing.T) {
+	ctx := context.Background()
+	s := makeSwarms(ctx, t, 1)[0]
+	defer s.Close()
+
+	blocked := ma.StringCast("/ip4/10.1.2.3/tcp/1234")
+	_, ipnet, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Filters.AddDialFilter(ipnet)
+
+	expected := map[string]string{
+		"/ip4/1.2.3.4/tcp/1234":         "",
+		"/ip6/fe80::1/tcp/1234":         "link-local",
+		"/ip4/1.2.3.4/udp/1234":         "no transport",
+		blocked.String():                "blocked",
+		s.ListenAddresses()[0].String(): "self",
+	}
+
+	p := testutil.RandPeerIDFatal(t)
+	for a := range expected {
+		s.Peerstore().AddAddr(p, ma.StringCast(a), pstore.PermanentAddrTTL)
+	}
+
+	explained := s.ExplainDialability(p)
+	if len(explained) != len(expected) {
+		t.Fatalf("expected %d addresses, got %d", len(expected), len(explained))
+	}
+	for _, d := range explained {
+		reason, ok := expected[d.Addr.String()]
+		if !ok {
+			t.Fatalf("unexpected address %s", d.Addr)
+		}
+		if d.Reason != reason || d.Dialable != (reason == "") {
+			t.Errorf("%s: expected reason %q, got dialable=%t reason=%q", d.Addr, reason, d.Dialable, d.Reason)
+		}
+	}
+}
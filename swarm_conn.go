@@ -1,9 +1,13 @@
 package swarm
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	ic "github.com/libp2p/go-libp2p-crypto"
 	inet "github.com/libp2p/go-libp2p-net"
@@ -18,6 +22,16 @@ import (
 // ErrConnClosed is returned when operating on a closed connection.
 var ErrConnClosed = errors.New("connection closed")
 
+// ErrStreamOpenTimeout is returned by Conn.NewStreamTimeout when the muxer
+// didn't open the stream before the deadline.
+var ErrStreamOpenTimeout = errors.New("timed out opening stream")
+
+// CompressedConn is an optional interface transport connections can implement
+// to report whether they negotiated compression (see Conn.Compressed).
+type CompressedConn interface {
+	Compressed() bool
+}
+
 // Conn is the connection type used by swarm. In general, you won't use this
 // type directly.
 type Conn struct {
@@ -32,9 +46,39 @@ type Conn struct {
 	streams struct {
 		sync.Mutex
 		m map[*Stream]struct{}
+		// outbound is the number of outbound streams in m.
+		outbound int
+
+		// drained is non-nil while we're draining the connection (see
+		// CloseGracefully) and is closed once the last stream closes.
+		drained chan struct{}
 	}
 
 	stat inet.Stat
+
+	dialLatency time.Duration
+	opened      time.Time
+	compressed  bool
+
+	// tracked is the raw connection under conn, if the swarm tracks it
+	// (see Swarm.TrackUpgrader).
+	tracked *trackedConn
+
+	quality struct {
+		sync.Mutex
+		v float64
+	}
+
+	onClose struct {
+		sync.Mutex
+		closed bool
+		fs     []func()
+	}
+
+	values struct {
+		sync.RWMutex
+		m map[interface{}]interface{}
+	}
 }
 
 // Close closes this connection.
@@ -48,6 +92,76 @@ func (c *Conn) Close() error {
 	return c.err
 }
 
+// CloseGracefully closes this connection once all of its streams have closed.
+// New streams (inbound or outbound) are refused in the mean time.
+//
+// If the context expires before the streams close, the connection is closed
+// forcefully (resetting the remaining streams) and the context's error is
+// returned.
+func (c *Conn) CloseGracefully(ctx context.Context) error {
+	drained := c.drain()
+	if drained == nil {
+		// Already closed.
+		return c.Close()
+	}
+
+	select {
+	case <-drained:
+		return c.Close()
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+}
+
+// drain stops new streams from being opened on the connection and returns a
+// channel that's closed once the existing streams have closed. It returns nil
+// if the connection is already closed.
+func (c *Conn) drain() <-chan struct{} {
+	c.streams.Lock()
+	defer c.streams.Unlock()
+	if c.streams.m == nil {
+		return nil
+	}
+	if c.streams.drained == nil {
+		c.streams.drained = make(chan struct{})
+		if len(c.streams.m) == 0 {
+			close(c.streams.drained)
+		}
+	}
+	return c.streams.drained
+}
+
+// OnClose registers a function to be called once this connection closes,
+// whether it's closed locally or by the remote peer. Functions are called in
+// the reverse order they were registered in, before the connection's close
+// notifications are sent. If the connection has already closed, f is called
+// immediately.
+//
+// f must not call Close on this connection.
+func (c *Conn) OnClose(f func()) {
+	c.onClose.Lock()
+	if c.onClose.closed {
+		c.onClose.Unlock()
+		f()
+		return
+	}
+	c.onClose.fs = append(c.onClose.fs, f)
+	c.onClose.Unlock()
+}
+
+func (c *Conn) runOnClose() {
+	c.onClose.Lock()
+	fs := c.onClose.fs
+	c.onClose.fs = nil
+	c.onClose.closed = true
+	c.onClose.Unlock()
+
+	for i := len(fs) - 1; i >= 0; i-- {
+		fs[i]()
+	}
+}
+
 func (c *Conn) IsClosed() bool {
 	return c.conn.IsClosed()
 }
@@ -59,7 +173,9 @@ func (c *Conn) doClose() {
 	c.streams.Lock()
 	streams := c.streams.m
 	c.streams.m = nil
+	c.streams.outbound = 0
 	c.streams.Unlock()
+	c.swarm.notifyStreamFreed()
 
 	c.err = c.conn.Close()
 
@@ -69,6 +185,8 @@ func (c *Conn) doClose() {
 		s.Reset()
 	}
 
+	c.runOnClose()
+
 	// do this in a goroutine to avoid deadlocking if we call close in an open notification.
 	go func() {
 		// prevents us from issuing close notifications before finishing the open notifications
@@ -78,14 +196,40 @@ func (c *Conn) doClose() {
 		c.swarm.notifyAll(func(f inet.Notifiee) {
 			f.Disconnected(c.swarm, c)
 		})
+		c.swarm.notifyNotifiees(func(n Notifiee) {
+			n.Disconnected(c.swarm, c)
+		})
+		if p := c.RemotePeer(); c.swarm.peerConns.remove(p) {
+			c.swarm.notifyPeerNotifiees(func(n PeerNotifiee) {
+				n.PeerDisconnected(c.swarm, p)
+			})
+		}
 		c.swarm.refs.Done() // taken in Swarm.addConn
 	}()
 }
 
 func (c *Conn) removeStream(s *Stream) {
+	var freed bool
 	c.streams.Lock()
-	delete(c.streams.m, s)
+	if _, ok := c.streams.m[s]; ok {
+		delete(c.streams.m, s)
+		if s.stat.Direction == inet.DirOutbound {
+			c.streams.outbound--
+			freed = true
+		}
+	}
+	if c.streams.drained != nil && len(c.streams.m) == 0 {
+		select {
+		case <-c.streams.drained:
+		default:
+			close(c.streams.drained)
+		}
+	}
 	c.streams.Unlock()
+
+	if freed {
+		c.swarm.notifyStreamFreed()
+	}
 }
 
 // listens for new streams.
@@ -169,24 +313,228 @@ func (c *Conn) Stat() inet.Stat {
 	return c.stat
 }
 
+// relayed returns true if this connection goes through a proxy transport
+// (e.g., a relay) instead of connecting directly to the remote peer.
+func (c *Conn) relayed() bool {
+	t := c.conn.Transport()
+	return t != nil && t.Proxy()
+}
+
+// ConnStats describes a connection, see Conn.ConnStats.
+type ConnStats struct {
+	// Direction is whether we dialed (outbound) or accepted (inbound) the
+	// connection.
+	Direction inet.Direction
+	// Opened is when the connection was added to the swarm.
+	Opened time.Time
+	// DialLatency is the time it took to dial the connection, zero for
+	// inbound connections.
+	DialLatency time.Duration
+}
+
+// ConnStats returns the connection's direction, when it was opened and how
+// long it took to dial. Stat only includes the direction as it's limited to
+// what inet.Conn requires.
+func (c *Conn) ConnStats() ConnStats {
+	return ConnStats{
+		Direction:   c.stat.Direction,
+		Opened:      c.opened,
+		DialLatency: c.dialLatency,
+	}
+}
+
+// DialLatency returns the time it took to dial this connection. It's zero for
+// inbound connections.
+func (c *Conn) DialLatency() time.Duration {
+	return c.dialLatency
+}
+
+// NetConn returns the net.Conn this connection is layered on, nil if the
+// swarm can't reach it (see Swarm.TrackUpgrader and NetConner). It's meant
+// for socket level settings: reading from or writing to it corrupts the
+// connection.
+func (c *Conn) NetConn() net.Conn {
+	if nc, ok := c.conn.(NetConner); ok {
+		return nc.NetConn()
+	}
+	if c.tracked != nil {
+		return c.tracked.Conn
+	}
+	return nil
+}
+
+// BandwidthStats returns the number of bytes read from and written to the
+// net.Conn this connection is layered on, security and muxer framing
+// included. It's zero for connections the swarm doesn't track (see
+// Swarm.TrackUpgrader).
+func (c *Conn) BandwidthStats() (in, out uint64) {
+	if c.tracked == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&c.tracked.bytesIn), atomic.LoadUint64(&c.tracked.bytesOut)
+}
+
+// Compressed returns true if the underlying transport connection negotiated
+// compression. It's false for transports that don't report it.
+func (c *Conn) Compressed() bool {
+	return c.compressed
+}
+
+// SetValue attaches the given value to this connection under key, replacing
+// any value previously set under the same key. Values live as long as the
+// connection and can be read from notifiee callbacks (see Value).
+//
+// Like context keys, keys should be of an unexported type to avoid
+// collisions.
+func (c *Conn) SetValue(key, value interface{}) {
+	c.values.Lock()
+	defer c.values.Unlock()
+	if c.values.m == nil {
+		c.values.m = make(map[interface{}]interface{})
+	}
+	c.values.m[key] = value
+}
+
+// Value returns the value set on this connection under key, if any.
+func (c *Conn) Value(key interface{}) (interface{}, bool) {
+	c.values.RLock()
+	defer c.values.RUnlock()
+	v, ok := c.values.m[key]
+	return v, ok
+}
+
+// Quality returns an estimate of the health of this connection between 0 (bad)
+// and 1 (good). It's a moving average over the outcome of recent attempts to
+// open streams (see ReportStreamFailure).
+func (c *Conn) Quality() float64 {
+	c.quality.Lock()
+	defer c.quality.Unlock()
+	return c.quality.v
+}
+
+// ReportStreamFailure lowers the quality of this connection. The swarm calls
+// this when it fails to open a stream but higher layers may also use it to
+// report streams that failed in ways the swarm can't observe (e.g., timeouts).
+func (c *Conn) ReportStreamFailure() {
+	c.updateQuality(false)
+}
+
+func (c *Conn) updateQuality(ok bool) {
+	c.quality.Lock()
+	c.quality.v *= 1 - connQualityWeight
+	if ok {
+		c.quality.v += connQualityWeight
+	}
+	c.quality.Unlock()
+
+	if !ok {
+		c.swarm.maybeReconnect(c)
+	}
+}
+
 // NewStream returns a new Stream from this connection
+//
+// If the swarm limits concurrent stream opens (see
+// Swarm.SetMaxConcurrentStreamOpens), it waits for a slot. Use
+// NewStreamTimeout to bound the wait.
 func (c *Conn) NewStream() (inet.Stream, error) {
+	s, err := c.newStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newStream is NewStream but gives up waiting for the swarm's stream open
+// limit (see SetMaxConcurrentStreamOpens) once ctx expires.
+func (c *Conn) newStream(ctx context.Context) (*Stream, error) {
+	if streamsFull(c.numOutboundStreams(), c.swarm.maxStreamsPerConn()) {
+		return nil, ErrTooManyStreams
+	}
+	release, err := c.swarm.acquireStreamOpen(ctx)
+	if err != nil {
+		return nil, err
+	}
 	ts, err := c.conn.OpenStream()
+	release()
 	if err != nil {
+		if !c.conn.IsClosed() {
+			c.updateQuality(false)
+		}
 		return nil, err
 	}
+	c.updateQuality(true)
 	return c.addStream(ts, inet.DirOutbound)
 }
 
+// NewStreamTimeout is like NewStream but gives up once ctx is done, failing
+// with ErrStreamOpenTimeout if its deadline passed. A stream the muxer opens
+// after we gave up is reset.
+func (c *Conn) NewStreamTimeout(ctx context.Context) (*Stream, error) {
+	if streamsFull(c.numOutboundStreams(), c.swarm.maxStreamsPerConn()) {
+		return nil, ErrTooManyStreams
+	}
+
+	type result struct {
+		ts  smux.Stream
+		err error
+	}
+	release, err := c.swarm.acquireStreamOpen(ctx)
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			return nil, ErrStreamOpenTimeout
+		}
+		return nil, err
+	}
+
+	// Buffered so the opener doesn't block if we give up.
+	resch := make(chan result, 1)
+	go func() {
+		// Hold the slot until the open completes, even if we give up.
+		defer release()
+		ts, err := c.conn.OpenStream()
+		resch <- result{ts, err}
+	}()
+
+	select {
+	case res := <-resch:
+		if res.err != nil {
+			if !c.conn.IsClosed() {
+				c.updateQuality(false)
+			}
+			return nil, res.err
+		}
+		c.updateQuality(true)
+		return c.addStream(res.ts, inet.DirOutbound)
+	case <-ctx.Done():
+		go func() {
+			if res := <-resch; res.err == nil {
+				res.ts.Reset()
+			}
+		}()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrStreamOpenTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
 func (c *Conn) addStream(ts smux.Stream, dir inet.Direction) (*Stream, error) {
 	c.streams.Lock()
-	// Are we still online?
-	if c.streams.m == nil {
+	// Are we still online (and not draining)?
+	if c.streams.m == nil || c.streams.drained != nil {
 		c.streams.Unlock()
 		ts.Reset()
 		return nil, ErrConnClosed
 	}
 
+	// Double check the stream limit now that we hold the lock.
+	if dir == inet.DirOutbound && streamsFull(c.streams.outbound, c.swarm.maxStreamsPerConn()) {
+		c.streams.Unlock()
+		ts.Reset()
+		return nil, ErrTooManyStreams
+	}
+
 	// Wrap and register the stream.
 	stat := inet.Stat{Direction: dir}
 	s := &Stream{
@@ -195,6 +543,9 @@ func (c *Conn) addStream(ts smux.Stream, dir inet.Direction) (*Stream, error) {
 		stat:   stat,
 	}
 	c.streams.m[s] = struct{}{}
+	if dir == inet.DirOutbound {
+		c.streams.outbound++
+	}
 
 	// Released once the stream disconnect notifications have finished
 	// firing (in Swarm.remove).
@@ -209,11 +560,29 @@ func (c *Conn) addStream(ts smux.Stream, dir inet.Direction) (*Stream, error) {
 	c.swarm.notifyAll(func(f inet.Notifiee) {
 		f.OpenedStream(c.swarm, s)
 	})
+	c.swarm.notifyStreamNotifiees(func(n StreamNotifiee) {
+		n.OpenedStream(c.swarm, s)
+	})
 	s.notifyLk.Unlock()
 
 	return s, nil
 }
 
+// NumStreams returns the number of open streams on this connection.
+func (c *Conn) NumStreams() int {
+	c.streams.Lock()
+	defer c.streams.Unlock()
+	return len(c.streams.m)
+}
+
+// numOutboundStreams returns the number of open outbound streams on this
+// connection, the ones the stream limit applies to.
+func (c *Conn) numOutboundStreams() int {
+	c.streams.Lock()
+	defer c.streams.Unlock()
+	return c.streams.outbound
+}
+
 // GetStreams returns the streams associated with this connection.
 func (c *Conn) GetStreams() []inet.Stream {
 	c.streams.Lock()
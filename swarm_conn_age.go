@@ -0,0 +1,74 @@
+package swarm
+
+import (
+	"time"
+)
+
+// SetMaxConnAge makes the swarm rotate connections: connections older than
+// age are closed once they have no open streams, so the next dial to the
+// peer opens a fresh connection. An age <= 0 (the default) disables rotation.
+//
+// Connections to protected peers (see Protect) are only rotated if we have
+// another connection to the peer, the swarm never drops its last connection
+// to a protected peer this way.
+//
+// Rotation stops when the swarm is closed.
+func (s *Swarm) SetMaxConnAge(age time.Duration) {
+	s.connAge.Lock()
+	defer s.connAge.Unlock()
+	if s.connAge.stop != nil {
+		close(s.connAge.stop)
+		s.connAge.stop = nil
+	}
+	if age <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	s.connAge.stop = stop
+	go s.rotateConns(age, stop)
+}
+
+func (s *Swarm) rotateConns(age time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(age / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.closeOldConns(age)
+		case <-stop:
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// closeOldConns gracefully closes the idle connections older than age.
+func (s *Swarm) closeOldConns(age time.Duration) {
+	var old []*Conn
+	s.conns.RLock()
+	for p, cs := range s.conns.m {
+		keep := 0
+		if s.isProtected(p) {
+			keep = 1
+		}
+		left := len(cs)
+		for _, c := range cs {
+			if left <= keep {
+				break
+			}
+			if time.Since(c.opened) < age || c.conn.IsClosed() || c.NumStreams() > 0 {
+				continue
+			}
+			old = append(old, c)
+			left--
+		}
+	}
+	s.conns.RUnlock()
+
+	for _, c := range old {
+		log.Debugf("rotating connection %s opened at %s", c, c.opened)
+		// A stream may have been opened since we checked, let it finish.
+		go c.CloseGracefully(s.ctx)
+	}
+}
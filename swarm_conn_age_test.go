@@ -0,0 +1,65 @@
+package swarm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+func TestMaxConnAge(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s1, s2, s3 := swarms[0], swarms[1], swarms[2]
+	s2.SetStreamHandler(func(s inet.Stream) {})
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	s1.Peerstore().AddAddrs(s3.LocalPeer(), s3.ListenAddresses(), pstore.PermanentAddrTTL)
+	old, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.DialPeer(ctx, s3.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	s1.Protect(s3.LocalPeer())
+	str, err := old.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s1.SetMaxConnAge(100 * time.Millisecond)
+
+	// busy connections aren't rotated.
+	time.Sleep(300 * time.Millisecond)
+	if old.(*Conn).IsClosed() {
+		t.Fatal("rotated a connection with an open stream")
+	}
+
+	str.Reset()
+	deadline := time.Now().Add(5 * time.Second)
+	for !old.(*Conn).IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the idle connection to be rotated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the only connection to a protected peer is kept.
+	if s1.Connectedness(s3.LocalPeer()) != inet.Connected {
+		t.Fatal("rotated the only connection to a protected peer")
+	}
+
+	c, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == old {
+		t.Fatal("expected a new connection")
+	}
+}
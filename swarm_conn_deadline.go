@@ -0,0 +1,52 @@
+package swarm
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrDeadlineUnsupported is returned by Conn.SetDeadline when the swarm can't
+// reach the connection's net.Conn (see Conn.NetConn).
+var ErrDeadlineUnsupported = errors.New("connection doesn't support deadlines")
+
+// SetDeadline sets a wall-clock deadline on the connection's underlying
+// net.Conn. Once it passes, reads and writes on the connection fail
+// regardless of activity, and the connection closes. Unlike an idle timeout,
+// traffic doesn't push the deadline back. A zero value clears the deadline.
+//
+// It returns ErrDeadlineUnsupported if the swarm can't reach the net.Conn,
+// see Conn.NetConn.
+func (c *Conn) SetDeadline(t time.Time) error {
+	nc := c.NetConn()
+	if nc == nil {
+		return ErrDeadlineUnsupported
+	}
+	return nc.SetDeadline(t)
+}
+
+// SetConnDeadline makes the swarm set a deadline (see Conn.SetDeadline) d
+// after a connection is established, on every new connection, inbound and
+// outbound. It's skipped for connections that don't support deadlines.
+//
+// A duration <= 0 (the default) doesn't set any deadline.
+func (s *Swarm) SetConnDeadline(d time.Duration) {
+	s.transportCfg.Lock()
+	defer s.transportCfg.Unlock()
+	s.transportCfg.connDeadline = d
+}
+
+// applyConnDeadline sets the default deadline on c, if any.
+func (s *Swarm) applyConnDeadline(c *Conn) error {
+	s.transportCfg.RLock()
+	d := s.transportCfg.connDeadline
+	s.transportCfg.RUnlock()
+	if d <= 0 {
+		return nil
+	}
+	err := c.SetDeadline(c.opened.Add(d))
+	if err == ErrDeadlineUnsupported {
+		log.Debugf("not setting a deadline on the connection to %s: %s", c.RemotePeer(), err)
+		return nil
+	}
+	return err
+}
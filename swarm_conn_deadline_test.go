@@ -0,0 +1,108 @@
+package swarm_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	transport "github.com/libp2p/go-libp2p-transport"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+func waitConnClosed(t *testing.T, s *Swarm, c *Conn) {
+	for i := 0; i < 100; i++ {
+		if c.IsClosed() && len(s.ConnsToPeer(c.RemotePeer())) == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("expected the connection to be closed")
+}
+
+func TestConnSetDeadline(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+	target.SetStreamHandler(func(s inet.Stream) {
+		io.Copy(s, s)
+		s.Close()
+	})
+
+	s := makeSwarms(ctx, t, 1)[0]
+	defer s.Close()
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	c, err := s.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(*Conn).SetDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	str, err := s.NewStream(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := []byte("ping")
+	if _, err := str.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(str, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Traffic doesn't push the deadline back.
+	time.Sleep(300 * time.Millisecond)
+	if _, err := str.Write(buf); err == nil {
+		if _, err := io.ReadFull(str, buf); err == nil {
+			t.Fatal("expected the stream to fail after the deadline")
+		}
+	}
+	waitConnClosed(t, s, c.(*Conn))
+}
+
+func TestDefaultConnDeadline(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	s := makeSwarms(ctx, t, 1)[0]
+	defer s.Close()
+	s.SetConnDeadline(200 * time.Millisecond)
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	c, err := s.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.(*Conn).IsClosed() {
+		t.Fatal("connection closed before its deadline")
+	}
+	waitConnClosed(t, s, c.(*Conn))
+}
+
+func TestConnSetDeadlineUnsupported(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	// the swarm can't reach the upgrader of a wrapped transport.
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		return &delayedTransport{Transport: tpt}
+	})
+	defer s.Close()
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	c, err := s.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(*Conn).SetDeadline(time.Now()); err != ErrDeadlineUnsupported {
+		t.Fatalf("expected ErrDeadlineUnsupported, got %v", err)
+	}
+}
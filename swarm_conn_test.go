@@ -0,0 +1,527 @@
+package swarm_test
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	transport "github.com/libp2p/go-libp2p-transport"
+	smux "github.com/libp2p/go-stream-muxer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+func TestCloseGracefully(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	ic, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ic.(*Conn)
+
+	st, err := c.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.CloseGracefully(closeCtx)
+	}()
+
+	select {
+	case err := <-errCh:
+		t.Fatal("connection closed before its streams finished:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := c.NewStream(); err == nil {
+		t.Fatal("shouldn't be able to open new streams while draining")
+	}
+
+	// The existing stream should still work.
+	if _, err := st.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := st.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Finish the stream.
+	st.Close()
+	if _, err := ioutil.ReadAll(st); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal("expected a clean close, got:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't closed after its streams finished")
+	}
+	if !c.IsClosed() {
+		t.Fatal("connection should be closed")
+	}
+}
+
+func TestCloseGracefullyTimeout(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	ic, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ic.(*Conn)
+
+	if _, err := c.NewStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	closeCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := c.CloseGracefully(closeCtx); err != context.DeadlineExceeded {
+		t.Fatal("expected the graceful close to time out, got:", err)
+	}
+	if !c.IsClosed() {
+		t.Fatal("connection should have been closed forcefully")
+	}
+}
+
+func TestConnOnClose(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	ic, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ic.(*Conn)
+
+	var remote *Conn
+	for i := 0; remote == nil; i++ {
+		if conns := s2.ConnsToPeer(s1.LocalPeer()); len(conns) > 0 {
+			remote = conns[0].(*Conn)
+		} else if i > 100 {
+			t.Fatal("remote never saw the connection")
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	var order []int
+	c.OnClose(func() { order = append(order, 1) })
+	c.OnClose(func() { order = append(order, 2) })
+
+	remoteClosed := make(chan struct{}, 2)
+	remote.OnClose(func() { remoteClosed <- struct{}{} })
+
+	c.Close()
+	c.Close()
+
+	if len(order) != 2 || order[0] != 2 || order[1] != 1 {
+		t.Fatalf("expected callbacks to run once each in LIFO order, got %v", order)
+	}
+
+	// closing our side should tear down the remote side too.
+	select {
+	case <-remoteClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote close callback never ran")
+	}
+	remote.Close()
+	select {
+	case <-remoteClosed:
+		t.Fatal("remote close callback ran twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// registering on a closed connection runs the callback right away.
+	ran := false
+	c.OnClose(func() { ran = true })
+	if !ran {
+		t.Fatal("callback registered after close didn't run")
+	}
+}
+
+type connValueKey int
+
+func TestConnValues(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	cn := newConnNotifiee(1)
+	s1.AddNotifiee(cn)
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	ic, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ic.(*Conn)
+
+	if _, ok := c.Value(connValueKey(0)); ok {
+		t.Fatal("expected no value before it was set")
+	}
+	c.SetValue(connValueKey(0), "mdns")
+	if v, ok := c.Value(connValueKey(0)); !ok || v != "mdns" {
+		t.Fatalf("expected mdns, got %v", v)
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := connValueKey(i)
+			for j := 0; j < 100; j++ {
+				c.SetValue(key, j)
+				if v, ok := c.Value(key); !ok || v != j {
+					t.Errorf("expected %d, got %v", j, v)
+					return
+				}
+				c.Value(connValueKey(0))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c.Close()
+	select {
+	case dc := <-cn.disconnected:
+		if v, ok := dc.Value(connValueKey(0)); !ok || v != "mdns" {
+			t.Fatalf("expected the value to still be set on disconnect, got %v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for disconnect")
+	}
+}
+
+// stallingConn doesn't open streams until release is closed.
+type stallingConn struct {
+	transport.Conn
+	release chan struct{}
+}
+
+func (sc *stallingConn) OpenStream() (smux.Stream, error) {
+	<-sc.release
+	return sc.Conn.OpenStream()
+}
+
+// stallingTransport wraps every connection it dials in a stallingConn.
+type stallingTransport struct {
+	transport.Transport
+	release chan struct{}
+}
+
+func (st *stallingTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	c, err := st.Transport.Dial(ctx, raddr, p)
+	if err != nil {
+		return nil, err
+	}
+	return &stallingConn{Conn: c, release: st.release}, nil
+}
+
+func TestNewStreamTimeout(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	st := &stallingTransport{release: make(chan struct{})}
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		st.Transport = tpt
+		return st
+	})
+	defer s.Close()
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+	ic, err := s.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ic.(*Conn)
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.NewStreamTimeout(tctx); err != ErrStreamOpenTimeout {
+		t.Fatalf("expected %s, got %v", ErrStreamOpenTimeout, err)
+	}
+
+	// the stream opened after we gave up isn't tracked.
+	close(st.release)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(c.GetStreams()); n != 0 {
+		t.Fatalf("expected no streams, got %d", n)
+	}
+
+	tctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	str, err := c.NewStreamTimeout(tctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer str.Close()
+	if n := len(c.GetStreams()); n != 1 {
+		t.Fatalf("expected 1 stream, got %d", n)
+	}
+}
+
+// compressedConn reports that it negotiated compression.
+type compressedConn struct {
+	transport.Conn
+}
+
+func (compressedConn) Compressed() bool { return true }
+
+// compressingTransport wraps every connection it dials in a compressedConn.
+type compressingTransport struct {
+	transport.Transport
+}
+
+func (ct *compressingTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	c, err := ct.Transport.Dial(ctx, raddr, p)
+	if err != nil {
+		return nil, err
+	}
+	return compressedConn{c}, nil
+}
+
+func TestConnCompressed(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		return &compressingTransport{tpt}
+	})
+	defer s.Close()
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+	c, err := s.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.(*Conn).Compressed() {
+		t.Fatal("expected the dialed connection to be compressed")
+	}
+
+	// the listener's transport doesn't report compression.
+	for _, tc := range target.ConnsToPeer(s.LocalPeer()) {
+		if tc.(*Conn).Compressed() {
+			t.Fatal("expected the accepted connection not to be compressed")
+		}
+	}
+}
+
+func TestConnBandwidthStats(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	done := make(chan struct{})
+	s2.SetStreamHandler(func(str inet.Stream) {
+		defer close(done)
+		defer str.Close()
+		if _, err := ioutil.ReadAll(str); err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := str.Write([]byte("thanks")); err != nil {
+			t.Error(err)
+		}
+	})
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	str.Close()
+	if _, err := ioutil.ReadAll(str); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	// the counters include the security handshake and muxer framing.
+	const overhead = 4096
+	check := func(s *Swarm, p peer.ID, in, out uint64) {
+		t.Helper()
+		gotIn, gotOut := s.ConnsToPeer(p)[0].(*Conn).BandwidthStats()
+		if gotIn < in || gotIn > in+overhead || gotOut < out || gotOut > out+overhead {
+			t.Fatalf("expected about %d bytes in and %d out, got %d and %d", in, out, gotIn, gotOut)
+		}
+		if bw := s.BandwidthByPeer()[p]; bw.In < gotIn || bw.Out < gotOut {
+			t.Fatalf("expected at least %d bytes in and %d out for the peer, got %+v", gotIn, gotOut, bw)
+		}
+	}
+	check(s1, s2.LocalPeer(), 6, 1000)
+	check(s2, s1.LocalPeer(), 1000, 6)
+}
+
+func TestConnStats(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	before := time.Now()
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	c, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := c.(*Conn).ConnStats()
+	if out.Direction != inet.DirOutbound {
+		t.Fatalf("expected an outbound connection, got direction %d", out.Direction)
+	}
+	if out.Opened.Before(before) || out.DialLatency <= 0 {
+		t.Fatalf("unexpected stats for the outbound connection: %+v", out)
+	}
+
+	var inbound []inet.Conn
+	for i := 0; len(inbound) == 0; i++ {
+		if i == 100 {
+			t.Fatal("timed out waiting for the inbound connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+		inbound = s2.ConnsToPeer(s1.LocalPeer())
+	}
+	in := inbound[0].(*Conn).ConnStats()
+	if in.Direction != inet.DirInbound {
+		t.Fatalf("expected an inbound connection, got direction %d", in.Direction)
+	}
+	if in.Opened.Before(before) || in.DialLatency != 0 {
+		t.Fatalf("unexpected stats for the inbound connection: %+v", in)
+	}
+}
+
+func TestMaxConcurrentStreamOpens(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	st := &stallingTransport{release: make(chan struct{})}
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		st.Transport = tpt
+		return st
+	})
+	defer s.Close()
+	s.SetMaxConcurrentStreamOpens(1)
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+	ic, err := s.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ic.(*Conn)
+
+	// takes the only slot until the transport lets streams open.
+	first := make(chan error, 1)
+	go func() {
+		str, err := c.NewStream()
+		if err == nil {
+			str.Close()
+		}
+		first <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.NewStreamTimeout(tctx); err != ErrStreamOpenTimeout {
+		t.Fatalf("expected %s, got %v", ErrStreamOpenTimeout, err)
+	}
+	if _, err := s.NewStream(tctx, target.LocalPeer()); err != context.DeadlineExceeded {
+		t.Fatalf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	close(st.release)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	str, err := s.NewStream(tctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	str.Close()
+}
+
+func TestPinConn(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+	s2.SetStreamHandler(func(s inet.Stream) {})
+	p := s2.LocalPeer()
+
+	// one stream per connection gives us two connections.
+	s1.SetMaxStreamsPerConn(1, StreamLimitNewConn)
+	s1.SetMaxConnsPerPeer(2)
+	s1.Peerstore().AddAddrs(p, s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	for i := 0; i < 2; i++ {
+		if _, err := s1.NewStream(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s1.SetMaxStreamsPerConn(0, StreamLimitNewConn)
+
+	ranked := s1.RankedConnsToPeer(p)
+	if len(ranked) != 2 {
+		t.Fatalf("expected two connections, got %d", len(ranked))
+	}
+	best, other := ranked[0], ranked[1].(*Conn)
+
+	s1.PinConn(other)
+	st, err := s1.NewStream(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Conn() != other {
+		t.Fatal("expected the stream to be opened on the pinned connection")
+	}
+
+	s1.UnpinConn(p)
+	if st, err = s1.NewStream(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if st.Conn() != best {
+		t.Fatal("expected the stream to be opened on the best connection once unpinned")
+	}
+
+	// closing the pinned connection drops the pin.
+	s1.PinConn(other)
+	other.Close()
+	if st, err = s1.NewStream(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if st.Conn() != best {
+		t.Fatal("expected the stream to be opened on the remaining connection")
+	}
+}
@@ -1,10 +1,14 @@
 package swarm
 
 import (
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	logging "github.com/ipfs/go-log"
@@ -12,6 +16,7 @@ import (
 	lgbl "github.com/libp2p/go-libp2p-loggables"
 	inet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
 	transport "github.com/libp2p/go-libp2p-transport"
 	ma "github.com/multiformats/go-multiaddr"
 )
@@ -41,17 +46,54 @@ var (
 	// ErrNoTransport is returned when we don't know a transport for the
 	// given multiaddr.
 	ErrNoTransport = errors.New("no transport for protocol")
+
+	// ErrDialingPaused is returned when we attempt to dial a peer while
+	// dialing is paused (see Swarm.PauseDialing).
+	ErrDialingPaused = errors.New("dialing paused")
+
+	// ErrInsecureDialRejected is returned when we attempt to dial a peer
+	// without a private key while encryption is required (see
+	// Swarm.SetRequireEncryption).
+	ErrInsecureDialRejected = errors.New("refusing to dial without encryption")
+
+	// ErrDialFallbackLoop is returned when the dial fallback (see
+	// Swarm.SetDialFallback) tries to dial the peer it's looking up.
+	ErrDialFallbackLoop = errors.New("dial fallback tried to dial the peer it's looking up")
+
+	// ErrDialCanceled is returned to the callers waiting on a dial that was
+	// canceled with Swarm.CancelDial.
+	ErrDialCanceled = errors.New("dial canceled")
+
+	// ErrNoAddresses is returned when dialing a peer we don't know any
+	// addresses of. Finding some (e.g., through peer routing) may help.
+	ErrNoAddresses = errors.New("no addresses")
+
+	// ErrNoGoodAddresses is returned when dialing a peer whose addresses
+	// we know but can't dial, e.g. because they're filtered or we don't
+	// have a transport for them.
+	ErrNoGoodAddresses = errors.New("no good addresses")
+
+	// ErrNoRemotePeer is returned when a transport hands us a connection
+	// without a remote peer, i.e. one it didn't authenticate.
+	ErrNoRemotePeer = errors.New("transport returned a connection without a remote peer")
 )
 
-// DialAttempts governs how many times a goroutine will try to dial a given peer.
-// Note: this is down to one, as we have _too many dials_ atm. To add back in,
-// add loop back in Dial(.)
+// DialAttempts is the default number of times the swarm will try to dial a
+// given peer before giving up. Use Swarm.SetDialAttempts to change it.
 const DialAttempts = 1
 
+// DialRetryDelay is how long the swarm waits between two attempts to dial the
+// same peer.
+var DialRetryDelay = 500 * time.Millisecond
+
 // ConcurrentFdDials is the number of concurrent outbound dials over transports
 // that consume file descriptors
 const ConcurrentFdDials = 160
 
+// ConcurrentNonFdDials is the number of concurrent outbound dials over
+// transports that don't consume file descriptors (see FdConsumer).
+const ConcurrentNonFdDials = 1000
+
 // DefaultPerPeerRateLimit is the number of concurrent outbound dials to make
 // per peer
 const DefaultPerPeerRateLimit = 8
@@ -87,22 +129,150 @@ const DefaultPerPeerRateLimit = 8
 // * It's safe to use its zero value.
 // * It's thread-safe.
 // * It's *not* safe to move this type after using.
+//
+// It tracks at most DefaultMaxBackoffEntries peers (see SetMaxEntries),
+// forgetting the least recently backed off peers first.
 type DialBackoff struct {
 	entries map[peer.ID]*backoffPeer
-	lock    sync.RWMutex
+	// lru holds the entries, least recently backed off first.
+	lru        list.List
+	maxEntries int
+	cfg        backoffConfig
+	clock      Clock
+	lock       sync.RWMutex
+}
+
+// Clock tells the time. DialBackoff uses one so tests can control time
+// instead of sleeping, see DialBackoff.SetClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// SetClock sets the clock used to compute and check backoff times. A nil
+// clock (the default) uses the system clock.
+func (db *DialBackoff) SetClock(c Clock) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.clock = c
+}
+
+// now returns the current time according to db's clock. The caller must hold
+// db.lock.
+func (db *DialBackoff) now() time.Time {
+	if db.clock == nil {
+		return time.Now()
+	}
+	return db.clock.Now()
+}
+
+// backoffConfig holds the parameters of a DialBackoff. Zero values stand for
+// the package level defaults (BackoffBase, BackoffCoef, BackoffMax and
+// BackoffFloor).
+type backoffConfig struct {
+	base, coef, max, floor time.Duration
+}
+
+// defaultBackoffConfig returns the current package level defaults. Swarms are
+// seeded with these so later changes to the package variables don't affect
+// them.
+func defaultBackoffConfig() backoffConfig {
+	return backoffConfig{base: BackoffBase, coef: BackoffCoef, max: BackoffMax, floor: BackoffFloor}
+}
+
+// withDefaults replaces zero values with the package level defaults.
+func (c backoffConfig) withDefaults() backoffConfig {
+	if c.base <= 0 {
+		c.base = BackoffBase
+	}
+	if c.coef <= 0 {
+		c.coef = BackoffCoef
+	}
+	if c.max <= 0 {
+		c.max = BackoffMax
+	}
+	if c.floor <= 0 {
+		c.floor = BackoffFloor
+	}
+	return c
+}
+
+// atLeastFloor returns d, raised to the backoff floor if it's below it.
+func (c backoffConfig) atLeastFloor(d time.Duration) time.Duration {
+	if d < c.floor {
+		return c.floor
+	}
+	return d
 }
 
 type backoffPeer struct {
+	id    peer.ID
 	tries int
 	until time.Time
+	// last is when the peer was last backed off.
+	last time.Time
+	elem *list.Element
 }
 
+// DefaultMaxBackoffEntries is the default maximum number of peers a
+// DialBackoff tracks.
+const DefaultMaxBackoffEntries = 10000
+
 func (db *DialBackoff) init() {
 	if db.entries == nil {
 		db.entries = make(map[peer.ID]*backoffPeer)
 	}
 }
 
+// SetMaxEntries sets the maximum number of peers tracked. Once it's reached,
+// the least recently backed off peers are forgotten. A limit <= 0 restores
+// the default (DefaultMaxBackoffEntries).
+func (db *DialBackoff) SetMaxEntries(n int) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.init()
+	db.maxEntries = n
+	db.evict()
+}
+
+// SetBase sets the base amount of time to backoff for, overriding the global
+// BackoffBase. A duration <= 0 restores the global default.
+func (db *DialBackoff) SetBase(d time.Duration) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.cfg.base = d
+}
+
+// SetCoef sets the backoff coefficient, overriding the global BackoffCoef. A
+// duration <= 0 restores the global default.
+func (db *DialBackoff) SetCoef(d time.Duration) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.cfg.coef = d
+}
+
+// SetMax sets the maximum backoff time, overriding the global BackoffMax. A
+// duration <= 0 restores the global default.
+func (db *DialBackoff) SetMax(d time.Duration) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.cfg.max = d
+}
+
+// SetFloor sets the minimum backoff time, overriding the global BackoffFloor.
+// A duration <= 0 restores the global default.
+func (db *DialBackoff) SetFloor(d time.Duration) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.cfg.floor = d
+}
+
+// config returns the backoff parameters in use.
+func (db *DialBackoff) config() backoffConfig {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.cfg.withDefaults()
+}
+
 // Backoff returns whether the client should backoff from dialing
 // peer p
 func (db *DialBackoff) Backoff(p peer.ID) (backoff bool) {
@@ -110,22 +280,46 @@ func (db *DialBackoff) Backoff(p peer.ID) (backoff bool) {
 	defer db.lock.Unlock()
 	db.init()
 	bp, found := db.entries[p]
-	if found && time.Now().Before(bp.until) {
+	if found && db.now().Before(bp.until) {
 		return true
 	}
 
 	return false
 }
 
-// BackoffBase is the base amount of time to backoff (default: 5s).
+// Peers returns the peers we're currently backing off from. See Export for
+// when their backoff expires.
+func (db *DialBackoff) Peers() []peer.ID {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	now := db.now()
+	var peers []peer.ID
+	for p, bp := range db.entries {
+		if now.Before(bp.until) {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// BackoffBase is the default base amount of time to backoff (default: 5s).
+// Swarms copy it when they're constructed, see DialBackoff.SetBase.
 var BackoffBase = time.Second * 5
 
-// BackoffCoef is the backoff coefficient (default: 1s).
+// BackoffCoef is the default backoff coefficient (default: 1s). Swarms copy
+// it when they're constructed, see DialBackoff.SetCoef.
 var BackoffCoef = time.Second
 
-// BackoffMax is the maximum backoff time (default: 5m).
+// BackoffMax is the default maximum backoff time (default: 5m). Swarms copy
+// it when they're constructed, see DialBackoff.SetMax.
 var BackoffMax = time.Minute * 5
 
+// BackoffFloor is the default minimum backoff time (default: 0, i.e.
+// BackoffBase). Unlike BackoffBase, it also applies to peers whose tries were
+// reset (see DialBackoff.ResetTries) and takes precedence over BackoffMax.
+// Swarms copy it when they're constructed, see DialBackoff.SetFloor.
+var BackoffFloor time.Duration
+
 // AddBackoff lets other nodes know that we've entered backoff with
 // peer p, so dialers should not wait unnecessarily. We still will
 // attempt to dial with one goroutine, in case we get through.
@@ -135,26 +329,74 @@ var BackoffMax = time.Minute * 5
 //
 //     BackoffBase + BakoffCoef * PriorBackoffs^2
 //
-// Where PriorBackoffs is the number of previous backoffs.
+// Where PriorBackoffs is the number of previous backoffs, capped at BackoffMax
+// and raised to BackoffFloor. The parameters are this DialBackoff's (see
+// SetBase, SetCoef, SetMax and SetFloor).
 func (db *DialBackoff) AddBackoff(p peer.ID) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 	db.init()
+	cfg := db.cfg.withDefaults()
 	bp, ok := db.entries[p]
 	if !ok {
-		db.entries[p] = &backoffPeer{
+		now := db.now()
+		bp = &backoffPeer{
+			id:    p,
 			tries: 1,
-			until: time.Now().Add(BackoffBase),
+			until: now.Add(cfg.atLeastFloor(cfg.base)),
+			last:  now,
 		}
+		bp.elem = db.lru.PushBack(bp)
+		db.entries[p] = bp
+		db.evict()
 		return
 	}
 
-	backoffTime := BackoffBase + BackoffCoef*time.Duration(bp.tries*bp.tries)
-	if backoffTime > BackoffMax {
-		backoffTime = BackoffMax
+	backoffTime := cfg.base + cfg.coef*time.Duration(bp.tries*bp.tries)
+	if backoffTime > cfg.max {
+		backoffTime = cfg.max
 	}
-	bp.until = time.Now().Add(backoffTime)
+	backoffTime = cfg.atLeastFloor(backoffTime)
+	bp.last = db.now()
+	bp.until = bp.last.Add(backoffTime)
 	bp.tries++
+	db.lru.MoveToBack(bp.elem)
+}
+
+// sweep forgets peers whose backoff has expired and that haven't been backed
+// off again for staleAfter. Forgotten peers start over from BackoffBase the
+// next time they're backed off.
+func (db *DialBackoff) sweep(staleAfter time.Duration) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	now := db.now()
+	// The LRU list is sorted by last, so we can stop at the first recent
+	// entry.
+	for e := db.lru.Front(); e != nil; e = db.lru.Front() {
+		bp := e.Value.(*backoffPeer)
+		if now.Sub(bp.last) < staleAfter || now.Before(bp.until) {
+			return
+		}
+		db.remove(bp)
+	}
+}
+
+// evict forgets the least recently backed off entries until we're within the
+// limit. Expired entries are left to sweep: forgetting them early would reset
+// the escalation of peers that keep failing.
+func (db *DialBackoff) evict() {
+	max := db.maxEntries
+	if max <= 0 {
+		max = DefaultMaxBackoffEntries
+	}
+	for len(db.entries) > max {
+		db.remove(db.lru.Front().Value.(*backoffPeer))
+	}
+}
+
+func (db *DialBackoff) remove(bp *backoffPeer) {
+	db.lru.Remove(bp.elem)
+	delete(db.entries, bp.id)
 }
 
 // Clear removes a backoff record. Clients should call this after a
@@ -163,7 +405,138 @@ func (db *DialBackoff) Clear(p peer.ID) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 	db.init()
-	delete(db.entries, p)
+	if bp, ok := db.entries[p]; ok {
+		db.remove(bp)
+	}
+}
+
+// ResetTries forgets how many times p has been backed off, without touching
+// the current backoff window. The next AddBackoff then only backs p off for
+// the base delay, as if it were p's first failure, instead of picking up the
+// escalation where p's previous failures left it.
+func (db *DialBackoff) ResetTries(p peer.ID) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.init()
+	if bp, ok := db.entries[p]; ok {
+		bp.tries = 0
+	}
+}
+
+// BackoffRecord is a peer's backoff state as exported by DialBackoff.Export.
+type BackoffRecord struct {
+	Peer peer.ID
+	// Tries is the number of times the peer has been backed off.
+	Tries int
+	// Until is when the backoff expires.
+	Until time.Time
+}
+
+// Export returns the backoff state of all peers we're tracking, least
+// recently backed off first, so it can be restored with Import (e.g. after a
+// restart).
+func (db *DialBackoff) Export() []BackoffRecord {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.init()
+	records := make([]BackoffRecord, 0, db.lru.Len())
+	for e := db.lru.Front(); e != nil; e = e.Next() {
+		bp := e.Value.(*backoffPeer)
+		records = append(records, BackoffRecord{Peer: bp.id, Tries: bp.tries, Until: bp.until})
+	}
+	return records
+}
+
+// Import restores backoff state exported by Export, replacing the state of
+// peers we're already tracking. Expired records are skipped.
+func (db *DialBackoff) Import(records []BackoffRecord) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.init()
+	now := db.now()
+	for _, r := range records {
+		if !now.Before(r.Until) {
+			continue
+		}
+		if bp, ok := db.entries[r.Peer]; ok {
+			db.remove(bp)
+		}
+		bp := &backoffPeer{
+			id:    r.Peer,
+			tries: r.Tries,
+			until: r.Until,
+			last:  now,
+		}
+		bp.elem = db.lru.PushBack(bp)
+		db.entries[r.Peer] = bp
+	}
+	db.evict()
+}
+
+// ExportBackoffs returns the swarm's dial backoff state. See
+// DialBackoff.Export.
+func (s *Swarm) ExportBackoffs() []BackoffRecord {
+	return s.backf.Export()
+}
+
+// SetClock sets the clock used by the swarm's dial backoff, see
+// DialBackoff.SetClock.
+func (s *Swarm) SetClock(c Clock) {
+	s.backf.SetClock(c)
+}
+
+// BackedOffPeers returns the peers the swarm is currently backing off from.
+func (s *Swarm) BackedOffPeers() []peer.ID {
+	return s.backf.Peers()
+}
+
+// ResetBackoffTries resets the escalation of the swarm's dial backoff for p,
+// see DialBackoff.ResetTries.
+func (s *Swarm) ResetBackoffTries(p peer.ID) {
+	s.backf.ResetTries(p)
+}
+
+// ImportBackoffs restores dial backoff state exported by ExportBackoffs. See
+// DialBackoff.Import.
+func (s *Swarm) ImportBackoffs(records []BackoffRecord) {
+	s.backf.Import(records)
+}
+
+// SetBackoffSweepInterval makes the swarm periodically forget peers whose dial
+// backoff expired and that haven't been backed off again for the maximum
+// backoff time (see DialBackoff.SetMax). Otherwise, they're only forgotten
+// when the backoff is full (see DialBackoff.SetMaxEntries). An interval <= 0
+// (the default) stops sweeping.
+//
+// The sweeper stops when the swarm is closed.
+func (s *Swarm) SetBackoffSweepInterval(interval time.Duration) {
+	s.backoffSweep.Lock()
+	defer s.backoffSweep.Unlock()
+	if s.backoffSweep.stop != nil {
+		close(s.backoffSweep.stop)
+		s.backoffSweep.stop = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	s.backoffSweep.stop = stop
+	go s.sweepBackoffs(interval, stop)
+}
+
+func (s *Swarm) sweepBackoffs(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.backf.sweep(s.backf.config().max)
+		case <-stop:
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
 }
 
 // DialPeer connects to a peer.
@@ -176,12 +549,490 @@ func (s *Swarm) DialPeer(ctx context.Context, p peer.ID) (inet.Conn, error) {
 	return s.dialPeer(ctx, p)
 }
 
+// DialPriority determines the order in which dials waiting on the swarm's
+// dial limits are started, see WithDialPriority.
+type DialPriority int
+
+const (
+	// DialPriorityLow is for background dials that can wait.
+	DialPriorityLow DialPriority = -1
+	// DialPriorityNormal is the default priority.
+	DialPriorityNormal DialPriority = 0
+	// DialPriorityHigh is for dials someone is waiting on, e.g. when
+	// bootstrapping or connecting on the user's request.
+	DialPriorityHigh DialPriority = 1
+)
+
+type dialPriorityKey struct{}
+
+// WithDialPriority returns a context that makes the swarm's dials start ahead
+// of lower priority dials once they have to wait on the dial limits. Dials of
+// the same priority start in order.
+//
+// The priority is the one of the call that started the dial: calls joining a
+// dial to the same peer that's already in progress don't change it.
+func WithDialPriority(ctx context.Context, prio DialPriority) context.Context {
+	return context.WithValue(ctx, dialPriorityKey{}, prio)
+}
+
+func dialPriority(ctx context.Context) DialPriority {
+	prio, _ := ctx.Value(dialPriorityKey{}).(DialPriority)
+	return prio
+}
+
+// DialHints are transport specific hints for a dial, e.g. the role expected
+// of the remote peer or a QoS class. The swarm passes them along to the
+// transports untouched, transports ignore the hints they don't know.
+type DialHints map[string]string
+
+type dialHintsKey struct{}
+
+// WithDialHints returns a context carrying hints for the transports dialing
+// on behalf of DialPeer. Transports read them with DialHintsFromContext.
+//
+// As with the dial priority, only the hints of the call that started the dial
+// are used.
+func WithDialHints(ctx context.Context, hints DialHints) context.Context {
+	return context.WithValue(ctx, dialHintsKey{}, hints)
+}
+
+// DialHintsFromContext returns the dial hints set with WithDialHints, nil if
+// there are none. Transports must not modify them.
+func DialHintsFromContext(ctx context.Context) DialHints {
+	hints, _ := ctx.Value(dialHintsKey{}).(DialHints)
+	return hints
+}
+
+// DialReport describes the work done by a dial.
+type DialReport struct {
+	// AttemptedAddrs is the number of addresses dialed.
+	AttemptedAddrs int
+	// FailedAddrs is the number of those addresses that failed.
+	FailedAddrs int
+}
+
+// dialCounts collects the numbers reported in a DialReport while dialing.
+type dialCounts struct {
+	attempted, failed int64
+}
+
+type dialCountsKey struct{}
+
+// countsFromContext returns the dialCounts of ctx, if any. dialCounts methods
+// may be called on a nil *dialCounts.
+func countsFromContext(ctx context.Context) *dialCounts {
+	dc, _ := ctx.Value(dialCountsKey{}).(*dialCounts)
+	return dc
+}
+
+func (dc *dialCounts) addAttempt() {
+	if dc != nil {
+		atomic.AddInt64(&dc.attempted, 1)
+	}
+}
+
+func (dc *dialCounts) addFailure() {
+	if dc != nil {
+		atomic.AddInt64(&dc.failed, 1)
+	}
+}
+
+// DialPeerWithReport is like DialPeer but also reports how many addresses
+// were dialed (across retries, see SetDialAttempts) and how many of those
+// failed.
+//
+// Nothing is reported when we're already connected to the peer or when the
+// call joins a dial to the peer that was already in progress.
+func (s *Swarm) DialPeerWithReport(ctx context.Context, p peer.ID) (inet.Conn, DialReport, error) {
+	dc := new(dialCounts)
+	c, err := s.dialPeer(context.WithValue(ctx, dialCountsKey{}, dc), p)
+	report := DialReport{
+		AttemptedAddrs: int(atomic.LoadInt64(&dc.attempted)),
+		FailedAddrs:    int(atomic.LoadInt64(&dc.failed)),
+	}
+	if err != nil {
+		return nil, report, err
+	}
+	return c, report, nil
+}
+
+// PauseDialing stops the swarm from starting new dials until ResumeDialing is
+// called. Dials to peers we're already connected to still return the existing
+// connection, other dials fail with ErrDialingPaused. Dials that are already
+// in progress aren't affected.
+func (s *Swarm) PauseDialing() {
+	atomic.StoreInt32(&s.dialPaused, 1)
+}
+
+// ResumeDialing allows the swarm to start new dials again after PauseDialing.
+func (s *Swarm) ResumeDialing() {
+	atomic.StoreInt32(&s.dialPaused, 0)
+}
+
+func (s *Swarm) dialingPaused() bool {
+	return atomic.LoadInt32(&s.dialPaused) != 0
+}
+
+// SetRequireEncryption makes dials fail with ErrInsecureDialRejected instead
+// of establishing unencrypted connections when the swarm has no private key.
+// It applies to every outbound dial, including RefreshConn, automatic
+// reconnects and DialPeerViaRelay.
+func (s *Swarm) SetRequireEncryption(require bool) {
+	s.dialCfg.Lock()
+	defer s.dialCfg.Unlock()
+	s.dialCfg.requireEncryption = require
+}
+
+func (s *Swarm) requireEncryption() bool {
+	s.dialCfg.RLock()
+	defer s.dialCfg.RUnlock()
+	return s.dialCfg.requireEncryption
+}
+
+// checkEncryption returns ErrInsecureDialRejected if we require encryption
+// but can't secure the connection to p.
+func (s *Swarm) checkEncryption(ctx context.Context, p peer.ID) error {
+	if s.requireEncryption() && s.peers.PrivKey(s.local) == nil {
+		log.Event(ctx, "swarmDialInsecureRejected", p)
+		return ErrInsecureDialRejected
+	}
+	return nil
+}
+
+// SetRelayFallbackOnly makes the swarm treat relay (/p2p-circuit) addresses
+// as a last resort. When enabled, relay addresses are only dialed once all
+// direct addresses have failed or, if window is positive, once window has
+// passed without a direct connection. Direct dials keep going in the latter
+// case.
+func (s *Swarm) SetRelayFallbackOnly(enabled bool, window time.Duration) {
+	s.relayFallbackOnly = enabled
+	s.relayFallbackWindow = window
+}
+
+// SetDialHedgeDelay makes the swarm dial a peer's addresses one at a time,
+// best first, instead of all at once: the next address is only dialed once
+// the dials in progress have all failed or d has passed without any of them
+// succeeding. Slow dials aren't canceled when the next address is dialed, the
+// first connection established wins. A delay <= 0 (the default) disables
+// hedging.
+func (s *Swarm) SetDialHedgeDelay(d time.Duration) {
+	s.dialCfg.Lock()
+	defer s.dialCfg.Unlock()
+	s.dialCfg.hedgeDelay = d
+}
+
+func (s *Swarm) dialHedgeDelay() time.Duration {
+	s.dialCfg.RLock()
+	defer s.dialCfg.RUnlock()
+	return s.dialCfg.hedgeDelay
+}
+
+// DialFallback is called when dialing a peer fails, either because we don't
+// know any usable addresses or because dialing all of them failed. It returns
+// new addresses for the peer (e.g., from a DHT or a rendezvous server). They're
+// added to the peerstore and the peer is dialed once more.
+//
+// Dials made from within the fallback (e.g., to query the DHT) don't invoke
+// the fallback again. Dialing the peer being looked up from within the
+// fallback fails with ErrDialFallbackLoop.
+type DialFallback func(ctx context.Context, p peer.ID) ([]ma.Multiaddr, error)
+
+// SetDialFallback sets the function used to find new addresses for peers we
+// failed to dial. A nil fallback (the default) disables this.
+func (s *Swarm) SetDialFallback(f DialFallback) {
+	s.dialCfg.Lock()
+	defer s.dialCfg.Unlock()
+	s.dialCfg.fallback = f
+}
+
+func (s *Swarm) dialFallback() DialFallback {
+	s.dialCfg.RLock()
+	defer s.dialCfg.RUnlock()
+	return s.dialCfg.fallback
+}
+
+// dialFallbackKey marks the context passed to the dial fallback with the peer
+// being looked up.
+type dialFallbackKey struct{}
+
+// SetPerPeerDialLimit overrides the number of addresses of peer p the swarm
+// dials concurrently (DefaultPerPeerRateLimit by default). A limit <= 0
+// restores the default.
+func (s *Swarm) SetPerPeerDialLimit(p peer.ID, limit int) {
+	s.limiter.setPeerLimit(p, limit)
+}
+
+// DialQueue identifies the limit a pending dial is waiting on.
+type DialQueue int
+
+const (
+	// DialActive means the dial isn't waiting, it's in progress.
+	DialActive DialQueue = iota
+	// DialWaitingOnPeerLimit means the dial is waiting for other dials to
+	// the same peer to finish (see SetPerPeerDialLimit).
+	DialWaitingOnPeerLimit
+	// DialWaitingOnFdLimit means the dial is waiting for a file descriptor
+	// (see ConcurrentFdDials).
+	DialWaitingOnFdLimit
+	// DialWaitingOnNonFdLimit means the dial is waiting on the limit for
+	// dials that don't consume file descriptors (see ConcurrentNonFdDials).
+	DialWaitingOnNonFdLimit
+)
+
+// PendingDial describes a dial to a single address that's either in progress
+// or queued behind one of the swarm's dial limits.
+type PendingDial struct {
+	Peer peer.ID
+	Addr ma.Multiaddr
+
+	Queue DialQueue
+	// Position is the dial's position in its queue, 0 being the next dial
+	// to run. Dials waiting on the peer limit are queued per peer. It's
+	// always 0 for active dials.
+	Position int
+}
+
+// PendingDials returns the address dials currently in progress followed by
+// those waiting on a dial limit.
+func (s *Swarm) PendingDials() []PendingDial {
+	return s.limiter.pendingDials()
+}
+
+// SetDialTimeout overrides the DialPeer timeout for peer p, e.g. to give
+// distant peers more time or to fail fast on LAN peers. It takes precedence
+// over the swarm's default (see SetDefaultDialTimeout) and the global
+// inet.DialPeerTimeout, but not over a timeout set on the caller's context. A
+// duration <= 0 restores the default.
+func (s *Swarm) SetDialTimeout(p peer.ID, d time.Duration) {
+	s.dialTimeouts.Lock()
+	defer s.dialTimeouts.Unlock()
+	if d <= 0 {
+		delete(s.dialTimeouts.m, p)
+		return
+	}
+	if s.dialTimeouts.m == nil {
+		s.dialTimeouts.m = make(map[peer.ID]time.Duration)
+	}
+	s.dialTimeouts.m[p] = d
+}
+
+// dialPeerTimeout returns the timeout to use when dialing peer p with ctx. A
+// timeout set on the context with inet.WithDialPeerTimeout takes precedence
+// over p's timeout (see SetDialTimeout), then the swarm's default (see
+// SetDefaultDialTimeout) and finally the global inet.DialPeerTimeout.
+func (s *Swarm) dialPeerTimeout(ctx context.Context, p peer.ID) time.Duration {
+	timeout := inet.GetDialPeerTimeout(ctx)
+	if timeout != inet.DialPeerTimeout {
+		return timeout
+	}
+	s.dialTimeouts.RLock()
+	d, ok := s.dialTimeouts.m[p]
+	s.dialTimeouts.RUnlock()
+	if ok {
+		return d
+	}
+	if d := s.defaultDialTimeout(); d > 0 {
+		return d
+	}
+	return timeout
+}
+
+// CancelDial cancels the in-progress dial to peer p, if any, including its
+// queued address dials. The callers waiting on it return ErrDialCanceled and
+// p isn't backed off.
+func (s *Swarm) CancelDial(p peer.ID) {
+	log.Debugf("canceling dials to %s", p)
+	s.dsync.CancelDial(p)
+}
+
+// DialAny dials all of the given peers concurrently and returns the first
+// connection established, canceling the remaining dials. If all dials fail,
+// it returns an error listing why each of them failed.
+//
+// Each dial respects the dialed peer's backoff, just like DialPeer.
+func (s *Swarm) DialAny(ctx context.Context, peers []peer.ID) (inet.Conn, error) {
+	if len(peers) == 0 {
+		return nil, errors.New("no peers to dial")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		p    peer.ID
+		conn *Conn
+		err  error
+	}
+	// Buffered so the losers don't block forever once we return.
+	resch := make(chan result, len(peers))
+	for _, p := range peers {
+		go func(p peer.ID) {
+			conn, err := s.dialPeer(ctx, p)
+			resch <- result{p, conn, err}
+		}(p)
+	}
+
+	errs := make([]string, 0, len(peers))
+	for range peers {
+		res := <-resch
+		if res.err == nil {
+			return res.conn, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", res.p, res.err))
+	}
+	return nil, fmt.Errorf("failed to dial any peer: %s", strings.Join(errs, ", "))
+}
+
+// Bootstrap dials all of the given peers concurrently and waits for every
+// dial to finish. The returned slice holds the result of dialing peers[i] at
+// index i: nil if we're now connected to that peer.
+//
+// Unlike DialAny, a failed dial doesn't affect the others. Dials go through
+// the usual limits and peers we're backing off from fail with ErrDialBackoff.
+func (s *Swarm) Bootstrap(ctx context.Context, peers []peer.ID) []error {
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p peer.ID) {
+			defer wg.Done()
+			_, errs[i] = s.dialPeer(ctx, p)
+		}(i, p)
+	}
+	wg.Wait()
+	return errs
+}
+
+// DialPeerViaRelay dials target through the relay peer relay, using the
+// /p2p/<relay>/p2p-circuit/p2p/<target> address. This requires a transport for
+// the p2p-circuit protocol (e.g., the one from go-libp2p-circuit) which also
+// registers the protocol with go-multiaddr.
+//
+// Unlike DialPeer, it always opens a new connection and doesn't check or
+// update the target's dial backoff.
+func (s *Swarm) DialPeerViaRelay(ctx context.Context, target, relay peer.ID) (_ inet.Conn, err error) {
+	if target == s.local || relay == s.local {
+		return nil, ErrDialToSelf
+	}
+	if target == relay {
+		return nil, errors.New("can't relay a connection through the target itself")
+	}
+	if s.peerBlocked(target) {
+		log.Event(ctx, "swarmDialBlocked", target)
+		return nil, ErrPeerBlocked
+	}
+	if s.dialingPaused() {
+		log.Event(ctx, "swarmDialPaused", target)
+		return nil, ErrDialingPaused
+	}
+	if s.isDraining() {
+		return nil, ErrSwarmClosed
+	}
+	if err := s.checkEncryption(ctx, target); err != nil {
+		return nil, err
+	}
+
+	addr, err := ma.NewMultiaddr(fmt.Sprintf("/p2p/%s/p2p-circuit/p2p/%s", relay.Pretty(), target.Pretty()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct relay address: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(withDialID(ctx), s.dialPeerTimeout(ctx, target))
+	defer cancel()
+
+	traced := s.dialTracesFor(target).begin(dialID(ctx), time.Now())
+	traced.plan([]ma.Multiaddr{addr}, nil)
+	defer func() { traced.end(err) }()
+
+	addrs := make(chan ma.Multiaddr, 1)
+	addrs <- addr
+	close(addrs)
+	// dialAddr makes sure we're connected to target.
+	connC, latency, err := s.dialAddrs(ctx, target, addrs, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.addConn(connC, inet.DirOutbound, latency)
+	if err != nil {
+		connC.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// RefreshConn dials a new connection to peer p even if we're already
+// connected to it, e.g. because the existing connection seems stale. Once the
+// new connection is up, the previous ones are closed gracefully (see
+// Conn.CloseGracefully) and new streams use the new connection.
+//
+// The dial ignores p's backoff. If it fails, the existing connections are
+// kept.
+func (s *Swarm) RefreshConn(ctx context.Context, p peer.ID) (inet.Conn, error) {
+	if p == s.local {
+		return nil, ErrDialToSelf
+	}
+	if s.peerBlocked(p) {
+		log.Event(ctx, "swarmDialBlocked", p)
+		return nil, ErrPeerBlocked
+	}
+	if s.dialingPaused() {
+		log.Event(ctx, "swarmDialPaused", p)
+		return nil, ErrDialingPaused
+	}
+	if s.isDraining() {
+		return nil, ErrSwarmClosed
+	}
+
+	old := s.ConnsToPeer(p)
+
+	ctx, cancel := context.WithTimeout(withDialID(ctx), s.dialPeerTimeout(ctx, p))
+	defer cancel()
+	c, err := s.dialWithRetries(ctx, p)
+	if err != nil {
+		log.Debugf("[dial %d] failed to refresh the connection to %s: %s", dialID(ctx), p, err)
+		return nil, err
+	}
+
+	for _, oc := range old {
+		// addConn may have resolved a simultaneous open in favor of an
+		// existing connection.
+		if oc == inet.Conn(c) {
+			continue
+		}
+		// Stop new streams from using it right away.
+		oc.(*Conn).drain()
+		go oc.(*Conn).CloseGracefully(s.ctx)
+	}
+	return c, nil
+}
+
 // internal dial method that returns an unwrapped conn
 //
 // It is gated by the swarm's dial synchronization systems: dialsync and
 // dialbackoff.
 func (s *Swarm) dialPeer(ctx context.Context, p peer.ID) (*Conn, error) {
-	log.Debugf("[%s] swarm dialing peer [%s]", s.local, p)
+	if s.peerBlocked(p) {
+		log.Event(ctx, "swarmDialBlocked", p)
+		return nil, ErrPeerBlocked
+	}
+
+	// check if we already have an open connection first. This is the hot
+	// path so don't do anything else (logging, validation, etc.) before.
+	if conn := s.bestConnToPeerWrapper(p); conn != nil && !wantsNewConn(ctx) {
+		return conn, nil
+	}
+
+	if s.dialingPaused() {
+		log.Event(ctx, "swarmDialPaused", p)
+		return nil, ErrDialingPaused
+	}
+
+	if s.isDraining() {
+		return nil, ErrSwarmClosed
+	}
+
+	ctx = withDialID(ctx)
+	log.Debugf("[dial %d] [%s] swarm dialing peer [%s]", dialID(ctx), s.local, p)
 	var logdial = lgbl.Dial("swarm", s.LocalPeer(), p, nil, nil)
 	err := p.Validate()
 	if err != nil {
@@ -190,36 +1041,122 @@ func (s *Swarm) dialPeer(ctx context.Context, p peer.ID) (*Conn, error) {
 
 	if p == s.local {
 		log.Event(ctx, "swarmDialSelf", logdial)
+		atomic.AddInt64(&s.dstats.dialsToSelf, 1)
 		return nil, ErrDialToSelf
 	}
 
-	defer log.EventBegin(ctx, "swarmDialAttemptSync", p).Done()
+	if fp, ok := ctx.Value(dialFallbackKey{}).(peer.ID); ok && fp == p {
+		return nil, ErrDialFallbackLoop
+	}
 
-	// check if we already have an open connection first
-	conn := s.bestConnToPeerWrapper(p)
-	if conn != nil {
-		return conn, nil
+	// dialAddrs checks this too but failing here doesn't back off the peer.
+	if err := s.checkEncryption(ctx, p); err != nil {
+		return nil, err
 	}
 
+	defer log.EventBegin(ctx, "swarmDialAttemptSync", p).Done()
+
 	// if this peer has been backed off, lets get out of here
 	if s.backf.Backoff(p) {
 		log.Event(ctx, "swarmDialBackoff", p)
+		atomic.AddInt64(&s.dstats.backoffs, 1)
 		return nil, ErrDialBackoff
 	}
 
 	// apply the DialPeer timeout
-	ctx, cancel := context.WithTimeout(ctx, inet.GetDialPeerTimeout(ctx))
+	ctx, cancel := context.WithTimeout(ctx, s.dialPeerTimeout(ctx, p))
 	defer cancel()
 
-	conn, err = s.dsync.DialLock(ctx, p)
+	conn, err := s.dsync.DialLock(ctx, p)
+	if err != nil && s.dialFallback() != nil {
+		conn, err = s.dialWithFallback(ctx, p, err)
+	}
 	if err != nil {
+		log.Event(ctx, "swarmDialFailed", logdial)
 		return nil, err
 	}
 
-	log.Debugf("network for %s finished dialing %s", s.local, p)
+	log.Debugf("[dial %d] network for %s finished dialing %s", dialID(ctx), s.local, p)
 	return conn, err
 }
 
+// dialIDs is used to generate unique dial IDs.
+var dialIDs uint64
+
+type dialIDKey struct{}
+
+// withDialID tags ctx with a new dial ID used to correlate the log lines of a
+// single call to dialPeer. Events logged with the returned context include it
+// as the "dialID" field.
+func withDialID(ctx context.Context) context.Context {
+	id := atomic.AddUint64(&dialIDs, 1)
+	ctx = context.WithValue(ctx, dialIDKey{}, id)
+	return logging.ContextWithLoggable(ctx, logging.LoggableMap{"dialID": id})
+}
+
+// dialID returns the dial ID ctx has been tagged with, 0 if none.
+func dialID(ctx context.Context) uint64 {
+	id, _ := ctx.Value(dialIDKey{}).(uint64)
+	return id
+}
+
+// dialWithFallback asks the dial fallback for new addresses of peer p after
+// dialing it failed with err and, if there are any, dials p once more.
+func (s *Swarm) dialWithFallback(ctx context.Context, p peer.ID, err error) (*Conn, error) {
+	if ctx.Err() != nil || err == ErrDialCanceled {
+		return nil, err
+	}
+	if ctx.Value(dialFallbackKey{}) != nil {
+		// We're dialing from within the fallback.
+		return nil, err
+	}
+
+	log.Debugf("[dial %d] dial to %s failed, asking the dial fallback for addresses: %s", dialID(ctx), p, err)
+	addrs, ferr := s.dialFallback()(context.WithValue(ctx, dialFallbackKey{}, p), p)
+	if ferr != nil {
+		log.Debugf("[dial %d] dial fallback for %s failed: %s", dialID(ctx), p, ferr)
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, err
+	}
+	s.peers.AddAddrs(p, addrs, pstore.TempAddrTTL)
+	return s.dsync.DialLock(ctx, p)
+}
+
+// dialWithRetries dials peer p up to s.dialAttempts() times, waiting
+// DialRetryDelay between attempts. Errors that won't go away by trying again
+// are returned immediately.
+func (s *Swarm) dialWithRetries(ctx context.Context, p peer.ID) (*Conn, error) {
+	attempts := s.dialAttempts()
+	for i := 1; ; i++ {
+		conn, err := s.dial(ctx, p)
+		if err == nil || i >= attempts || !retryableDialErr(err) {
+			return conn, err
+		}
+		log.Debugf("[dial %d] dial attempt %d to %s failed, retrying: %s", dialID(ctx), i, p, err)
+
+		t := time.NewTimer(DialRetryDelay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		}
+	}
+}
+
+// retryableDialErr returns true if dialing again might fix the given error.
+func retryableDialErr(err error) bool {
+	switch err {
+	case ErrDialToSelf, ErrPeerBlocked, ErrSwarmClosed, ErrAddrFiltered,
+		ErrGaterDisallowedConnection, ErrNoAddresses, ErrNoGoodAddresses,
+		ErrInsecureDialRejected, context.Canceled, context.DeadlineExceeded:
+		return false
+	}
+	return true
+}
+
 // doDial is an ugly shim method to retain all the logging and backoff logic
 // of the old dialsync code
 func (s *Swarm) doDial(ctx context.Context, p peer.ID) (*Conn, error) {
@@ -227,7 +1164,7 @@ func (s *Swarm) doDial(ctx context.Context, p peer.ID) (*Conn, error) {
 	// By the time we take the dial lock, we may already *have* a connection
 	// to the peer.
 	c := s.bestConnToPeerWrapper(p)
-	if c != nil {
+	if c != nil && !wantsNewConn(ctx) {
 		return c, nil
 	}
 
@@ -237,7 +1174,10 @@ func (s *Swarm) doDial(ctx context.Context, p peer.ID) (*Conn, error) {
 	// if it succeeds, dial will add the conn to the swarm itself.
 	defer log.EventBegin(ctx, "swarmDialAttemptStart", logdial).Done()
 
-	conn, err := s.dial(ctx, p)
+	atomic.AddInt64(&s.dstats.dials, 1)
+	atomic.AddInt64(&s.dialsInFlight, 1)
+	conn, err := s.dialWithRetries(ctx, p)
+	atomic.AddInt64(&s.dialsInFlight, -1)
 	if err != nil {
 		conn = s.bestConnToPeerFallbackWrapper(p)
 		if conn != nil {
@@ -245,17 +1185,25 @@ func (s *Swarm) doDial(ctx context.Context, p peer.ID) (*Conn, error) {
 			// Could have canceled the dial because we received a
 			// connection or some other random reason.
 			// Just ignore the error and return the connection.
-			log.Debugf("ignoring dial error because we have a connection: %s", err)
+			log.Debugf("[dial %d] ignoring dial error because we have a connection: %s", dialID(ctx), err)
+			atomic.AddInt64(&s.dstats.successes, 1)
 			return conn, nil
 		}
+		if ctx.Err() != nil {
+			// Canceled, the peer isn't at fault.
+			atomic.AddInt64(&s.dstats.failures, 1)
+			return nil, ErrDialCanceled
+		}
 		if err != context.Canceled {
 			log.Event(ctx, "swarmDialBackoffAdd", logdial)
 			s.backf.AddBackoff(p) // let others know to backoff
 		}
 
 		// ok, we failed.
-		return nil, fmt.Errorf("dial attempt failed: %s", err)
+		atomic.AddInt64(&s.dstats.failures, 1)
+		return nil, fmt.Errorf("dial attempt failed: %w", err)
 	}
+	atomic.AddInt64(&s.dstats.successes, 1)
 	return conn, nil
 }
 
@@ -265,19 +1213,26 @@ func (s *Swarm) canDial(addr ma.Multiaddr) bool {
 }
 
 // dial is the actual swarm's dial logic, gated by Dial.
-func (s *Swarm) dial(ctx context.Context, p peer.ID) (*Conn, error) {
+func (s *Swarm) dial(ctx context.Context, p peer.ID) (_ *Conn, err error) {
 	var logdial = lgbl.Dial("swarm", s.LocalPeer(), p, nil, nil)
 	if p == s.local {
 		log.Event(ctx, "swarmDialDoDialSelf", logdial)
+		atomic.AddInt64(&s.dstats.dialsToSelf, 1)
 		return nil, ErrDialToSelf
 	}
+	if dialID(ctx) == 0 {
+		ctx = withDialID(ctx)
+	}
+	traced := s.dialTracesFor(p).begin(dialID(ctx), time.Now())
+	defer func() { traced.end(err) }()
 	defer log.EventBegin(ctx, "swarmDialDo", logdial).Done()
 	logdial["dial"] = "failure" // start off with failure. set to "success" at the end.
 
 	sk := s.peers.PrivKey(s.local)
 	logdial["encrypted"] = sk != nil // log whether this will be an encrypted dial or not.
 	if sk == nil {
-		// fine for sk to be nil, just log.
+		// fine for sk to be nil unless we require encryption (checked
+		// in dialAddrs), just log.
 		log.Debug("Dial not given PrivateKey, so WILL NOT SECURE conn.")
 	}
 
@@ -289,23 +1244,11 @@ func (s *Swarm) dial(ctx context.Context, p peer.ID) (*Conn, error) {
 		the improved rate limiter, while maintaining the outward behaviour
 		that we previously had (halting a dial when we run out of addrs)
 	*/
-	peerAddrs := s.peers.Addrs(p)
-	if len(peerAddrs) == 0 {
-		return nil, errors.New("no addresses")
-	}
-	goodAddrs := s.filterKnownUndialables(peerAddrs)
-
-	if len(goodAddrs) == 0 {
-		return nil, errors.New("no good addresses")
-	}
-
-	if s.bestDest != nil {
-		// Select the best address to peer.
-		bestAddrs := s.bestDestSelectWrapper(p, goodAddrs)
-		if len(bestAddrs) != 0 {
-			goodAddrs = bestAddrs
-		}
+	goodAddrs, relayAddrs, err := s.addrsToDial(ctx, p, true)
+	if err != nil {
+		return nil, err
 	}
+	traced.plan(goodAddrs, relayAddrs)
 	goodAddrsChan := make(chan ma.Multiaddr, len(goodAddrs))
 	for _, a := range goodAddrs {
 		goodAddrsChan <- a
@@ -314,7 +1257,7 @@ func (s *Swarm) dial(ctx context.Context, p peer.ID) (*Conn, error) {
 	/////////
 
 	// try to get a connection to any addr
-	connC, err := s.dialAddrs(ctx, p, goodAddrsChan)
+	connC, latency, err := s.dialAddrs(ctx, p, goodAddrsChan, relayAddrs, s.relayFallbackWindow)
 	if err != nil {
 		logdial["error"] = err.Error()
 		return nil, err
@@ -323,7 +1266,7 @@ func (s *Swarm) dial(ctx context.Context, p peer.ID) (*Conn, error) {
 		"localAddr":  connC.LocalMultiaddr(),
 		"remoteAddr": connC.RemoteMultiaddr(),
 	}
-	swarmC, err := s.addConn(connC, inet.DirOutbound)
+	swarmC, err := s.addConn(connC, inet.DirOutbound, latency)
 	if err != nil {
 		logdial["error"] = err.Error()
 		connC.Close() // close the connection. didn't work out :(
@@ -334,12 +1277,131 @@ func (s *Swarm) dial(ctx context.Context, p peer.ID) (*Conn, error) {
 	return swarmC, nil
 }
 
+// addrsToDial returns the addresses of peer p to dial, in order, followed by
+// the relay addresses to fall back on (see SetRelayFallbackOnly). If
+// dropScores is set, the scores of addresses p no longer has are forgotten.
+func (s *Swarm) addrsToDial(ctx context.Context, p peer.ID, dropScores bool) (addrs, fallback []ma.Multiaddr, err error) {
+	peerAddrs := s.peers.Addrs(p)
+	if len(peerAddrs) == 0 {
+		return nil, nil, ErrNoAddresses
+	}
+	peerAddrs = s.resolveAddrs(ctx, p, peerAddrs)
+	if dropScores {
+		s.addrScores.dropUnknown(p, peerAddrs)
+	}
+
+	goodAddrs := s.filterKnownUndialables(peerAddrs)
+
+	if len(goodAddrs) == 0 {
+		return nil, nil, ErrNoGoodAddresses
+	}
+	s.rankAddrs(p, goodAddrs)
+
+	if order := s.addrDialOrder(); order != nil {
+		// Only keep the addresses that made it through the filters.
+		if ordered := intersectAddrs(order(p, goodAddrs), goodAddrs); len(ordered) != 0 {
+			goodAddrs = ordered
+		}
+	}
+
+	if s.bestDest != nil {
+		// Select the best address to peer.
+		bestAddrs := s.bestDestSelectWrapper(p, goodAddrs)
+		if len(bestAddrs) != 0 {
+			goodAddrs = bestAddrs
+		}
+	}
+	if max := s.maxDialAddrs(); max > 0 && len(goodAddrs) > max {
+		goodAddrs = goodAddrs[:max]
+	}
+	var relayAddrs []ma.Multiaddr
+	if s.relayFallbackOnly {
+		goodAddrs, relayAddrs = splitRelayAddrs(goodAddrs)
+		if len(goodAddrs) == 0 {
+			goodAddrs, relayAddrs = relayAddrs, nil
+		}
+	}
+	return goodAddrs, relayAddrs, nil
+}
+
+// PlannedDial is an address DialPeer would dial and the name of the
+// transport it would use (e.g., "tcp").
+type PlannedDial struct {
+	Addr      ma.Multiaddr
+	Transport string
+}
+
+// DialPlan describes what DialPeer would dial, see DryRunDial.
+type DialPlan struct {
+	// Addrs are dialed in order, as the dial limits allow.
+	Addrs []PlannedDial
+	// Fallback are the relay addresses dialed once all of Addrs fail or
+	// the relay fallback window passes (see SetRelayFallbackOnly).
+	Fallback []PlannedDial
+}
+
+// DryRunDial returns the addresses of peer p DialPeer would dial, in order,
+// and the transports it would use. It goes through the same resolution,
+// filtering and ranking but doesn't dial or change the swarm's state.
+//
+// It doesn't consider the dial backoff or existing connections.
+func (s *Swarm) DryRunDial(ctx context.Context, p peer.ID) (DialPlan, error) {
+	if p == s.local {
+		return DialPlan{}, ErrDialToSelf
+	}
+	addrs, fallback, err := s.addrsToDial(ctx, p, false)
+	if err != nil {
+		return DialPlan{}, err
+	}
+	return DialPlan{Addrs: s.planDials(addrs), Fallback: s.planDials(fallback)}, nil
+}
+
+func (s *Swarm) planDials(addrs []ma.Multiaddr) []PlannedDial {
+	var planned []PlannedDial
+	for _, a := range addrs {
+		// filterKnownUndialables only keeps addresses we have a
+		// transport for.
+		if tpt := s.TransportForDialing(a); tpt != nil {
+			planned = append(planned, PlannedDial{Addr: a, Transport: transportName(tpt)})
+		}
+	}
+	return planned
+}
+
 // filterKnownUndialables takes a list of multiaddrs, and removes those
 // that we definitely don't want to dial: addresses configured to be blocked,
 // IPv6 link-local addresses, addresses without a dial-capable transport,
 // and addresses that we know to be our own.
 // This is an optimization to avoid wasting time on dials that we know are going to fail.
 func (s *Swarm) filterKnownUndialables(addrs []ma.Multiaddr) []ma.Multiaddr {
+	filters := s.undialableFilters()
+	fs := make([]func(ma.Multiaddr) bool, len(filters))
+	for i, f := range filters {
+		fs[i] = f.keep
+	}
+	return addrutil.FilterAddrs(addrs, fs...)
+}
+
+// addrFilter is one of the filters used by filterKnownUndialables. reason
+// explains why an address that doesn't pass the filter isn't dialable.
+type addrFilter struct {
+	reason string
+	keep   func(ma.Multiaddr) bool
+}
+
+func (s *Swarm) undialableFilters() []addrFilter {
+	return []addrFilter{
+		{"self", s.notOurAddrFilter()},
+		{"no transport", s.newDialTransportCache().canDial},
+		// TODO: Consider allowing link-local addresses
+		{"link-local", addrutil.AddrOverNonLocalIP},
+		{"blocked", addrutil.FilterNeg(s.addrFilters().AddrBlocked)},
+	}
+}
+
+// notOurAddrFilter returns a filter dropping our own /ip4 and /ip6 listen
+// addresses.
+func (s *Swarm) notOurAddrFilter() func(ma.Multiaddr) bool {
 	lisAddrs, _ := s.InterfaceListenAddresses()
 	var ourAddrs []ma.Multiaddr
 	for _, addr := range lisAddrs {
@@ -349,47 +1411,253 @@ func (s *Swarm) filterKnownUndialables(addrs []ma.Multiaddr) []ma.Multiaddr {
 			ourAddrs = append(ourAddrs, addr)
 		}
 	}
+	return addrutil.SubtractFilter(ourAddrs...)
+}
 
-	return addrutil.FilterAddrs(addrs,
-		addrutil.SubtractFilter(ourAddrs...),
-		s.canDial,
-		// TODO: Consider allowing link-local addresses
-		addrutil.AddrOverNonLocalIP,
-		addrutil.FilterNeg(s.Filters.AddrBlocked),
-	)
+// hasDialableAddr returns true if we know of an address p passes
+// filterKnownUndialables. It stops at the first one and only looks up our own
+// addresses once an address passes the other filters, so it's cheap enough
+// for Connectedness.
+func (s *Swarm) hasDialableAddr(p peer.ID) bool {
+	addrs := s.peers.Addrs(p)
+	if len(addrs) == 0 {
+		return false
+	}
+	tpts := s.newDialTransportCache()
+	filters := s.addrFilters()
+	var notOurs func(ma.Multiaddr) bool
+	for _, a := range addrs {
+		if !tpts.canDial(a) || !addrutil.AddrOverNonLocalIP(a) || filters.AddrBlocked(a) {
+			continue
+		}
+		if notOurs == nil {
+			notOurs = s.notOurAddrFilter()
+		}
+		if notOurs(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// isListenAddr returns true if addr is one of the addresses we listen on.
+func (s *Swarm) isListenAddr(addr ma.Multiaddr) bool {
+	ifaceAddrs, _ := s.InterfaceListenAddresses()
+	for _, addrs := range [][]ma.Multiaddr{s.ListenAddresses(), ifaceAddrs} {
+		for _, a := range addrs {
+			if a.Equal(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AddrDialability describes whether the swarm would dial an address.
+type AddrDialability struct {
+	Addr     ma.Multiaddr
+	Dialable bool
+	// Reason is the reason the address isn't dialable: "self" (it's one of
+	// our own addresses), "no transport", "link-local" or "blocked" (by the
+	// swarm's address filters). It's empty for dialable addresses.
+	Reason string
+}
+
+// ExplainDialability reports, for each of peer p's known addresses, whether
+// the swarm would dial it and, if not, why. It's meant for debugging and
+// doesn't change any state. DNS addresses are reported as they are, without
+// resolving them first.
+func (s *Swarm) ExplainDialability(p peer.ID) []AddrDialability {
+	filters := s.undialableFilters()
+	addrs := s.peers.Addrs(p)
+	out := make([]AddrDialability, len(addrs))
+	for i, a := range addrs {
+		out[i] = AddrDialability{Addr: a, Dialable: true}
+		for _, f := range filters {
+			if !f.keep(a) {
+				out[i].Dialable = false
+				out[i].Reason = f.reason
+				break
+			}
+		}
+	}
+	return out
+}
+
+// circuitCode is the multiaddr code of /p2p-circuit. The protocol is
+// registered by the circuit relay transport, not go-multiaddr.
+const circuitCode = 290
+
+// isRelayAddr returns true if a goes through a circuit relay.
+func isRelayAddr(a ma.Multiaddr) bool {
+	return hasProtocol(a, circuitCode)
 }
 
-func (s *Swarm) dialAddrs(ctx context.Context, p peer.ID, remoteAddrs <-chan ma.Multiaddr) (transport.Conn, error) {
-	log.Debugf("%s swarm dialing %s", s.local, p)
+// splitRelayAddrs splits addrs into direct and relay addresses, preserving
+// their order.
+func splitRelayAddrs(addrs []ma.Multiaddr) (direct, relay []ma.Multiaddr) {
+	for _, a := range addrs {
+		if isRelayAddr(a) {
+			relay = append(relay, a)
+		} else {
+			direct = append(direct, a)
+		}
+	}
+	return direct, relay
+}
+
+// intersectAddrs returns the addresses of addrs that are in allowed, in the
+// order of addrs, without duplicates.
+func intersectAddrs(addrs, allowed []ma.Multiaddr) []ma.Multiaddr {
+	keep := make(map[string]struct{}, len(allowed))
+	for _, a := range allowed {
+		keep[string(a.Bytes())] = struct{}{}
+	}
+	var out []ma.Multiaddr
+	for _, a := range addrs {
+		if _, ok := keep[string(a.Bytes())]; ok {
+			delete(keep, string(a.Bytes()))
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// rankAddrs sorts the (filtered) addresses of peer p we're about to dial in
+// place, best first. The address family preference takes precedence over
+// address scores.
+func (s *Swarm) rankAddrs(p peer.ID, addrs []ma.Multiaddr) {
+	s.addrScores.SortAddrs(p, addrs)
+	s.dialCfg.RLock()
+	pref, randomize := s.dialCfg.familyPref, s.dialCfg.randomizeAddrOrder
+	s.dialCfg.RUnlock()
+	pref.sortAddrs(addrs)
+	if randomize {
+		s.shuffleTies(p, addrs, pref)
+	}
+}
+
+// SetRandomizeAddrOrder sets whether the swarm should shuffle the addresses
+// of a peer that are ranked the same (same address family preference and
+// score) before dialing them, spreading the load over equivalent endpoints
+// (e.g., several relays) instead of always dialing the first one. Addresses
+// are never moved ahead of better ranked ones. It's off by default.
+func (s *Swarm) SetRandomizeAddrOrder(enable bool) {
+	s.dialCfg.Lock()
+	defer s.dialCfg.Unlock()
+	s.dialCfg.randomizeAddrOrder = enable
+}
+
+// shuffleTies shuffles each run of equally ranked addresses of the (ranked)
+// addresses of peer p. They were ranked with the address family preference
+// pref.
+func (s *Swarm) shuffleTies(p peer.ID, addrs []ma.Multiaddr, pref AddressFamilyPreference) {
+	ties := s.addrScores.ties(p, addrs)
+	for i := 1; i < len(addrs); i++ {
+		ties[i] = ties[i] && pref.prefers(addrs[i-1]) == pref.prefers(addrs[i])
+	}
+
+	s.addrRand.Lock()
+	defer s.addrRand.Unlock()
+	if s.addrRand.r == nil {
+		s.addrRand.r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	for start := 0; start < len(addrs); {
+		end := start + 1
+		for end < len(addrs) && ties[end] {
+			end++
+		}
+		run := addrs[start:end]
+		s.addrRand.r.Shuffle(len(run), func(i, j int) {
+			run[i], run[j] = run[j], run[i]
+		})
+		start = end
+	}
+}
+
+// dialAddrs dials the given addresses (respecting the dial limiter) and returns
+// the first successful connection along with the time it took to dial it.
+// remoteAddrs must be buffered to hold all of the addresses.
+//
+// The fallback addresses are only dialed once all of remoteAddrs have failed
+// or, if window is positive, once window has passed.
+//
+// If a hedge delay is set (see SetDialHedgeDelay), remoteAddrs are dialed one
+// at a time.
+func (s *Swarm) dialAddrs(ctx context.Context, p peer.ID, remoteAddrs <-chan ma.Multiaddr, fallback []ma.Multiaddr, window time.Duration) (transport.Conn, time.Duration, error) {
+	log.Debugf("[dial %d] %s swarm dialing %s", dialID(ctx), s.local, p)
+
+	if err := s.checkEncryption(ctx, p); err != nil {
+		return nil, 0, err
+	}
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel() // cancel work when we exit func
 
 	// use a single response type instead of errs and conns, reduces complexity *a ton*
-	respch := make(chan dialResult)
+	//
+	// Every dial job sends exactly one result. Make room for all of them so
+	// the limiter never blocks on us after we've returned.
+	respch := make(chan dialResult, cap(remoteAddrs)+len(fallback))
 
 	defaultDialFail := inet.ErrNoRemoteAddrs
 	exitErr := defaultDialFail
 
-	defer s.limiter.clearAllPeerDials(p)
+	counts := countsFromContext(ctx)
 
 	var active int
-	for remoteAddrs != nil || active > 0 {
+	defer func() {
+		if active > 0 {
+			go drainDialResults(respch, active)
+		}
+	}()
+	defer s.limiter.clearAllPeerDials(p)
+
+	var fallbackTimer <-chan time.Time
+	if len(fallback) > 0 && window > 0 {
+		t := time.NewTimer(window)
+		defer t.Stop()
+		fallbackTimer = t.C
+	}
+	dialFallback := func() {
+		log.Debugf("[dial %d] %s swarm dialing fallback addresses of %s", dialID(ctx), s.local, p)
+		for _, addr := range fallback {
+			s.limitedDial(ctx, p, addr, respch)
+			counts.addAttempt()
+			active++
+		}
+		fallback, fallbackTimer = nil, nil
+	}
+
+	hedgeDelay := s.dialHedgeDelay()
+	// hedgeTimer fires when the next address may be dialed even though the
+	// previous dials are still in progress.
+	var hedgeTimer <-chan time.Time
+	hedgeReady := true
+
+	for remoteAddrs != nil || active > 0 || len(fallback) > 0 {
+		if len(fallback) > 0 && remoteAddrs == nil && active == 0 {
+			// Everything else failed, no need to wait any longer.
+			dialFallback()
+		}
+
 		// Check for context cancellations and/or responses first.
 		select {
 		case <-ctx.Done():
 			if exitErr == defaultDialFail {
 				exitErr = ctx.Err()
 			}
-			return nil, exitErr
+			return nil, 0, exitErr
 		case resp := <-respch:
 			active--
+			s.recordDialResult(ctx, p, resp)
 			if resp.Err != nil {
-				log.Infof("got error on dial to %s: %s", resp.Addr, resp.Err)
+				log.Infof("[dial %d] got error on dial to %s: %s", dialID(ctx), resp.Addr, resp.Err)
 				// Errors are normal, lots of dials will fail
+				counts.addFailure()
 				exitErr = resp.Err
 			} else if resp.Conn != nil {
-				return resp.Conn, nil
+				return resp.Conn, resp.Latency, nil
 			}
 
 			// We got a result, try again from the top.
@@ -398,32 +1666,68 @@ func (s *Swarm) dialAddrs(ctx context.Context, p peer.ID, remoteAddrs <-chan ma.
 		}
 
 		// Now, attempt to dial.
+		nextAddrs := remoteAddrs
+		if hedgeDelay > 0 && active > 0 && !hedgeReady {
+			nextAddrs = nil
+		}
 		select {
-		case addr, ok := <-remoteAddrs:
+		case addr, ok := <-nextAddrs:
 			if !ok {
 				remoteAddrs = nil
 				continue
 			}
 
 			s.limitedDial(ctx, p, addr, respch)
+			counts.addAttempt()
 			active++
+			if hedgeDelay > 0 {
+				hedgeReady, hedgeTimer = false, time.After(hedgeDelay)
+			}
+		case <-hedgeTimer:
+			log.Debugf("[dial %d] %s swarm hedging dial to %s", dialID(ctx), s.local, p)
+			hedgeReady, hedgeTimer = true, nil
+		case <-fallbackTimer:
+			dialFallback()
 		case <-ctx.Done():
 			if exitErr == defaultDialFail {
 				exitErr = ctx.Err()
 			}
-			return nil, exitErr
+			return nil, 0, exitErr
 		case resp := <-respch:
 			active--
+			s.recordDialResult(ctx, p, resp)
 			if resp.Err != nil {
-				log.Infof("got error on dial to %s: %s", resp.Addr, resp.Err)
+				log.Infof("[dial %d] got error on dial to %s: %s", dialID(ctx), resp.Addr, resp.Err)
 				// Errors are normal, lots of dials will fail
+				counts.addFailure()
 				exitErr = resp.Err
 			} else if resp.Conn != nil {
-				return resp.Conn, nil
+				return resp.Conn, resp.Latency, nil
 			}
 		}
 	}
-	return nil, exitErr
+	return nil, 0, exitErr
+}
+
+// drainDialResults waits for the remaining n results of an abandoned
+// dialAddrs call and closes any connections that were still established.
+func drainDialResults(respch <-chan dialResult, n int) {
+	for ; n > 0; n-- {
+		if resp := <-respch; resp.Conn != nil {
+			resp.Conn.Close()
+		}
+	}
+}
+
+// recordDialResult feeds the result of dialing a single address into the
+// address scoreboard. Dials that failed because we canceled them don't count.
+func (s *Swarm) recordDialResult(ctx context.Context, p peer.ID, resp dialResult) {
+	switch {
+	case resp.Err == nil:
+		s.addrScores.AddSuccess(p, resp.Addr, resp.Latency)
+	case ctx.Err() == nil:
+		s.addrScores.AddFailure(p, resp.Addr)
+	}
 }
 
 // limitedDial will start a dial to the given peer when
@@ -431,31 +1735,56 @@ func (s *Swarm) dialAddrs(ctx context.Context, p peer.ID, remoteAddrs <-chan ma.
 // limiting that occur without using extra goroutines per addr
 func (s *Swarm) limitedDial(ctx context.Context, p peer.ID, a ma.Multiaddr, resp chan dialResult) {
 	s.limiter.AddDialJob(&dialJob{
-		addr: a,
-		peer: p,
-		resp: resp,
-		ctx:  ctx,
+		addr:     a,
+		peer:     p,
+		resp:     resp,
+		ctx:      ctx,
+		priority: dialPriority(ctx),
 	})
 }
 
-func (s *Swarm) dialAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) (transport.Conn, error) {
+func (s *Swarm) dialAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) (_ transport.Conn, err error) {
 	// Just to double check. Costs nothing.
 	if s.local == p {
 		return nil, ErrDialToSelf
 	}
-	log.Debugf("%s swarm dialing %s %s", s.local, p, addr)
+	// Another peer claiming one of our addresses would make us dial
+	// ourselves. filterKnownUndialables should have caught this but it only
+	// knows about plain IP addresses.
+	if s.isListenAddr(addr) {
+		log.Event(ctx, "swarmDialOwnAddr", p, logging.LoggableMap{"addr": addr.String()})
+		return nil, ErrDialToSelf
+	}
+	log.Debugf("[dial %d] %s swarm dialing %s %s", dialID(ctx), s.local, p, addr)
+
+	start := time.Now()
+	id := dialID(ctx)
+	s.emitDialEvent(DialEvent{Type: DialStarted, Peer: p, Addr: addr, Start: start, DialID: id})
+	defer func() {
+		s.emitDialEvent(DialEvent{Type: DialFinished, Peer: p, Addr: addr, Start: start, End: time.Now(), Err: err, DialID: id})
+	}()
+
+	if s.gater != nil && !s.gater.InterceptAddrDial(p, addr) {
+		return nil, ErrGaterDisallowedConnection
+	}
 
 	tpt := s.TransportForDialing(addr)
 	if tpt == nil {
 		return nil, ErrNoTransport
 	}
 
-	connC, err := tpt.Dial(ctx, addr, p)
+	connC, err := s.transportDial(ctx, tpt, addr, p)
+	s.dstats.recordTransportDial(tpt, err)
 	if err != nil {
 		return nil, fmt.Errorf("%s --> %s dial attempt failed: %s", s.local, p, err)
 	}
 
 	// Trust the transport? Yeah... right.
+	if connC.RemotePeer() == "" {
+		connC.Close()
+		log.Errorf("BUG in transport %T: dialed %s without learning its peer ID", tpt, addr)
+		return nil, ErrNoRemotePeer
+	}
 	if connC.RemotePeer() != p {
 		connC.Close()
 		err = fmt.Errorf("BUG in transport %T: tried to dial %s, dialed %s", p, connC.RemotePeer(), tpt)
@@ -463,6 +1792,11 @@ func (s *Swarm) dialAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) (tra
 		return nil, err
 	}
 
+	if err := s.applySocketOpts(connC); err != nil {
+		connC.Close()
+		return nil, fmt.Errorf("%s --> %s failed to set socket options: %s", s.local, p, err)
+	}
+
 	// success! we got one!
 	return connC, nil
 }
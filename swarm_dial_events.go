@@ -0,0 +1,83 @@
+package swarm
+
+import (
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DialEventBufferSize is the number of dial events buffered for each
+// subscriber (see Swarm.SubscribeDials). Events that don't fit are dropped.
+const DialEventBufferSize = 64
+
+// DialEventType tells whether a DialEvent is for the start or the end of a
+// dial.
+type DialEventType int
+
+const (
+	// DialStarted is emitted when we start dialing an address.
+	DialStarted DialEventType = iota
+	// DialFinished is emitted when a dial to an address succeeds or fails.
+	DialFinished
+)
+
+// DialEvent describes a dial to a single address of a peer.
+type DialEvent struct {
+	Type DialEventType
+	Peer peer.ID
+	Addr ma.Multiaddr
+
+	Start time.Time
+	// End is when the dial finished. It's zero for DialStarted events.
+	End time.Time
+	// Err is the reason a finished dial failed, nil if it succeeded.
+	Err error
+
+	// DialID identifies the dial to the peer this address dial is part of.
+	// Dials to several addresses of a peer share it. It's the ID the swarm's
+	// debug logs are tagged with.
+	DialID uint64
+}
+
+// SubscribeDials returns a channel receiving an event whenever the swarm
+// starts or finishes dialing an address, and a function that cancels the
+// subscription and closes the channel.
+//
+// Dials never wait for subscribers: events are dropped if the subscriber
+// falls more than DialEventBufferSize events behind.
+func (s *Swarm) SubscribeDials() (<-chan DialEvent, func()) {
+	ch := make(chan DialEvent, DialEventBufferSize)
+
+	s.dialSubs.Lock()
+	if s.dialSubs.m == nil {
+		s.dialSubs.m = make(map[chan DialEvent]struct{})
+	}
+	s.dialSubs.m[ch] = struct{}{}
+	s.dialSubs.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.dialSubs.Lock()
+			delete(s.dialSubs.m, ch)
+			s.dialSubs.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (s *Swarm) emitDialEvent(ev DialEvent) {
+	s.traceDialEvent(ev)
+
+	s.dialSubs.RLock()
+	defer s.dialSubs.RUnlock()
+	for ch := range s.dialSubs.m {
+		select {
+		case ch <- ev:
+		default:
+			log.Debugf("dropping dial event for %s, subscriber is too slow", ev.Peer)
+		}
+	}
+}
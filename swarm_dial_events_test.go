@@ -0,0 +1,70 @@
+package swarm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+func TestSubscribeDials(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	events, cancel := s1.SubscribeDials()
+	defer cancel()
+
+	unreachable, badAddr, l := newSilentPeer(t)
+	l.Close()
+	s1.Peerstore().AddAddr(unreachable, badAddr, pstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, unreachable); err == nil {
+		t.Fatal("dial should have failed")
+	}
+	goodAddr := s2.ListenAddresses()[0]
+	s1.Peerstore().AddAddr(s2.LocalPeer(), goodAddr, pstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() DialEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a dial event")
+		}
+		panic("unreachable")
+	}
+	for _, expected := range []struct {
+		typ    DialEventType
+		peer   peer.ID
+		failed bool
+	}{
+		{DialStarted, unreachable, false},
+		{DialFinished, unreachable, true},
+		{DialStarted, s2.LocalPeer(), false},
+		{DialFinished, s2.LocalPeer(), false},
+	} {
+		ev := next()
+		if ev.Type != expected.typ || ev.Peer != expected.peer {
+			t.Fatalf("expected a %d event for %s, got a %d event for %s", expected.typ, expected.peer, ev.Type, ev.Peer)
+		}
+		if (ev.Err != nil) != expected.failed {
+			t.Fatalf("unexpected dial outcome for %s: %v", ev.Addr, ev.Err)
+		}
+		if ev.Type == DialFinished && ev.End.Before(ev.Start) {
+			t.Fatal("dial finished before it started")
+		}
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("expected the channel to be closed")
+	}
+}
@@ -0,0 +1,295 @@
+package swarm
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DialTrace records the dials to a peer, see Swarm.StartDialTrace.
+//
+// A trace serializes to JSON as:
+//
+//	{
+//	  "peer": "<base58 peer ID>",
+//	  "dials": [
+//	    {
+//	      "start": "<RFC 3339 time>",
+//	      "end": "<RFC 3339 time, omitted while the dial is running>",
+//	      "addrs": ["<multiaddr>", ...],
+//	      "fallback": ["<relay multiaddr>", ...],
+//	      "attempts": [
+//	        {
+//	          "addr": "<multiaddr>",
+//	          "start": "<RFC 3339 time>",
+//	          "end": "<RFC 3339 time>",
+//	          "error": "<omitted if the attempt succeeded>"
+//	        }
+//	      ],
+//	      "error": "<omitted if the dial succeeded>"
+//	    }
+//	  ]
+//	}
+//
+// "addrs" and "fallback" are the addresses the swarm chose to dial, in
+// order. "attempts" are listed in the order they finished. Times have
+// nanosecond precision.
+type DialTrace struct {
+	peer peer.ID
+	stop func()
+
+	lk    sync.Mutex
+	dials []TracedDial
+}
+
+// TracedDial is a single attempt at connecting to a peer. It usually dials
+// several addresses.
+type TracedDial struct {
+	Start time.Time
+	// End is zero while the dial is running.
+	End time.Time
+	// Addrs are the addresses the swarm chose to dial, in order, and
+	// Fallback the relay addresses dialed if they all fail.
+	Addrs    []ma.Multiaddr
+	Fallback []ma.Multiaddr
+	Attempts []TracedDialAttempt
+	// Err is the reason the dial failed, nil if it succeeded.
+	Err error
+
+	// id is the dial ID of the dial, see DialEvent.DialID.
+	id uint64
+}
+
+// TracedDialAttempt is a dial to one of the peer's addresses.
+type TracedDialAttempt struct {
+	Addr       ma.Multiaddr
+	Start, End time.Time
+	// Err is the reason the attempt failed, nil if it succeeded.
+	Err error
+}
+
+// StartDialTrace starts recording the dials to peer p: the addresses chosen,
+// in which order, and the outcome and timing of each attempt. Recording
+// stops when the trace's Stop method is called.
+//
+// Unlike SubscribeDials, tracing never drops events. It's meant for
+// debugging and shouldn't be left running.
+func (s *Swarm) StartDialTrace(p peer.ID) *DialTrace {
+	t := &DialTrace{peer: p}
+
+	s.dialTraces.Lock()
+	if s.dialTraces.m == nil {
+		s.dialTraces.m = make(map[peer.ID]map[*DialTrace]struct{})
+	}
+	if s.dialTraces.m[p] == nil {
+		s.dialTraces.m[p] = make(map[*DialTrace]struct{})
+	}
+	s.dialTraces.m[p][t] = struct{}{}
+	s.dialTraces.Unlock()
+
+	var once sync.Once
+	t.stop = func() {
+		once.Do(func() {
+			s.dialTraces.Lock()
+			delete(s.dialTraces.m[p], t)
+			if len(s.dialTraces.m[p]) == 0 {
+				delete(s.dialTraces.m, p)
+			}
+			s.dialTraces.Unlock()
+		})
+	}
+	return t
+}
+
+// Stop stops recording. The trace keeps what it recorded so far.
+func (t *DialTrace) Stop() {
+	t.stop()
+}
+
+// Peer returns the traced peer.
+func (t *DialTrace) Peer() peer.ID {
+	return t.peer
+}
+
+// Dials returns a copy of the dials recorded so far, oldest first.
+func (t *DialTrace) Dials() []TracedDial {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	dials := make([]TracedDial, len(t.dials))
+	for i, d := range t.dials {
+		d.Attempts = append([]TracedDialAttempt(nil), d.Attempts...)
+		dials[i] = d
+	}
+	return dials
+}
+
+type exportedDialTrace struct {
+	Peer  string               `json:"peer"`
+	Dials []exportedTracedDial `json:"dials"`
+}
+
+type exportedTracedDial struct {
+	Start    time.Time                   `json:"start"`
+	End      *time.Time                  `json:"end,omitempty"`
+	Addrs    []string                    `json:"addrs"`
+	Fallback []string                    `json:"fallback,omitempty"`
+	Attempts []exportedTracedDialAttempt `json:"attempts"`
+	Error    string                      `json:"error,omitempty"`
+}
+
+type exportedTracedDialAttempt struct {
+	Addr  string    `json:"addr"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Error string    `json:"error,omitempty"`
+}
+
+// MarshalJSON encodes the trace as documented on DialTrace.
+func (t *DialTrace) MarshalJSON() ([]byte, error) {
+	out := exportedDialTrace{
+		Peer:  peer.IDB58Encode(t.peer),
+		Dials: []exportedTracedDial{},
+	}
+	for _, d := range t.Dials() {
+		ed := exportedTracedDial{
+			Start:    d.Start,
+			Addrs:    addrStrings(d.Addrs),
+			Fallback: addrStrings(d.Fallback),
+			Attempts: []exportedTracedDialAttempt{},
+			Error:    errString(d.Err),
+		}
+		if !d.End.IsZero() {
+			end := d.End
+			ed.End = &end
+		}
+		for _, a := range d.Attempts {
+			ed.Attempts = append(ed.Attempts, exportedTracedDialAttempt{
+				Addr:  a.Addr.String(),
+				Start: a.Start,
+				End:   a.End,
+				Error: errString(a.Err),
+			})
+		}
+		out.Dials = append(out.Dials, ed)
+	}
+	return json.Marshal(&out)
+}
+
+func addrStrings(addrs []ma.Multiaddr) []string {
+	strs := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		strs = append(strs, a.String())
+	}
+	return strs
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// dialTraces are the traces recording the dials to a peer. It's nil (and
+// does nothing) if nobody is tracing the peer.
+type dialTraces []*DialTrace
+
+func (s *Swarm) dialTracesFor(p peer.ID) dialTraces {
+	s.dialTraces.RLock()
+	defer s.dialTraces.RUnlock()
+
+	if len(s.dialTraces.m[p]) == 0 {
+		return nil
+	}
+	traces := make(dialTraces, 0, len(s.dialTraces.m[p]))
+	for t := range s.dialTraces.m[p] {
+		traces = append(traces, t)
+	}
+	return traces
+}
+
+// tracedDial is a dial recorded by a trace: the index of its TracedDial in
+// t.dials.
+type tracedDial struct {
+	t *DialTrace
+	i int
+}
+
+// tracedDials are the dials begun by dialTraces.begin, one per trace.
+type tracedDials []tracedDial
+
+// begin records the start of the dial with the given dial ID and returns the
+// recorded dials, to be completed with plan and end.
+func (ts dialTraces) begin(id uint64, start time.Time) tracedDials {
+	if len(ts) == 0 {
+		return nil
+	}
+	ds := make(tracedDials, 0, len(ts))
+	for _, t := range ts {
+		t.lk.Lock()
+		t.dials = append(t.dials, TracedDial{Start: start, id: id})
+		ds = append(ds, tracedDial{t: t, i: len(t.dials) - 1})
+		t.lk.Unlock()
+	}
+	return ds
+}
+
+func (ds tracedDials) plan(addrs, fallback []ma.Multiaddr) {
+	for _, d := range ds {
+		d.t.lk.Lock()
+		td := &d.t.dials[d.i]
+		td.Addrs = append([]ma.Multiaddr(nil), addrs...)
+		td.Fallback = append([]ma.Multiaddr(nil), fallback...)
+		d.t.lk.Unlock()
+	}
+}
+
+func (ds tracedDials) end(err error) {
+	now := time.Now()
+	for _, d := range ds {
+		d.t.lk.Lock()
+		td := &d.t.dials[d.i]
+		td.End = now
+		td.Err = err
+		d.t.lk.Unlock()
+	}
+}
+
+// traceDialEvent records finished dials to single addresses.
+func (s *Swarm) traceDialEvent(ev DialEvent) {
+	if ev.Type != DialFinished {
+		return
+	}
+	for _, t := range s.dialTracesFor(ev.Peer) {
+		t.lk.Lock()
+		d := t.dialWithID(ev.DialID)
+		if d == nil {
+			// Started before the trace.
+			t.dials = append(t.dials, TracedDial{Start: ev.Start, id: ev.DialID})
+			d = &t.dials[len(t.dials)-1]
+		}
+		d.Attempts = append(d.Attempts, TracedDialAttempt{
+			Addr:  ev.Addr,
+			Start: ev.Start,
+			End:   ev.End,
+			Err:   ev.Err,
+		})
+		t.lk.Unlock()
+	}
+}
+
+// dialWithID returns the last dial with the given dial ID, nil if there's
+// none. Retries share their dial ID but don't overlap, so the last one is the
+// one running. t.lk must be held.
+func (t *DialTrace) dialWithID(id uint64) *TracedDial {
+	for i := len(t.dials) - 1; i >= 0; i-- {
+		if t.dials[i].id == id {
+			return &t.dials[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package swarm_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	transport "github.com/libp2p/go-libp2p-transport"
+	testutil "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+func TestDialTrace(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	_, badAddr, l := newSilentPeer(t)
+	l.Close()
+	goodAddr := s2.ListenAddresses()[0]
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), []ma.Multiaddr{badAddr, goodAddr}, pstore.PermanentAddrTTL)
+	// dial the addresses one after the other, the bad one first.
+	s1.SetDialHedgeDelay(time.Minute)
+	s1.SetAddrDialOrder(func(peer.ID, []ma.Multiaddr) []ma.Multiaddr {
+		return []ma.Multiaddr{badAddr, goodAddr}
+	})
+
+	trace := s1.StartDialTrace(s2.LocalPeer())
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	trace.Stop()
+	s1.ClosePeer(s2.LocalPeer())
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	dials := trace.Dials()
+	if len(dials) != 1 {
+		t.Fatalf("expected a single dial to be traced, got %d", len(dials))
+	}
+	d := dials[0]
+	if d.Err != nil {
+		t.Fatalf("expected the dial to succeed, got %s", d.Err)
+	}
+	if d.End.Before(d.Start) {
+		t.Fatal("dial finished before it started")
+	}
+	if len(d.Addrs) != 2 || !d.Addrs[0].Equal(badAddr) || !d.Addrs[1].Equal(goodAddr) {
+		t.Fatalf("expected the dialed addresses to be %s and %s, got %s", badAddr, goodAddr, d.Addrs)
+	}
+	if len(d.Attempts) != 2 {
+		t.Fatalf("expected two attempts, got %d", len(d.Attempts))
+	}
+	for i, expected := range []struct {
+		addr   ma.Multiaddr
+		failed bool
+	}{
+		{badAddr, true},
+		{goodAddr, false},
+	} {
+		a := d.Attempts[i]
+		if !a.Addr.Equal(expected.addr) {
+			t.Fatalf("expected attempt %d to dial %s, dialed %s", i, expected.addr, a.Addr)
+		}
+		if (a.Err != nil) != expected.failed {
+			t.Fatalf("unexpected outcome for %s: %v", a.Addr, a.Err)
+		}
+		if a.Start.Before(d.Start) || a.End.Before(a.Start) || a.End.After(d.End) {
+			t.Fatalf("unexpected timing for %s: %s - %s", a.Addr, a.Start, a.End)
+		}
+	}
+
+	buf, err := json.Marshal(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Peer  string `json:"peer"`
+		Dials []struct {
+			Start    time.Time `json:"start"`
+			End      time.Time `json:"end"`
+			Addrs    []string  `json:"addrs"`
+			Attempts []struct {
+				Addr  string `json:"addr"`
+				Error string `json:"error"`
+			} `json:"attempts"`
+			Error string `json:"error"`
+		} `json:"dials"`
+	}
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Peer != peer.IDB58Encode(s2.LocalPeer()) {
+		t.Fatalf("expected the trace to be for %s, got %s", s2.LocalPeer(), decoded.Peer)
+	}
+	if len(decoded.Dials) != 1 || len(decoded.Dials[0].Attempts) != 2 {
+		t.Fatalf("unexpected trace: %s", buf)
+	}
+	dj := decoded.Dials[0]
+	if !dj.Start.Equal(d.Start) || !dj.End.Equal(d.End) || dj.Error != "" {
+		t.Fatalf("unexpected trace: %s", buf)
+	}
+	if dj.Attempts[0].Addr != badAddr.String() || dj.Attempts[0].Error == "" {
+		t.Fatalf("expected the first attempt to fail, got %s", buf)
+	}
+	if dj.Attempts[1].Addr != goodAddr.String() || dj.Attempts[1].Error != "" {
+		t.Fatalf("expected the second attempt to succeed, got %s", buf)
+	}
+}
+
+func TestDialTraceOverlappingDials(t *testing.T) {
+	// the fake relay connects directly, the target would take both
+	// connections for a simultaneous open.
+	defer func(w time.Duration) { SimultaneousOpenWindow = w }(SimultaneousOpenWindow)
+	SimultaneousOpenWindow = 0
+
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	var ct *circuitTransport
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		ct = newCircuitTransport(tpt)
+		return &delayedTransport{Transport: tpt, delay: 500 * time.Millisecond}
+	})
+	defer s.Close()
+	ct.proxied = true
+	if err := s.AddTransport(ct); err != nil {
+		t.Fatal(err)
+	}
+	ct.peers[target.LocalPeer()] = target
+	directAddr := target.ListenAddresses()[0]
+	s.Peerstore().AddAddr(target.LocalPeer(), directAddr, pstore.PermanentAddrTTL)
+
+	trace := s.StartDialTrace(target.LocalPeer())
+	defer trace.Stop()
+	events, cancel := s.SubscribeDials()
+	defer cancel()
+
+	errch := make(chan error, 1)
+	go func() {
+		_, err := s.DialPeer(ctx, target.LocalPeer())
+		errch <- err
+	}()
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("direct dial never started")
+	}
+
+	// a relayed dial while the direct one is running.
+	if _, err := s.DialPeerViaRelay(ctx, target.LocalPeer(), testutil.RandPeerIDFatal(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+
+	dials := trace.Dials()
+	if len(dials) != 2 {
+		t.Fatalf("expected two traced dials, got %d", len(dials))
+	}
+	direct, relayed := dials[0], dials[1]
+	if len(direct.Attempts) != 1 || !direct.Attempts[0].Addr.Equal(directAddr) || direct.Err != nil {
+		t.Fatalf("unexpected direct dial: %+v", direct)
+	}
+	if len(relayed.Attempts) != 1 || !relayed.Attempts[0].Addr.Equal(relayed.Addrs[0]) || relayed.Err != nil {
+		t.Fatalf("unexpected relayed dial: %+v", relayed)
+	}
+	if !relayed.End.Before(direct.End) {
+		t.Fatal("expected the relayed dial to finish first")
+	}
+}
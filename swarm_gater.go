@@ -0,0 +1,55 @@
+package swarm
+
+import (
+	"errors"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ErrGaterDisallowedConnection is returned when the swarm's ConnGater
+// rejects a connection.
+var ErrGaterDisallowedConnection = errors.New("gater disallows connection to peer")
+
+// ConnGater can veto connections at various points of their setup. Each method
+// returns false to reject the connection.
+type ConnGater interface {
+	// InterceptAddrDial is called before dialing address addr of peer p.
+	InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool
+
+	// InterceptAccept is called when a listener accepts a connection from
+	// the remote address addr.
+	InterceptAccept(addr ma.Multiaddr) bool
+
+	// InterceptSecured is called once we know which peer an inbound or
+	// outbound connection is to, before it's added to the swarm.
+	InterceptSecured(dir inet.Direction, p peer.ID, addrs inet.ConnMultiaddrs) bool
+}
+
+// SetConnGater sets the ConnGater consulted on inbound and outbound
+// connections. A nil gater (the default) allows all connections.
+func (s *Swarm) SetConnGater(g ConnGater) {
+	s.gater = g
+}
+
+// SetPostSecureHook sets a function that's called on every new inbound and
+// outbound connection once the remote peer is known, before the connection is
+// added to the swarm. If the hook returns an error, the connection is closed
+// and the error is returned to the dialer.
+//
+// The connection isn't usable yet when the hook runs so it must not open
+// streams on it.
+func (s *Swarm) SetPostSecureHook(hook func(*Conn) error) {
+	s.postSecureHook = hook
+}
+
+// SetObservedAddrHook sets a function that's called on every new inbound and
+// outbound connection, after the post-secure hook, to derive an address for
+// the remote peer (e.g., its remote multiaddr normalized or rewritten). A
+// non-nil result is added to the peerstore with RecentlyConnectedAddrTTL.
+//
+// As with the post-secure hook, the connection isn't usable yet.
+func (s *Swarm) SetObservedAddrHook(hook func(*Conn) ma.Multiaddr) {
+	s.observedAddr = hook
+}
@@ -0,0 +1,174 @@
+package swarm_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+// testGater rejects the given peers and addresses.
+type testGater struct {
+	peers map[peer.ID]bool
+	addrs map[string]bool
+}
+
+func newTestGater() *testGater {
+	return &testGater{peers: make(map[peer.ID]bool), addrs: make(map[string]bool)}
+}
+
+func (g *testGater) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool {
+	return !g.addrs[addr.String()]
+}
+
+func (g *testGater) InterceptAccept(addr ma.Multiaddr) bool {
+	ip, _ := addr.ValueForProtocol(ma.P_IP4)
+	return !g.addrs[ip]
+}
+
+func (g *testGater) InterceptSecured(dir inet.Direction, p peer.ID, addrs inet.ConnMultiaddrs) bool {
+	return !g.peers[p]
+}
+
+func TestConnGaterOutbound(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s1, s2, s3 := swarms[0], swarms[1], swarms[2]
+
+	g := newTestGater()
+	g.addrs[s2.ListenAddresses()[0].String()] = true
+	g.peers[s3.LocalPeer()] = true
+	s1.SetConnGater(g)
+
+	for _, s := range []*Swarm{s2, s3} {
+		s1.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), pstore.PermanentAddrTTL)
+		if _, err := s1.DialPeer(ctx, s.LocalPeer()); err == nil {
+			t.Fatalf("dial to %s should have been rejected", s.LocalPeer())
+		}
+		if len(s1.ConnsToPeer(s.LocalPeer())) != 0 {
+			t.Fatalf("shouldn't have a connection to %s", s.LocalPeer())
+		}
+	}
+}
+
+func TestConnGaterInbound(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s1, s2, s3 := swarms[0], swarms[1], swarms[2]
+
+	// s2 rejects s1 once it knows who it is, s3 rejects everything from
+	// 127.0.0.1 right away.
+	g2 := newTestGater()
+	g2.peers[s1.LocalPeer()] = true
+	s2.SetConnGater(g2)
+	g3 := newTestGater()
+	g3.addrs["127.0.0.1"] = true
+	s3.SetConnGater(g3)
+
+	for _, s := range []*Swarm{s2, s3} {
+		s1.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), pstore.PermanentAddrTTL)
+		s1.DialPeer(ctx, s.LocalPeer())
+
+		deadline := time.Now().Add(5 * time.Second)
+		for s1.Connectedness(s.LocalPeer()) == inet.Connected {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s should have closed our connection", s.LocalPeer())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(s.Conns()) != 0 {
+			t.Fatalf("%s shouldn't have accepted our connection", s.LocalPeer())
+		}
+	}
+}
+
+func TestPostSecureHook(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s1, s2, s3 := swarms[0], swarms[1], swarms[2]
+
+	errRejected := errors.New("rejected")
+	s1.SetPostSecureHook(func(c *Conn) error {
+		if c.RemotePeer() == s2.LocalPeer() {
+			return errRejected
+		}
+		return nil
+	})
+
+	// outbound
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err == nil {
+		t.Fatal("dial to s2 should have been rejected")
+	}
+	if len(s1.ConnsToPeer(s2.LocalPeer())) != 0 {
+		t.Fatal("shouldn't have a connection to s2")
+	}
+	s1.Peerstore().AddAddrs(s3.LocalPeer(), s3.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, s3.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	// inbound
+	s2.Peerstore().AddAddrs(s1.LocalPeer(), s1.ListenAddresses(), pstore.PermanentAddrTTL)
+	s2.DialPeer(ctx, s1.LocalPeer())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s2.Connectedness(s1.LocalPeer()) == inet.Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("s1 should have closed the connection from s2")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(s1.ConnsToPeer(s2.LocalPeer())) != 0 {
+		t.Fatal("s1 shouldn't have accepted the connection from s2")
+	}
+}
+
+func TestObservedAddrHook(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	observed := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	s2.SetObservedAddrHook(func(c *Conn) ma.Multiaddr {
+		return observed
+	})
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the inbound connection is added asynchronously.
+	for i := 0; ; i++ {
+		found := false
+		for _, a := range s2.Peerstore().Addrs(s1.LocalPeer()) {
+			found = found || a.Equal(observed)
+		}
+		if found {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected %s in the peerstore, got %s", observed, s2.Peerstore().Addrs(s1.LocalPeer()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the dialer didn't set a hook.
+	for _, a := range s1.Peerstore().Addrs(s2.LocalPeer()) {
+		if a.Equal(observed) {
+			t.Fatalf("didn't expect %s in the dialer's peerstore", observed)
+		}
+	}
+}
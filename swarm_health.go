@@ -0,0 +1,90 @@
+package swarm
+
+import (
+	"sort"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// LimiterStats is a snapshot of the dial limiter's usage. Queued dials may
+// include dials that have been canceled but not yet dropped.
+type LimiterStats struct {
+	// FdDials is the number of running dials that consume a file
+	// descriptor, out of FdLimit.
+	FdDials int
+	FdLimit int
+	// WaitingOnFd is the number of dials waiting for a file descriptor.
+	WaitingOnFd int
+
+	// NonFdDials is the number of running dials that don't consume a file
+	// descriptor, out of NonFdLimit.
+	NonFdDials int
+	NonFdLimit int
+	// WaitingOnNonFd is the number of such dials waiting for their turn.
+	WaitingOnNonFd int
+
+	// WaitingOnPeerLimit is the number of dials waiting for other dials to
+	// the same peer to finish.
+	WaitingOnPeerLimit int
+}
+
+// Saturated returns true if new dials would have to wait for running dials
+// to finish.
+func (ls LimiterStats) Saturated() bool {
+	return ls.FdDials >= ls.FdLimit || ls.NonFdDials >= ls.NonFdLimit
+}
+
+// HealthReport is a snapshot of the swarm's state, see Swarm.HealthCheck.
+type HealthReport struct {
+	// Closed is set once the swarm has been closed.
+	Closed bool
+
+	// ListenAddrs are the addresses the swarm is listening on, as
+	// returned by InterfaceListenAddresses. ListenErr is set if they
+	// couldn't be determined.
+	ListenAddrs []ma.Multiaddr
+	ListenErr   error
+
+	// Transports are the names of the registered transports (e.g., "tcp").
+	Transports []string
+
+	// Conns is the number of open connections and Peers the number of
+	// peers they're to.
+	Conns int
+	Peers int
+
+	Limiter LimiterStats
+}
+
+// HealthCheck reports whether the swarm is listening, which transports it has
+// and how busy it is. It only reads the swarm's state so it's cheap enough to
+// serve a health check endpoint.
+func (s *Swarm) HealthCheck() HealthReport {
+	var r HealthReport
+
+	s.listeners.RLock()
+	r.Closed = s.listeners.m == nil
+	s.listeners.RUnlock()
+	r.ListenAddrs, r.ListenErr = s.InterfaceListenAddresses()
+
+	s.transports.RLock()
+	names := make(map[string]struct{}, len(s.transports.m))
+	for _, t := range s.transports.m {
+		names[transportName(t)] = struct{}{}
+	}
+	s.transports.RUnlock()
+	for name := range names {
+		r.Transports = append(r.Transports, name)
+	}
+	sort.Strings(r.Transports)
+
+	s.conns.RLock()
+	r.Peers = len(s.conns.m)
+	for _, cs := range s.conns.m {
+		r.Conns += len(cs)
+	}
+	s.conns.RUnlock()
+
+	r.Limiter = s.limiter.stats()
+	return r
+}
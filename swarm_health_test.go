@@ -0,0 +1,52 @@
+package swarm_test
+
+import (
+	"context"
+	"testing"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+func TestHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s1 := swarms[0]
+
+	for _, s := range swarms[1:] {
+		s1.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), pstore.PermanentAddrTTL)
+		if _, err := s1.DialPeer(ctx, s.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := s1.HealthCheck()
+	if r.Closed {
+		t.Fatal("swarm shouldn't be closed")
+	}
+	if r.ListenErr != nil {
+		t.Fatal(r.ListenErr)
+	}
+	listenAddr := s1.ListenAddresses()[0]
+	found := false
+	for _, a := range r.ListenAddrs {
+		found = found || a.Equal(listenAddr)
+	}
+	if !found {
+		t.Fatalf("expected %s in the listen addresses, got %s", listenAddr, r.ListenAddrs)
+	}
+	if len(r.Transports) != 1 || r.Transports[0] != "tcp" {
+		t.Fatalf("expected the tcp transport, got %s", r.Transports)
+	}
+	if r.Conns != 2 || r.Peers != 2 {
+		t.Fatalf("expected 2 connections to 2 peers, got %d to %d", r.Conns, r.Peers)
+	}
+	if r.Limiter.Saturated() || r.Limiter.FdDials != 0 {
+		t.Fatalf("dial limiter should be idle: %+v", r.Limiter)
+	}
+
+	s1.Close()
+	if r := s1.HealthCheck(); !r.Closed || r.Conns != 0 {
+		t.Fatalf("expected a closed swarm without connections, got %+v", r)
+	}
+}
@@ -0,0 +1,119 @@
+package swarm
+
+import (
+	"sync"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// InboundConnLimit limits how fast the swarm accepts inbound connections from
+// a single remote IP address. Each IP may open Burst connections at once and
+// then Rate more connections per Interval.
+type InboundConnLimit struct {
+	Rate     int
+	Interval time.Duration
+	Burst    int
+}
+
+// SetInboundConnLimit sets the per-IP inbound connection limit. Inbound
+// connections over the limit are closed as soon as they're accepted. The zero
+// value disables the limit (the default).
+func (s *Swarm) SetInboundConnLimit(limit InboundConnLimit) {
+	s.inbound.Lock()
+	defer s.inbound.Unlock()
+	s.inbound.limit = limit
+	s.inbound.buckets = make(map[string]*connBucket)
+}
+
+// connBucket is a token bucket counting inbound connections from one IP.
+type connBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type inboundLimiter struct {
+	sync.Mutex
+	limit     InboundConnLimit
+	buckets   map[string]*connBucket
+	lastPrune time.Time
+}
+
+func (il *inboundLimiter) enabled() bool {
+	return il.limit.Rate > 0 && il.limit.Interval > 0
+}
+
+func (il *inboundLimiter) burst() float64 {
+	if il.limit.Burst > 0 {
+		return float64(il.limit.Burst)
+	}
+	return float64(il.limit.Rate)
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (il *inboundLimiter) refill(b *connBucket, now time.Time) {
+	rate := float64(il.limit.Rate) / float64(il.limit.Interval)
+	b.tokens += float64(now.Sub(b.last)) * rate
+	if burst := il.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// allow returns true if we should accept an inbound connection from the given
+// remote address.
+func (il *inboundLimiter) allow(raddr ma.Multiaddr) bool {
+	il.Lock()
+	defer il.Unlock()
+
+	if !il.enabled() {
+		return true
+	}
+
+	ip := remoteIP(raddr)
+	if ip == "" {
+		return true
+	}
+
+	now := time.Now()
+	il.prune(now)
+
+	b, ok := il.buckets[ip]
+	if !ok {
+		b = &connBucket{tokens: il.burst(), last: now}
+		il.buckets[ip] = b
+	}
+	il.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets IPs whose buckets have filled up again. It runs at most once
+// per interval.
+func (il *inboundLimiter) prune(now time.Time) {
+	if now.Sub(il.lastPrune) < il.limit.Interval {
+		return
+	}
+	il.lastPrune = now
+	for ip, b := range il.buckets {
+		il.refill(b, now)
+		if b.tokens >= il.burst() {
+			delete(il.buckets, ip)
+		}
+	}
+}
+
+// remoteIP returns the IP address of the given multiaddr, or "" if it
+// doesn't have one.
+func remoteIP(a ma.Multiaddr) string {
+	if ip, err := a.ValueForProtocol(ma.P_IP4); err == nil {
+		return ip
+	}
+	if ip, err := a.ValueForProtocol(ma.P_IP6); err == nil {
+		return ip
+	}
+	return ""
+}
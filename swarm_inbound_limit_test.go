@@ -0,0 +1,57 @@
+package swarm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+func TestInboundConnLimit(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 4)
+	defer closeSwarms(swarms)
+	target, dialers := swarms[0], swarms[1:]
+
+	target.SetInboundConnLimit(InboundConnLimit{Rate: 1, Interval: time.Hour, Burst: 2})
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// all dialers connect from the same IP.
+	for i, d := range dialers {
+		d.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+		if _, err := d.DialPeer(ctx, target.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 {
+			waitFor("inbound conn", func() bool {
+				return target.Connectedness(d.LocalPeer()) == inet.Connected
+			})
+		}
+	}
+
+	// the third connection exceeds the burst and gets closed.
+	last := dialers[2]
+	waitFor("excess conn to close", func() bool {
+		return last.Connectedness(target.LocalPeer()) != inet.Connected
+	})
+	if n := len(target.Conns()); n != 2 {
+		t.Fatalf("expected 2 inbound conns, got %d", n)
+	}
+	if target.Connectedness(last.LocalPeer()) == inet.Connected {
+		t.Fatal("target shouldn't have kept the excess conn")
+	}
+}
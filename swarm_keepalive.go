@@ -0,0 +1,104 @@
+package swarm
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultKeepaliveFailures is the number of consecutive failed pings after
+// which a connection is closed if ConnKeepalive.MaxFailures isn't set.
+const DefaultKeepaliveFailures = 3
+
+var errPingTimeout = errors.New("ping timed out")
+
+// ConnKeepalive configures periodic pings used to detect dead connections.
+type ConnKeepalive struct {
+	// Interval is the time between two pings. 0 disables keepalives.
+	Interval time.Duration
+	// MaxFailures is the number of consecutive failed pings after which
+	// the connection is closed.
+	MaxFailures int
+}
+
+// pinger is implemented by transport connections that can ping the remote
+// side themselves (e.g., yamux sessions).
+type pinger interface {
+	Ping() (time.Duration, error)
+}
+
+// SetConnKeepalive enables keepalives on connections opened after this call.
+//
+// Every ka.Interval, the swarm pings each connection: using the muxer's ping
+// if it has one or by opening (and resetting) a stream otherwise. After
+// ka.MaxFailures consecutive failures, the connection is closed.
+func (s *Swarm) SetConnKeepalive(ka ConnKeepalive) {
+	if ka.MaxFailures <= 0 {
+		ka.MaxFailures = DefaultKeepaliveFailures
+	}
+	s.keepalive.Lock()
+	defer s.keepalive.Unlock()
+	s.keepalive.cfg = ka
+}
+
+func (s *Swarm) connKeepalive() ConnKeepalive {
+	s.keepalive.RLock()
+	defer s.keepalive.RUnlock()
+	return s.keepalive.cfg
+}
+
+// keepalive pings the connection until it closes, closing it once ka.MaxFailures
+// pings in a row have failed.
+func (c *Conn) keepalive(ka ConnKeepalive) {
+	closed := make(chan struct{})
+	c.OnClose(func() { close(closed) })
+
+	ticker := time.NewTicker(ka.Interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+
+		if err := c.ping(ka.Interval); err != nil {
+			failures++
+			log.Debugf("keepalive ping %d/%d to %s failed: %s", failures, ka.MaxFailures, c.RemotePeer(), err)
+			if failures >= ka.MaxFailures {
+				log.Infof("closing dead connection %s", c)
+				c.Close()
+				return
+			}
+			continue
+		}
+		failures = 0
+	}
+}
+
+// ping checks that the connection is still alive, giving up after timeout.
+func (c *Conn) ping(timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if p, ok := c.conn.(pinger); ok {
+			_, err := p.Ping()
+			errCh <- err
+			return
+		}
+		s, err := c.conn.OpenStream()
+		if err == nil {
+			s.Reset()
+		}
+		errCh <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		return errPingTimeout
+	}
+}
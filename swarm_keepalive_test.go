@@ -0,0 +1,92 @@
+package swarm_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	transport "github.com/libp2p/go-libp2p-transport"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+// deadConn is a transport connection that never answers pings.
+type deadConn struct {
+	transport.Conn
+
+	lk    sync.Mutex
+	pings int
+}
+
+func (dc *deadConn) Ping() (time.Duration, error) {
+	dc.lk.Lock()
+	defer dc.lk.Unlock()
+	dc.pings++
+	return 0, errors.New("dead")
+}
+
+// deadTransport wraps every connection it dials in a deadConn.
+type deadTransport struct {
+	transport.Transport
+	conns chan *deadConn
+}
+
+func (dt *deadTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	c, err := dt.Transport.Dial(ctx, raddr, p)
+	if err != nil {
+		return nil, err
+	}
+	dc := &deadConn{Conn: c}
+	dt.conns <- dc
+	return dc, nil
+}
+
+func TestConnKeepalive(t *testing.T) {
+	const maxFailures = 3
+
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	dt := &deadTransport{conns: make(chan *deadConn, 1)}
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		dt.Transport = tpt
+		return dt
+	})
+	defer s.Close()
+	s.SetConnKeepalive(ConnKeepalive{Interval: 20 * time.Millisecond, MaxFailures: maxFailures})
+
+	cn := newConnNotifiee(1)
+	s.AddNotifiee(cn)
+
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+	c, err := s.DialPeer(ctx, target.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := <-dt.conns
+
+	select {
+	case dead := <-cn.disconnected:
+		if dead != c {
+			t.Fatal("wrong conn disconnected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the dead conn to be closed")
+	}
+
+	dc.lk.Lock()
+	pings := dc.pings
+	dc.lk.Unlock()
+	if pings != maxFailures {
+		t.Fatalf("expected the conn to be closed after %d pings, got %d", maxFailures, pings)
+	}
+	if len(s.ConnsToPeer(target.LocalPeer())) != 0 {
+		t.Fatal("expected the dead conn to be removed")
+	}
+}
@@ -0,0 +1,265 @@
+package swarm
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ErrTooManyStreams is returned when opening a stream would exceed the
+// configured maximum number of streams per connection.
+var ErrTooManyStreams = errors.New("too many streams on connection")
+
+// ErrTooManyConns is returned when an inbound connection is rejected because
+// the swarm has reached its maximum number of connections and none of the
+// existing connections could be closed to make room.
+var ErrTooManyConns = errors.New("too many connections")
+
+// StreamLimitPolicy determines what Swarm.NewStream does when all connections
+// to a peer have reached the maximum number of streams per connection.
+type StreamLimitPolicy int
+
+const (
+	// StreamLimitFail makes NewStream fail with ErrTooManyStreams.
+	StreamLimitFail StreamLimitPolicy = iota
+	// StreamLimitNewConn makes NewStream open a new connection to the peer,
+	// unless that would exceed the maximum number of connections per peer.
+	StreamLimitNewConn
+	// StreamLimitBlock makes NewStream wait until a stream to the peer (or a
+	// connection) closes, or its context ends.
+	StreamLimitBlock
+)
+
+// SetMaxStreamsPerConn limits the number of outbound streams that may be open
+// on a single connection. Conn.NewStream fails with ErrTooManyStreams when
+// the limit is reached, Swarm.NewStream applies the given policy.
+//
+// A limit of 0 (the default) means no limit.
+func (s *Swarm) SetMaxStreamsPerConn(limit int, policy StreamLimitPolicy) {
+	s.streamLimits.Lock()
+	defer s.streamLimits.Unlock()
+	s.streamLimits.maxStreamsPerConn = limit
+	s.streamLimits.policy = policy
+}
+
+// SetMaxConnsPerPeer limits the number of connections the StreamLimitNewConn
+// policy may open to a single peer.
+//
+// A limit of 0 (the default) means no limit.
+func (s *Swarm) SetMaxConnsPerPeer(limit int) {
+	s.streamLimits.Lock()
+	defer s.streamLimits.Unlock()
+	s.streamLimits.maxConnsPerPeer = limit
+}
+
+// maxStreamsPerConn returns the configured maximum number of outbound streams
+// per connection (0 if unlimited).
+func (s *Swarm) maxStreamsPerConn() int {
+	s.streamLimits.RLock()
+	defer s.streamLimits.RUnlock()
+	return s.streamLimits.maxStreamsPerConn
+}
+
+// streamLimitPolicy returns the configured stream limit policy.
+func (s *Swarm) streamLimitPolicy() StreamLimitPolicy {
+	s.streamLimits.RLock()
+	defer s.streamLimits.RUnlock()
+	return s.streamLimits.policy
+}
+
+// streamFreed returns a channel that's closed the next time an outbound
+// stream or a connection closes (see notifyStreamFreed).
+func (s *Swarm) streamFreed() <-chan struct{} {
+	s.streamFrees.Lock()
+	defer s.streamFrees.Unlock()
+	if s.streamFrees.ch == nil {
+		s.streamFrees.ch = make(chan struct{})
+	}
+	return s.streamFrees.ch
+}
+
+// notifyStreamFreed wakes up the NewStream calls waiting for room on a
+// connection (see StreamLimitBlock).
+func (s *Swarm) notifyStreamFreed() {
+	s.streamFrees.Lock()
+	defer s.streamFrees.Unlock()
+	if s.streamFrees.ch != nil {
+		close(s.streamFrees.ch)
+		s.streamFrees.ch = nil
+	}
+}
+
+// canOpenConnForStreams returns true if the stream limit policy allows us to
+// open another connection to a peer we already have conns connections to.
+func (s *Swarm) canOpenConnForStreams(conns int) bool {
+	s.streamLimits.RLock()
+	defer s.streamLimits.RUnlock()
+	if s.streamLimits.policy != StreamLimitNewConn {
+		return false
+	}
+	return s.streamLimits.maxConnsPerPeer <= 0 || conns < s.streamLimits.maxConnsPerPeer
+}
+
+// streamsFull returns true if the given number of streams reaches the
+// configured limit.
+func streamsFull(streams, limit int) bool {
+	return limit > 0 && streams >= limit
+}
+
+// SetMaxConcurrentStreamOpens limits the number of outbound streams being
+// opened at the same time across all connections. Once the limit is reached,
+// opening a stream waits for another open to complete (or the context passed
+// to Swarm.NewStream or Conn.NewStreamTimeout to expire).
+//
+// A limit of 0 (the default) means no limit. Opens already waiting keep
+// waiting on the previous limit.
+func (s *Swarm) SetMaxConcurrentStreamOpens(limit int) {
+	var sem chan struct{}
+	if limit > 0 {
+		sem = make(chan struct{}, limit)
+	}
+	s.streamOpens.Lock()
+	defer s.streamOpens.Unlock()
+	s.streamOpens.sem = sem
+}
+
+// acquireStreamOpen waits for a slot to open a stream (see
+// SetMaxConcurrentStreamOpens). The returned function releases it.
+func (s *Swarm) acquireStreamOpen(ctx context.Context) (func(), error) {
+	s.streamOpens.RLock()
+	sem := s.streamOpens.sem
+	s.streamOpens.RUnlock()
+	if sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ConnScorer rates how valuable a connection is. When the swarm has too many
+// connections (see SetMaxConns), the lowest scoring ones are closed first.
+type ConnScorer func(c *Conn) float64
+
+// DefaultConnScorer scores connections by their number of open streams.
+func DefaultConnScorer(c *Conn) float64 {
+	return float64(len(c.GetStreams()))
+}
+
+// SetMaxConns limits the total number of connections. When a new connection
+// would exceed the limit, the lowest scoring connections to peers that aren't
+// protected (see Protect) are closed to make room. If that's not enough, new
+// inbound connections are rejected with ErrTooManyConns. Outbound ones are
+// kept as we asked for them.
+//
+// A limit of 0 (the default) means no limit. A nil score uses
+// DefaultConnScorer.
+func (s *Swarm) SetMaxConns(limit int, score ConnScorer) {
+	if score == nil {
+		score = DefaultConnScorer
+	}
+	s.connLimit.Lock()
+	defer s.connLimit.Unlock()
+	s.connLimit.maxConns = limit
+	s.connLimit.score = score
+}
+
+// Protect prevents connections to peer p from being closed to stay within
+// the maximum number of connections (see SetMaxConns).
+func (s *Swarm) Protect(p peer.ID) {
+	s.connLimit.Lock()
+	defer s.connLimit.Unlock()
+	if s.connLimit.protected == nil {
+		s.connLimit.protected = make(map[peer.ID]struct{})
+	}
+	s.connLimit.protected[p] = struct{}{}
+}
+
+// Unprotect undoes Protect.
+func (s *Swarm) Unprotect(p peer.ID) {
+	s.connLimit.Lock()
+	defer s.connLimit.Unlock()
+	delete(s.connLimit.protected, p)
+}
+
+// isProtected returns true if p is protected (see Protect).
+func (s *Swarm) isProtected(p peer.ID) bool {
+	s.connLimit.RLock()
+	defer s.connLimit.RUnlock()
+	_, ok := s.connLimit.protected[p]
+	return ok
+}
+
+// overConnLimitLocked returns true if adding a connection while closing
+// closing others would exceed the maximum number of connections. s.conns must
+// be locked.
+func (s *Swarm) overConnLimitLocked(closing int) bool {
+	s.connLimit.RLock()
+	max := s.connLimit.maxConns
+	s.connLimit.RUnlock()
+	if max <= 0 {
+		return false
+	}
+	n := 1 - closing
+	for _, cs := range s.conns.m {
+		n += len(cs)
+	}
+	return n > max
+}
+
+// makeRoomForConn closes connections until we can add a new one without
+// exceeding the maximum number of connections. It returns false if the new
+// connection should be rejected.
+func (s *Swarm) makeRoomForConn(dir inet.Direction) bool {
+	s.connLimit.RLock()
+	max, score := s.connLimit.maxConns, s.connLimit.score
+	s.connLimit.RUnlock()
+	if max <= 0 {
+		return true
+	}
+
+	conns := s.Conns()
+	excess := len(conns) + 1 - max
+	if excess <= 0 {
+		return true
+	}
+
+	type candidate struct {
+		c     *Conn
+		score float64
+	}
+	candidates := make([]candidate, 0, len(conns))
+	s.connLimit.RLock()
+	for _, ic := range conns {
+		c := ic.(*Conn)
+		if _, ok := s.connLimit.protected[c.RemotePeer()]; !ok {
+			candidates = append(candidates, candidate{c: c})
+		}
+	}
+	s.connLimit.RUnlock()
+
+	// We'd reject the inbound connection anyway, don't close any.
+	if excess > len(candidates) && dir == inet.DirInbound {
+		return false
+	}
+
+	// Don't score with the lock held, the scorer may call back into the
+	// swarm.
+	for i := range candidates {
+		candidates[i].score = score(candidates[i].c)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score < candidates[j].score
+	})
+	for i := 0; i < excess && i < len(candidates); i++ {
+		log.Debugf("closing connection to %s to stay within the connection limit", candidates[i].c.RemotePeer())
+		candidates[i].c.Close()
+	}
+	return true
+}
@@ -0,0 +1,251 @@
+package swarm_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+func TestMaxStreamsPerConnFail(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s1.SetMaxStreamsPerConn(2, StreamLimitFail)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	st1, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.NewStream(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.NewStream(ctx, s2.LocalPeer()); err != ErrTooManyStreams {
+		t.Fatal("expected ErrTooManyStreams, got:", err)
+	}
+	if _, err := st1.Conn().NewStream(); err != ErrTooManyStreams {
+		t.Fatal("expected ErrTooManyStreams from the conn, got:", err)
+	}
+	if n := len(s1.ConnsToPeer(s2.LocalPeer())); n != 1 {
+		t.Fatalf("shouldn't have opened another connection, have %d", n)
+	}
+
+	// Freeing up a stream should make room for another one.
+	st1.Reset()
+	if _, err := s1.NewStream(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxStreamsPerConnBlock(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s1.SetMaxStreamsPerConn(1, StreamLimitBlock)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	st1, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Waits until the context ends.
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := s1.NewStream(tctx, s2.LocalPeer()); err != context.DeadlineExceeded {
+		t.Fatal("expected the context deadline to be exceeded, got:", err)
+	}
+
+	// Or until a stream closes.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s1.NewStream(ctx, s2.LocalPeer())
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		t.Fatal("NewStream should have waited for a stream to close, got:", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	st1.Reset()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewStream didn't return once a stream closed")
+	}
+	if n := len(s1.ConnsToPeer(s2.LocalPeer())); n != 1 {
+		t.Fatalf("shouldn't have opened another connection, have %d", n)
+	}
+}
+
+func TestMaxStreamsPerConnIgnoresInbound(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	inbound := make(chan inet.Stream, 2)
+	s1.SetStreamHandler(func(s inet.Stream) {
+		inbound <- s
+	})
+	s1.SetMaxStreamsPerConn(1, StreamLimitFail)
+	s2.Peerstore().AddAddrs(s1.LocalPeer(), s1.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	// the remote side opens streams to us.
+	for i := 0; i < 2; i++ {
+		st, err := s2.NewStream(ctx, s1.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		// the stream is only announced once we write.
+		if _, err := st.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-inbound:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an inbound stream")
+		}
+	}
+
+	if _, err := s1.NewStream(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal("inbound streams shouldn't count against the outbound stream limit:", err)
+	}
+	if _, err := s1.NewStream(ctx, s2.LocalPeer()); err != ErrTooManyStreams {
+		t.Fatal("expected ErrTooManyStreams, got:", err)
+	}
+}
+
+func TestMaxStreamsPerConnNewConn(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s1.SetMaxStreamsPerConn(1, StreamLimitNewConn)
+	s1.SetMaxConnsPerPeer(2)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	st1, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st1.Conn() == st2.Conn() {
+		t.Fatal("expected the second stream to be opened on a new connection")
+	}
+	if n := len(s1.ConnsToPeer(s2.LocalPeer())); n != 2 {
+		t.Fatalf("expected 2 connections, have %d", n)
+	}
+
+	if _, err := s1.NewStream(ctx, s2.LocalPeer()); err != ErrTooManyStreams {
+		t.Fatal("expected ErrTooManyStreams once the connection limit is reached, got:", err)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 5)
+	defer closeSwarms(swarms)
+	s1 := swarms[0]
+
+	scores := map[peer.ID]float64{
+		swarms[1].LocalPeer(): 3,
+		swarms[2].LocalPeer(): 1,
+		swarms[3].LocalPeer(): 2,
+	}
+	s1.SetMaxConns(2, func(c *Conn) float64 {
+		return scores[c.RemotePeer()]
+	})
+
+	for _, s := range swarms[1:4] {
+		s1.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), pstore.PermanentAddrTTL)
+		if _, err := s1.DialPeer(ctx, s.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(s1.Conns()); n != 2 {
+		t.Fatalf("expected 2 connections, got %d", n)
+	}
+	if s1.Connectedness(swarms[2].LocalPeer()) == inet.Connected {
+		t.Fatal("expected the lowest scoring connection to be closed")
+	}
+
+	// with every connection protected, inbound connections are rejected.
+	s1.Protect(swarms[1].LocalPeer())
+	s1.Protect(swarms[3].LocalPeer())
+	s5 := swarms[4]
+	s5.Peerstore().AddAddrs(s1.LocalPeer(), s1.ListenAddresses(), pstore.PermanentAddrTTL)
+	s5.DialPeer(ctx, s1.LocalPeer())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s5.Connectedness(s1.LocalPeer()) == inet.Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("s1 should have rejected the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, s := range []*Swarm{swarms[1], swarms[3]} {
+		if s1.Connectedness(s.LocalPeer()) != inet.Connected {
+			t.Fatalf("protected connection to %s was closed", s.LocalPeer())
+		}
+	}
+
+	// if closing the unprotected connections isn't enough, they're kept.
+	s1.Unprotect(swarms[3].LocalPeer())
+	s1.SetMaxConns(1, func(c *Conn) float64 {
+		return scores[c.RemotePeer()]
+	})
+	s5.DialPeer(ctx, s1.LocalPeer())
+	deadline = time.Now().Add(5 * time.Second)
+	for s5.Connectedness(s1.LocalPeer()) == inet.Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("s1 should have rejected the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s1.Connectedness(swarms[3].LocalPeer()) != inet.Connected {
+		t.Fatal("closed a connection for an inbound connection that was rejected anyway")
+	}
+}
+
+func TestMaxConnsConcurrentInbound(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 9)
+	defer closeSwarms(swarms)
+	s1 := swarms[0]
+	s1.SetMaxConns(2, nil)
+
+	var wg sync.WaitGroup
+	for _, s := range swarms[1:] {
+		s.Peerstore().AddAddrs(s1.LocalPeer(), s1.ListenAddresses(), pstore.PermanentAddrTTL)
+		wg.Add(1)
+		go func(s *Swarm) {
+			defer wg.Done()
+			s.DialPeer(ctx, s1.LocalPeer())
+		}(s)
+	}
+	wg.Wait()
+
+	if n := len(s1.Conns()); n > 2 {
+		t.Fatalf("expected at most 2 connections, got %d", n)
+	}
+}
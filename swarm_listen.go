@@ -2,7 +2,9 @@ package swarm
 
 import (
 	"fmt"
+	"time"
 
+	logging "github.com/ipfs/go-log"
 	inet "github.com/libp2p/go-libp2p-net"
 	ma "github.com/multiformats/go-multiaddr"
 )
@@ -41,7 +43,7 @@ func (s *Swarm) AddListenAddr(a ma.Multiaddr) error {
 		return ErrNoTransport
 	}
 
-	list, err := tpt.Listen(a)
+	list, err := s.transportListen(tpt, a)
 	if err != nil {
 		return err
 	}
@@ -54,6 +56,7 @@ func (s *Swarm) AddListenAddr(a ma.Multiaddr) error {
 	}
 	s.refs.Add(1)
 	s.listeners.m[list] = struct{}{}
+	s.listeners.cacheEOL = time.Time{}
 	s.listeners.Unlock()
 
 	maddr := list.Multiaddr()
@@ -68,6 +71,7 @@ func (s *Swarm) AddListenAddr(a ma.Multiaddr) error {
 			list.Close()
 			s.listeners.Lock()
 			delete(s.listeners.m, list)
+			s.listeners.cacheEOL = time.Time{}
 			s.listeners.Unlock()
 			s.refs.Done()
 		}()
@@ -80,10 +84,27 @@ func (s *Swarm) AddListenAddr(a ma.Multiaddr) error {
 				return
 			}
 			log.Debugf("swarm listener accepted connection: %s", c)
+			if s.isDraining() {
+				c.Close()
+				continue
+			}
+			if s.gater != nil && !s.gater.InterceptAccept(c.RemoteMultiaddr()) {
+				log.Debugf("gater rejected inbound connection from %s", c.RemoteMultiaddr())
+				c.Close()
+				continue
+			}
+			if !s.inbound.allow(c.RemoteMultiaddr()) {
+				log.Event(s.ctx, "swarmInboundConnRateLimited", logging.LoggableMap{
+					"peer": c.RemotePeer().Pretty(),
+					"addr": c.RemoteMultiaddr().String(),
+				})
+				c.Close()
+				continue
+			}
 			s.refs.Add(1)
 			go func() {
 				defer s.refs.Done()
-				_, err := s.addConn(c, inet.DirInbound)
+				_, err := s.addConn(c, inet.DirInbound, 0)
 				if err != nil {
 					// Probably just means that the swarm has been closed.
 					log.Warningf("add conn failed: ", err)
@@ -8,7 +8,7 @@ import (
 
 	inet "github.com/libp2p/go-libp2p-net"
 
-	. "github.com/libp2p/go-libp2p-swarm/testing"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 )
 
 // TestConnectednessCorrect starts a few networks, connects a few
@@ -19,13 +19,13 @@ func TestConnectednessCorrect(t *testing.T) {
 
 	nets := make([]inet.Network, 4)
 	for i := 0; i < 4; i++ {
-		nets[i] = GenSwarm(t, ctx)
+		nets[i] = swarmt.GenSwarm(t, ctx)
 	}
 
 	// connect 0-1, 0-2, 0-3, 1-2, 2-3
 
 	dial := func(a, b inet.Network) {
-		DivulgeAddresses(b, a)
+		swarmt.DivulgeAddresses(b, a)
 		if _, err := a.DialPeer(ctx, b.LocalPeer()); err != nil {
 			t.Fatalf("Failed to dial: %s", err)
 		}
@@ -71,7 +71,13 @@ func TestConnectednessCorrect(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 50)
 
-	expectConnectedness(t, nets[2], nets[1], inet.NotConnected)
+	// net 1 dialed net 2 so it still knows how to reach it.
+	if c := nets[1].Connectedness(nets[2].LocalPeer()); c != inet.CanConnect {
+		t.Errorf("expected net 1 to be able to reconnect to net 2, got %d", c)
+	}
+	if c := nets[2].Connectedness(nets[1].LocalPeer()); c != inet.NotConnected {
+		t.Errorf("expected net 2 not to be connected to net 1, got %d", c)
+	}
 
 	for _, n := range nets {
 		n.Close()
@@ -110,11 +116,11 @@ func TestNetworkOpenStream(t *testing.T) {
 
 	nets := make([]inet.Network, 4)
 	for i := 0; i < 4; i++ {
-		nets[i] = GenSwarm(t, ctx)
+		nets[i] = swarmt.GenSwarm(t, ctx)
 	}
 
 	dial := func(a, b inet.Network) {
-		DivulgeAddresses(b, a)
+		swarmt.DivulgeAddresses(b, a)
 		if _, err := a.DialPeer(ctx, b.LocalPeer()); err != nil {
 			t.Fatalf("Failed to dial: %s", err)
 		}
@@ -0,0 +1,173 @@
+package swarm
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	pnet "github.com/libp2p/go-libp2p-interface-pnet"
+	transport "github.com/libp2p/go-libp2p-transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+// Upgraded connections hide the net.Conn they're layered on behind the
+// security and muxer layers. The only layer of the upgrader seeing the raw
+// connection is the private network protector, so the swarm hooks into it
+// (see TrackUpgrader) and keeps the raw connections by their endpoints until
+// they close. Upgraded connections have the same endpoints, which is how the
+// swarm finds the net.Conn under them.
+
+// TrackUpgrader makes the swarm keep track of the net.Conns under the
+// connections u upgrades, so it can apply socket options (see
+// SetConnSocketOpts) and deadlines (see Conn.SetDeadline) to them. It wraps
+// u's Protector, if any.
+//
+// AddTransport does this for transports exposing their upgrader as an
+// Upgrader field, like the stock TCP transport. Call it for the others, e.g.
+// for transports wrapping such a transport.
+func (s *Swarm) TrackUpgrader(u *tptu.Upgrader) {
+	if tp, ok := u.Protector.(*trackingProtector); ok && tp.s == s {
+		return
+	}
+	u.Protector = &trackingProtector{s: s, inner: u.Protector}
+}
+
+// trackUpgraderOf calls TrackUpgrader on t's upgrader, if t exposes it as an
+// Upgrader field.
+func (s *Swarm) trackUpgraderOf(t transport.Transport) {
+	v := reflect.ValueOf(t)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	f := v.Elem().FieldByName("Upgrader")
+	if !f.IsValid() || !f.CanInterface() {
+		return
+	}
+	if u, ok := f.Interface().(*tptu.Upgrader); ok && u != nil {
+		s.TrackUpgrader(u)
+	}
+}
+
+// trackingProtector tracks the connections it protects before handing them
+// to the upgrader's protector, if any.
+type trackingProtector struct {
+	s     *Swarm
+	inner pnet.Protector
+}
+
+func (p *trackingProtector) Protect(c net.Conn) (net.Conn, error) {
+	if p.inner == nil && pnet.ForcePrivateNetwork {
+		// The upgrader only checks this when it has no protector.
+		return nil, pnet.ErrNotInPrivateNetwork
+	}
+	var tc net.Conn = c
+	if mc, ok := c.(manet.Conn); ok {
+		tc = p.s.trackConn(mc)
+	}
+	if p.inner == nil {
+		return tc, nil
+	}
+	pc, err := p.inner.Protect(tc)
+	if err != nil {
+		// The upgrader closes c, not tc.
+		if t, ok := tc.(*trackedConn); ok {
+			p.s.untrackConn(t)
+		}
+		return nil, err
+	}
+	return pc, nil
+}
+
+func (p *trackingProtector) Fingerprint() []byte {
+	if p.inner == nil {
+		return nil
+	}
+	return p.inner.Fingerprint()
+}
+
+// trackedConn is a raw connection tracked by the swarm until it closes. It
+// counts the bytes read from and written to it (see Conn.BandwidthStats).
+type trackedConn struct {
+	// Accessed atomically, keep them first so they're 64-bit aligned.
+	bytesIn, bytesOut uint64
+
+	manet.Conn
+	s   *Swarm
+	key string
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.s.untrackConn(c)
+	return c.Conn.Close()
+}
+
+// netConns are the raw connections tracked by the swarm, by endpoints.
+type netConns struct {
+	sync.Mutex
+	m map[string]*trackedConn
+}
+
+// endpointsKey returns the key of the connection between laddr and raddr.
+// Binary multiaddrs are self-delimiting, so the concatenation is unambiguous.
+func endpointsKey(laddr, raddr ma.Multiaddr) string {
+	return string(laddr.Bytes()) + string(raddr.Bytes())
+}
+
+func (s *Swarm) trackConn(c manet.Conn) *trackedConn {
+	tc := &trackedConn{
+		Conn: c,
+		s:    s,
+		key:  endpointsKey(c.LocalMultiaddr(), c.RemoteMultiaddr()),
+	}
+	s.netConns.Lock()
+	if s.netConns.m == nil {
+		s.netConns.m = make(map[string]*trackedConn)
+	}
+	s.netConns.m[tc.key] = tc
+	s.netConns.Unlock()
+	return tc
+}
+
+func (s *Swarm) untrackConn(tc *trackedConn) {
+	s.netConns.Lock()
+	if s.netConns.m[tc.key] == tc {
+		delete(s.netConns.m, tc.key)
+	}
+	s.netConns.Unlock()
+}
+
+// trackedConnFor returns the tracked raw connection under the transport
+// connection c, nil if there's none.
+func (s *Swarm) trackedConnFor(c transport.Conn) *trackedConn {
+	key := endpointsKey(c.LocalMultiaddr(), c.RemoteMultiaddr())
+	s.netConns.Lock()
+	defer s.netConns.Unlock()
+	return s.netConns.m[key]
+}
+
+// netConnOf returns the net.Conn under the transport connection c, nil if
+// the swarm can't reach it.
+func (s *Swarm) netConnOf(c transport.Conn) net.Conn {
+	if nc, ok := c.(NetConner); ok {
+		return nc.NetConn()
+	}
+	if tc := s.trackedConnFor(c); tc != nil {
+		return tc.Conn
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package swarm
+
+import (
+	"context"
+	"sync"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Notifiee is an interface for an object wishing to receive notifications
+// about the lifecycle of the swarm's connections.
+//
+// Unlike inet.Notifiee, it's handed the concrete swarm types so observers can
+// use swarm specific functionality (e.g., Conn.DialLatency) without type
+// assertions.
+type Notifiee interface {
+	Connected(*Swarm, *Conn)    // called when a connection opened
+	Disconnected(*Swarm, *Conn) // called when a connection closed
+}
+
+// StreamNotifiee is an optional interface a Notifiee may implement to also be
+// notified about the lifecycle of the swarm's streams.
+type StreamNotifiee interface {
+	OpenedStream(*Swarm, *Stream) // called when a stream opened
+	ClosedStream(*Swarm, *Stream) // called when a stream closed
+}
+
+// PeerNotifiee is an optional interface a Notifiee may implement to also be
+// notified when we're no longer connected to a peer at all.
+type PeerNotifiee interface {
+	// PeerDisconnected is called once the last connection to the peer
+	// closed, after that connection's Disconnected notification.
+	PeerDisconnected(*Swarm, peer.ID)
+}
+
+// AddNotifiee signs up a Notifiee to receive connection lifecycle events (and
+// stream lifecycle events if it implements StreamNotifiee).
+//
+// Note: Notify and StopNotify are reserved for inet.Notifiee as required by
+// the inet.Network interface.
+func (s *Swarm) AddNotifiee(n Notifiee) {
+	s.notifiees.Lock()
+	s.notifiees.m[n] = struct{}{}
+	s.notifiees.Unlock()
+}
+
+// RemoveNotifiee unregisters a Notifiee from receiving connection lifecycle
+// events.
+func (s *Swarm) RemoveNotifiee(n Notifiee) {
+	s.notifiees.Lock()
+	delete(s.notifiees.m, n)
+	s.notifiees.Unlock()
+}
+
+// notifyNotifiees sends a signal to all swarm Notifiees.
+//
+// The set of notifiees is copied before firing so that no swarm locks are held
+// while the callbacks run. This allows notifiees to call back into the swarm
+// (including (un)registering themselves).
+func (s *Swarm) notifyNotifiees(notify func(Notifiee)) {
+	s.notifiees.RLock()
+	notifiees := make([]Notifiee, 0, len(s.notifiees.m))
+	for n := range s.notifiees.m {
+		notifiees = append(notifiees, n)
+	}
+	s.notifiees.RUnlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(notifiees))
+	for _, n := range notifiees {
+		go func(n Notifiee) {
+			defer wg.Done()
+			notify(n)
+		}(n)
+	}
+	wg.Wait()
+}
+
+// notifyStreamNotifiees sends a signal to all swarm Notifiees implementing
+// StreamNotifiee.
+func (s *Swarm) notifyStreamNotifiees(notify func(StreamNotifiee)) {
+	s.notifyNotifiees(func(n Notifiee) {
+		if sn, ok := n.(StreamNotifiee); ok {
+			notify(sn)
+		}
+	})
+}
+
+// notifyPeerNotifiees sends a signal to all swarm Notifiees implementing
+// PeerNotifiee.
+func (s *Swarm) notifyPeerNotifiees(notify func(PeerNotifiee)) {
+	s.notifyNotifiees(func(n Notifiee) {
+		if pn, ok := n.(PeerNotifiee); ok {
+			notify(pn)
+		}
+	})
+}
+
+// connCounts counts connections per peer.
+type connCounts struct {
+	sync.Mutex
+	m map[peer.ID]int
+}
+
+func (cc *connCounts) add(p peer.ID) {
+	cc.Lock()
+	defer cc.Unlock()
+	if cc.m == nil {
+		cc.m = make(map[peer.ID]int)
+	}
+	cc.m[p]++
+}
+
+// remove returns true if it removed the last connection to p.
+func (cc *connCounts) remove(p peer.ID) bool {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.m[p]--
+	if cc.m[p] > 0 {
+		return false
+	}
+	delete(cc.m, p)
+	return true
+}
+
+// WaitForConnected blocks until we're connected to peer p, whether we dialed
+// it or it connected to us, or until ctx expires. Unlike DialPeer, it never
+// dials p itself.
+func (s *Swarm) WaitForConnected(ctx context.Context, p peer.ID) error {
+	w := &connWaiter{p: p, connected: make(chan struct{})}
+	s.AddNotifiee(w)
+	defer s.RemoveNotifiee(w)
+
+	// Check after registering so we don't miss a connection opened in
+	// between.
+	if s.Connectedness(p) == inet.Connected {
+		return nil
+	}
+
+	select {
+	case <-w.connected:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.ctx.Done():
+		return ErrSwarmClosed
+	}
+}
+
+// connWaiter is the Notifiee used by WaitForConnected.
+type connWaiter struct {
+	p         peer.ID
+	once      sync.Once
+	connected chan struct{}
+}
+
+func (w *connWaiter) Connected(_ *Swarm, c *Conn) {
+	if c.RemotePeer() == w.p {
+		w.once.Do(func() { close(w.connected) })
+	}
+}
+
+func (w *connWaiter) Disconnected(*Swarm, *Conn) {}
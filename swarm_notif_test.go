@@ -1,12 +1,14 @@
 package swarm_test
 
 import (
+	"io"
 	"testing"
 	"time"
 
 	"context"
 	inet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
 	ma "github.com/multiformats/go-multiaddr"
 
 	. "github.com/libp2p/go-libp2p-swarm"
@@ -211,3 +213,377 @@ func (nn *netNotifiee) OpenedStream(n inet.Network, v inet.Stream) {
 func (nn *netNotifiee) ClosedStream(n inet.Network, v inet.Stream) {
 	nn.closedStream <- v
 }
+
+type connNotifiee struct {
+	connected    chan *Conn
+	disconnected chan *Conn
+}
+
+func newConnNotifiee(buffer int) *connNotifiee {
+	return &connNotifiee{
+		connected:    make(chan *Conn, buffer),
+		disconnected: make(chan *Conn, buffer),
+	}
+}
+
+func (cn *connNotifiee) Connected(s *Swarm, c *Conn) {
+	cn.connected <- c
+}
+func (cn *connNotifiee) Disconnected(s *Swarm, c *Conn) {
+	cn.disconnected <- c
+}
+
+func TestSwarmNotifiees(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	n1 := newConnNotifiee(1)
+	n2 := newConnNotifiee(1)
+	s1.AddNotifiee(n1)
+	s1.AddNotifiee(n2)
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	c, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(ch chan *Conn) {
+		select {
+		case c2 := <-ch:
+			if c2 != c {
+				t.Fatal("got incorrect conn", c, c2)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	expect(n1.connected)
+	expect(n2.connected)
+
+	c.Close()
+
+	expect(n1.disconnected)
+	expect(n2.disconnected)
+
+	// unregistered notifiees shouldn't hear about new connections.
+	s1.RemoveNotifiee(n2)
+	c, err = s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(n1.connected)
+	select {
+	case <-n2.connected:
+		t.Fatal("removed notifiee should not have been notified")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type streamNotifiee struct {
+	*connNotifiee
+	opened chan *Stream
+	closed chan *Stream
+}
+
+func newStreamNotifiee(buffer int) *streamNotifiee {
+	return &streamNotifiee{
+		connNotifiee: newConnNotifiee(buffer),
+		opened:       make(chan *Stream, buffer),
+		closed:       make(chan *Stream, buffer),
+	}
+}
+
+func (sn *streamNotifiee) OpenedStream(s *Swarm, st *Stream) {
+	sn.opened <- st
+}
+func (sn *streamNotifiee) ClosedStream(s *Swarm, st *Stream) {
+	sn.closed <- st
+}
+
+func TestSwarmStreamNotifiees(t *testing.T) {
+	const streamCount = 5
+
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	// a notifiee without the stream hooks must keep working.
+	cn := newConnNotifiee(1)
+	s1.AddNotifiee(cn)
+	sn := newStreamNotifiee(streamCount)
+	s1.AddNotifiee(sn)
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	c, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams := make(map[inet.Stream]bool)
+	for i := 0; i < streamCount; i++ {
+		st, err := c.NewStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[st] = true
+	}
+	for st := range streams {
+		st.Reset()
+	}
+
+	count := func(ch chan *Stream) {
+		for i := 0; i < streamCount; i++ {
+			select {
+			case st := <-ch:
+				if !streams[st] {
+					t.Fatal("got notified about an unknown stream")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout, only got %d notifications", i)
+			}
+		}
+		select {
+		case <-ch:
+			t.Fatal("got too many notifications")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	count(sn.opened)
+	count(sn.closed)
+
+	select {
+	case <-cn.connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestRemoteStreamReset(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s2.SetStreamHandler(func(s inet.Stream) {
+		s.Reset()
+	})
+
+	sn := newStreamNotifiee(2)
+	s1.AddNotifiee(sn)
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	ic, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ic.(*Conn)
+
+	st, err := c.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Fatalf("expected a reset error, got %v", err)
+	}
+
+	if n := c.NumStreams(); n != 0 {
+		t.Fatalf("expected no streams after remote reset, got %d", n)
+	}
+
+	// resetting and closing a dead stream shouldn't notify again.
+	st.Reset()
+	st.Close()
+
+	select {
+	case <-sn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the stream to be closed")
+	}
+	select {
+	case <-sn.closed:
+		t.Fatal("stream closed twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWaitForConnected(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := s1.WaitForConnected(tctx, s2.LocalPeer()); err != context.DeadlineExceeded {
+		t.Fatalf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+	if s1.Connectedness(s2.LocalPeer()) == inet.Connected {
+		t.Fatal("WaitForConnected shouldn't dial")
+	}
+
+	// s2 connects to s1 while s1 waits.
+	dialed := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s2.Peerstore().AddAddrs(s1.LocalPeer(), s1.ListenAddresses(), pstore.PermanentAddrTTL)
+		_, err := s2.DialPeer(ctx, s1.LocalPeer())
+		dialed <- err
+	}()
+	tctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := s1.WaitForConnected(tctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-dialed; err != nil {
+		t.Fatal(err)
+	}
+
+	// already connected.
+	if err := s1.WaitForConnected(tctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type peerNotifiee struct {
+	*connNotifiee
+	peerDisconnected chan peer.ID
+}
+
+func (pn *peerNotifiee) PeerDisconnected(s *Swarm, p peer.ID) {
+	pn.peerDisconnected <- p
+}
+
+func TestPeerDisconnected(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+	s2.SetStreamHandler(func(s inet.Stream) {})
+
+	pn := &peerNotifiee{connNotifiee: newConnNotifiee(2), peerDisconnected: make(chan peer.ID, 1)}
+	s1.AddNotifiee(pn)
+
+	// one stream per connection gives us two connections.
+	s1.SetMaxStreamsPerConn(1, StreamLimitNewConn)
+	s1.SetMaxConnsPerPeer(2)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	st1, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st1.Conn() == st2.Conn() {
+		t.Fatal("expected two connections")
+	}
+
+	expectDisconnected := func(c inet.Conn) {
+		t.Helper()
+		select {
+		case dc := <-pn.disconnected:
+			if dc != c {
+				t.Fatal("got incorrect conn", c, dc)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	st1.Conn().Close()
+	expectDisconnected(st1.Conn())
+	select {
+	case <-pn.peerDisconnected:
+		t.Fatal("still connected to the peer")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	st2.Conn().Close()
+	expectDisconnected(st2.Conn())
+	select {
+	case p := <-pn.peerDisconnected:
+		if p != s2.LocalPeer() {
+			t.Fatalf("expected %s to be disconnected, got %s", s2.LocalPeer(), p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestStreamDeadlineNotReset(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s2.SetStreamHandler(func(s inet.Stream) {
+		io.Copy(s, s)
+		s.Close()
+	})
+
+	sn := newStreamNotifiee(2)
+	s1.AddNotifiee(sn)
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	ic, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ic.(*Conn)
+
+	st, err := c.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the read to time out")
+	}
+	if n := c.NumStreams(); n != 1 {
+		t.Fatalf("expected the stream to survive the deadline, got %d streams", n)
+	}
+
+	// the stream still works.
+	st.SetReadDeadline(time.Time{})
+	buf := []byte("hello")
+	if _, err := st.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(st, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// writing after Close fails but we can still read.
+	st.Close()
+	if _, err := st.Write(buf); err == nil {
+		t.Fatal("expected writing to a closed stream to fail")
+	}
+	if n := c.NumStreams(); n != 1 {
+		t.Fatalf("expected the stream to stay open for reading, got %d streams", n)
+	}
+	select {
+	case <-sn.closed:
+		t.Fatal("stream closed before it was fully closed")
+	default:
+	}
+	if _, err := st.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if n := c.NumStreams(); n != 0 {
+		t.Fatalf("expected no streams once both sides closed, got %d", n)
+	}
+	select {
+	case <-sn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the stream to be closed")
+	}
+}
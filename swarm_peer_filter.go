@@ -0,0 +1,57 @@
+package swarm
+
+import (
+	"errors"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ErrPeerBlocked is returned when trying to dial (or accept a connection from)
+// a peer that has been blocked, either explicitly or because it isn't on the
+// allowlist when running in allowlist-only mode.
+var ErrPeerBlocked = errors.New("peer blocked")
+
+// BlockPeer prevents the swarm from dialing the given peer and makes it
+// reject inbound connections from it. It also removes the peer from the
+// allowlist.
+//
+// Existing connections to the peer are left alone. Use ClosePeer to close
+// them.
+func (s *Swarm) BlockPeer(p peer.ID) {
+	s.peerFilter.Lock()
+	defer s.peerFilter.Unlock()
+	delete(s.peerFilter.allowed, p)
+	s.peerFilter.blocked[p] = struct{}{}
+}
+
+// AllowPeer removes the given peer from the blocklist and adds it to the
+// allowlist.
+func (s *Swarm) AllowPeer(p peer.ID) {
+	s.peerFilter.Lock()
+	defer s.peerFilter.Unlock()
+	delete(s.peerFilter.blocked, p)
+	s.peerFilter.allowed[p] = struct{}{}
+}
+
+// SetAllowlistOnly enables or disables allowlist-only mode. In this mode, the
+// swarm only dials (and accepts connections from) peers that have been
+// explicitly allowed with AllowPeer.
+func (s *Swarm) SetAllowlistOnly(enabled bool) {
+	s.peerFilter.Lock()
+	defer s.peerFilter.Unlock()
+	s.peerFilter.allowlistOnly = enabled
+}
+
+// peerBlocked returns true if we shouldn't talk to the given peer.
+func (s *Swarm) peerBlocked(p peer.ID) bool {
+	s.peerFilter.RLock()
+	defer s.peerFilter.RUnlock()
+	if _, ok := s.peerFilter.blocked[p]; ok {
+		return true
+	}
+	if s.peerFilter.allowlistOnly {
+		_, ok := s.peerFilter.allowed[p]
+		return !ok
+	}
+	return false
+}
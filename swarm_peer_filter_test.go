@@ -0,0 +1,71 @@
+package swarm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+func TestBlockPeer(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	s2.Peerstore().AddAddrs(s1.LocalPeer(), s1.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	s1.BlockPeer(s2.LocalPeer())
+
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != ErrPeerBlocked {
+		t.Fatal("expected dialing a blocked peer to fail with ErrPeerBlocked, got:", err)
+	}
+
+	// s2 may think it connected but s1 should reject the connection.
+	if c, err := s2.DialPeer(ctx, s1.LocalPeer()); err == nil {
+		for i := 0; !c.(*Conn).IsClosed(); i++ {
+			if i > 500 {
+				t.Fatal("blocked peer's connection should have been closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if len(s1.ConnsToPeer(s2.LocalPeer())) != 0 {
+		t.Fatal("shouldn't have accepted a connection from a blocked peer")
+	}
+
+	s1.AllowPeer(s2.LocalPeer())
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal("dialing an unblocked peer should have worked, got:", err)
+	}
+}
+
+func TestAllowlistOnly(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s1, s2, s3 := swarms[0], swarms[1], swarms[2]
+
+	for _, s := range []*Swarm{s2, s3} {
+		s1.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), pstore.PermanentAddrTTL)
+	}
+
+	s1.SetAllowlistOnly(true)
+	s1.AllowPeer(s2.LocalPeer())
+
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal("dialing an allowed peer should have worked, got:", err)
+	}
+	if _, err := s1.DialPeer(ctx, s3.LocalPeer()); err != ErrPeerBlocked {
+		t.Fatal("expected dialing a peer not on the allowlist to fail with ErrPeerBlocked, got:", err)
+	}
+
+	s1.SetAllowlistOnly(false)
+	if _, err := s1.DialPeer(ctx, s3.LocalPeer()); err != nil {
+		t.Fatal("dialing should work after leaving allowlist-only mode, got:", err)
+	}
+}
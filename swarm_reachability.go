@@ -0,0 +1,53 @@
+package swarm
+
+import (
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+const (
+	// relayOnlyFactor scales the reachability of peers we can only reach
+	// through relays, which are slower and less reliable to dial.
+	relayOnlyFactor = 0.5
+	// backedOffFactor scales the reachability of peers we're backing off
+	// from. Their dials fail straight away until the backoff expires.
+	backedOffFactor = 0.1
+)
+
+// ReachabilityScore estimates how likely we are to successfully dial peer p,
+// from 0 (we can't) to 1 (we're already connected). It only looks at what we
+// know locally, without any network I/O (DNS addresses aren't resolved):
+//
+//   - the peer's dialable addresses, after filtering,
+//   - their dial history (see AddrScoreboard), addresses we know nothing
+//     about count as a coin flip,
+//   - whether they're all relay addresses,
+//   - whether we're backing off from the peer.
+func (s *Swarm) ReachabilityScore(p peer.ID) float64 {
+	if p == s.local || s.peerBlocked(p) {
+		return 0
+	}
+	if s.Connectedness(p) == inet.Connected {
+		return 1
+	}
+
+	addrs := s.filterKnownUndialables(s.peers.Addrs(p))
+	if len(addrs) == 0 {
+		return 0
+	}
+
+	// The probability that at least one of the addresses works.
+	allFail := 1.0
+	for _, rate := range s.addrScores.successRates(p, addrs) {
+		allFail *= 1 - rate
+	}
+	score := 1 - allFail
+
+	if direct, _ := splitRelayAddrs(addrs); len(direct) == 0 {
+		score *= relayOnlyFactor
+	}
+	if s.backf.Backoff(p) {
+		score *= backedOffFactor
+	}
+	return score
+}
@@ -0,0 +1,60 @@
+package swarm_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	testutil "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestReachabilityScore(t *testing.T) {
+	ctx := context.Background()
+	s := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
+	defer s.Close()
+	if err := s.AddTransport(newCircuitTransport(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	direct := []ma.Multiaddr{
+		ma.StringCast("/ip4/1.2.3.4/tcp/1"),
+		ma.StringCast("/ip4/5.6.7.8/tcp/2"),
+	}
+	good := testutil.RandPeerIDFatal(t)
+	s.Peerstore().AddAddrs(good, direct, pstore.PermanentAddrTTL)
+	for _, a := range direct {
+		s.AddrScoreboard().AddSuccess(good, a, time.Millisecond)
+	}
+	if score := s.ReachabilityScore(good); score < 0.8 {
+		t.Fatalf("expected a high score for a peer with working addresses, got %f", score)
+	}
+
+	backedOff := testutil.RandPeerIDFatal(t)
+	s.Peerstore().AddAddrs(backedOff, direct, pstore.PermanentAddrTTL)
+	for _, a := range direct {
+		s.AddrScoreboard().AddSuccess(backedOff, a, time.Millisecond)
+	}
+	s.Backoff().AddBackoff(backedOff)
+	if score := s.ReachabilityScore(backedOff); score > 0.2 {
+		t.Fatalf("expected a low score for a backed off peer, got %f", score)
+	}
+
+	relayOnly := testutil.RandPeerIDFatal(t)
+	relay := testutil.RandPeerIDFatal(t)
+	s.Peerstore().AddAddrs(relayOnly, []ma.Multiaddr{
+		ma.StringCast(fmt.Sprintf("/ip4/1.2.3.4/tcp/1/p2p/%s/p2p-circuit", relay.Pretty())),
+		ma.StringCast(fmt.Sprintf("/ip4/5.6.7.8/tcp/2/p2p/%s/p2p-circuit", relay.Pretty())),
+	}, pstore.PermanentAddrTTL)
+	if score := s.ReachabilityScore(relayOnly); score < 0.2 || score > 0.8 {
+		t.Fatalf("expected a medium score for a relay-only peer, got %f", score)
+	}
+
+	if score := s.ReachabilityScore(testutil.RandPeerIDFatal(t)); score != 0 {
+		t.Fatalf("expected 0 for a peer without addresses, got %f", score)
+	}
+}
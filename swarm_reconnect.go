@@ -0,0 +1,99 @@
+package swarm
+
+import (
+	"context"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// AutoReconnectInterval is the minimum amount of time between two automatic
+// reconnection attempts to the same peer (default: 1m).
+var AutoReconnectInterval = time.Minute
+
+// connQualityWeight is the weight given to the latest sample when updating a
+// connection's quality.
+const connQualityWeight = 0.2
+
+// SetAutoReconnectOnDegradation enables automatic reconnection. When the
+// quality of a connection (see Conn.Quality) drops below threshold, the swarm
+// dials a fresh connection to the peer in the background and prefers it for
+// new streams. Attempts are rate limited per peer (see
+// AutoReconnectInterval).
+//
+// A threshold of 0 disables automatic reconnection.
+func (s *Swarm) SetAutoReconnectOnDegradation(threshold float64) {
+	s.reconnect.Lock()
+	s.reconnect.threshold = threshold
+	s.reconnect.Unlock()
+}
+
+// reconnectThreshold returns the current automatic reconnection threshold.
+func (s *Swarm) reconnectThreshold() float64 {
+	s.reconnect.Lock()
+	defer s.reconnect.Unlock()
+	return s.reconnect.threshold
+}
+
+// degraded returns true if the given connection quality is below the
+// automatic reconnection threshold.
+func (s *Swarm) degraded(quality float64) bool {
+	return quality < s.reconnectThreshold()
+}
+
+// maybeReconnect starts a background dial to the peer on the other side of c
+// if c has degraded and we haven't tried to reconnect to that peer recently.
+func (s *Swarm) maybeReconnect(c *Conn) {
+	if !s.degraded(c.Quality()) {
+		return
+	}
+	p := c.RemotePeer()
+
+	s.reconnect.Lock()
+	now := time.Now()
+	if last, ok := s.reconnect.last[p]; ok && now.Sub(last) < AutoReconnectInterval {
+		s.reconnect.Unlock()
+		return
+	}
+	for op, last := range s.reconnect.last {
+		if now.Sub(last) >= AutoReconnectInterval {
+			delete(s.reconnect.last, op)
+		}
+	}
+	s.reconnect.last[p] = now
+	s.reconnect.Unlock()
+
+	log.Debugf("connection %s degraded, reconnecting to %s", c, p)
+	go s.reconnectPeer(p)
+}
+
+// reconnectPeer dials a new connection to p through dialPeer, so the usual
+// checks (blocked peers, backoff, ...) apply and concurrent dials to p are
+// merged.
+func (s *Swarm) reconnectPeer(p peer.ID) {
+	if _, err := s.dialPeer(withNewConn(s.ctx), p); err != nil {
+		log.Debugf("failed to reconnect to %s: %s", p, err)
+		// The backoff rate limits further attempts, if any.
+		s.forgetReconnect(p)
+	}
+}
+
+// forgetReconnect forgets when we last tried to reconnect to p.
+func (s *Swarm) forgetReconnect(p peer.ID) {
+	s.reconnect.Lock()
+	delete(s.reconnect.last, p)
+	s.reconnect.Unlock()
+}
+
+type newConnKey struct{}
+
+// withNewConn makes dialPeer open a new connection even if we're already
+// connected to the peer.
+func withNewConn(ctx context.Context) context.Context {
+	return context.WithValue(ctx, newConnKey{}, true)
+}
+
+func wantsNewConn(ctx context.Context) bool {
+	v, _ := ctx.Value(newConnKey{}).(bool)
+	return v
+}
@@ -0,0 +1,94 @@
+package swarm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+func TestAutoReconnectOnDegradation(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s1.SetAutoReconnectOnDegradation(0.5)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	ic, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ic.(*Conn)
+
+	waitForConns := func(n int) {
+		for i := 0; len(s1.ConnsToPeer(s2.LocalPeer())) < n; i++ {
+			if i > 500 {
+				t.Fatalf("expected %d connections", n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// degrade the connection.
+	for c.Quality() >= 0.5 {
+		c.ReportStreamFailure()
+	}
+
+	waitForConns(2)
+
+	st, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	replacement := st.Conn().(*Conn)
+	if replacement == c {
+		t.Fatal("expected new streams to use the replacement connection")
+	}
+
+	// sustained degradation shouldn't trigger another reconnect.
+	for replacement.Quality() >= 0.5 {
+		replacement.ReportStreamFailure()
+	}
+	for i := 0; i < 10; i++ {
+		c.ReportStreamFailure()
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := len(s1.ConnsToPeer(s2.LocalPeer())); n != 2 {
+		t.Fatalf("expected reconnects to be rate limited, have %d connections", n)
+	}
+}
+
+func TestAutoReconnectBlockedPeer(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s1.SetAutoReconnectOnDegradation(0.5)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	ic, err := s1.DialPeer(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ic.(*Conn)
+
+	events, cancel := s1.SubscribeDials()
+	defer cancel()
+
+	s1.BlockPeer(s2.LocalPeer())
+	for c.Quality() >= 0.5 {
+		c.ReportStreamFailure()
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("expected blocked peers not to be dialed, dialed %s", ev.Addr)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
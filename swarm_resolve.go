@@ -0,0 +1,67 @@
+package swarm
+
+import (
+	"context"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+)
+
+// Resolver resolves DNS-based (/dns4, /dns6, /dnsaddr) multiaddrs to
+// concrete IP multiaddrs. *madns.Resolver implements it.
+type Resolver interface {
+	Resolve(ctx context.Context, maddr ma.Multiaddr) ([]ma.Multiaddr, error)
+}
+
+// SetResolver sets the resolver used to resolve DNS addresses before dialing
+// them. The default is madns.DefaultResolver.
+func (s *Swarm) SetResolver(r Resolver) {
+	s.resolver = r
+}
+
+// AddrResolveHook is called with a DNS address of a peer we're about to dial
+// and the addresses it resolved to. See SetAddrResolveHook.
+type AddrResolveHook func(original ma.Multiaddr, resolved []ma.Multiaddr)
+
+// SetAddrResolveHook sets a function called whenever a peer's DNS address is
+// resolved before dialing, e.g. to populate a resolution cache or for
+// diagnostics. It's called synchronously, with the addresses actually kept
+// (records for other peers are dropped), and isn't called for addresses that
+// fail to resolve.
+func (s *Swarm) SetAddrResolveHook(h AddrResolveHook) {
+	s.addrResolveHook = h
+}
+
+// resolveAddrs replaces the DNS addresses of peer p with the addresses they
+// resolve to. Addresses that fail to resolve are dropped.
+func (s *Swarm) resolveAddrs(ctx context.Context, p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	resolved := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if !madns.Matches(a) {
+			resolved = append(resolved, a)
+			continue
+		}
+
+		ras, err := s.resolver.Resolve(ctx, a)
+		if err != nil {
+			log.Debugf("failed to resolve %s for %s: %s", a, p, err)
+			continue
+		}
+		start := len(resolved)
+		for _, ra := range ras {
+			// /dnsaddr records may end with the peer's ID.
+			if rest, last := ma.SplitLast(ra); last != nil && last.Protocol().Code == ma.P_IPFS {
+				if last.Value() != peer.IDB58Encode(p) || rest == nil {
+					continue
+				}
+				ra = rest
+			}
+			resolved = append(resolved, ra)
+		}
+		if h := s.addrResolveHook; h != nil {
+			h(a, append([]ma.Multiaddr(nil), resolved[start:]...))
+		}
+	}
+	return resolved
+}
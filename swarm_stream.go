@@ -79,10 +79,35 @@ func (s *Stream) Read(p []byte) (int, error) {
 			s.state.v = streamCloseRead
 		}
 		s.state.Unlock()
+	} else if err != nil {
+		s.maybeReset(err)
 	}
 	return n, err
 }
 
+// maybeReset marks the stream as reset if err means the remote side reset
+// it. Other errors (e.g., expired deadlines or writing after Close) leave the
+// stream as it is.
+func (s *Stream) maybeReset(err error) {
+	if !isResetErr(err) {
+		return
+	}
+	s.state.Lock()
+	switch s.state.v {
+	case streamOpen, streamCloseRead, streamCloseWrite:
+		s.state.v = streamReset
+		s.remove()
+	}
+	s.state.Unlock()
+}
+
+// isResetErr returns true if err is the muxer's stream reset error. Muxers
+// don't all return smux.ErrReset (yamux has its own error), but they use the
+// same message.
+func isResetErr(err error) bool {
+	return err == smux.ErrReset || err.Error() == smux.ErrReset.Error()
+}
+
 // Write writes bytes to a stream, flushing for each call.
 func (s *Stream) Write(p []byte) (int, error) {
 	n, err := s.stream.Write(p)
@@ -91,6 +116,9 @@ func (s *Stream) Write(p []byte) (int, error) {
 		s.conn.swarm.bwc.LogSentMessage(int64(n))
 		s.conn.swarm.bwc.LogSentMessageStream(int64(n), s.Protocol(), s.Conn().RemotePeer())
 	}
+	if err != nil {
+		s.maybeReset(err)
+	}
 	return n, err
 }
 
@@ -136,6 +164,9 @@ func (s *Stream) remove() {
 		s.conn.swarm.notifyAll(func(f inet.Notifiee) {
 			f.ClosedStream(s.conn.swarm, s)
 		})
+		s.conn.swarm.notifyStreamNotifiees(func(n StreamNotifiee) {
+			n.ClosedStream(s.conn.swarm, s)
+		})
 		s.conn.swarm.refs.Done()
 	}()
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
 	"testing"
@@ -14,10 +15,13 @@ import (
 	inet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
+	transport "github.com/libp2p/go-libp2p-transport"
+	filter "github.com/libp2p/go-maddr-filter"
+	testutil "github.com/libp2p/go-testutil"
 	ma "github.com/multiformats/go-multiaddr"
 
 	. "github.com/libp2p/go-libp2p-swarm"
-	. "github.com/libp2p/go-libp2p-swarm/testing"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 )
 
 var log = logging.Logger("swarm_test")
@@ -54,17 +58,17 @@ func EchoStreamHandler(stream inet.Stream) {
 }
 
 func makeDialOnlySwarm(ctx context.Context, t *testing.T) *Swarm {
-	swarm := GenSwarm(t, ctx, OptDialOnly)
+	swarm := swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly)
 	swarm.SetStreamHandler(EchoStreamHandler)
 
 	return swarm
 }
 
-func makeSwarms(ctx context.Context, t *testing.T, num int, opts ...Option) []*Swarm {
+func makeSwarms(ctx context.Context, t *testing.T, num int, opts ...swarmt.Option) []*Swarm {
 	swarms := make([]*Swarm, 0, num)
 
 	for i := 0; i < num; i++ {
-		swarm := GenSwarm(t, ctx, opts...)
+		swarm := swarmt.GenSwarm(t, ctx, opts...)
 		swarm.SetStreamHandler(EchoStreamHandler)
 		swarms = append(swarms, swarm)
 	}
@@ -102,7 +106,7 @@ func SubtestSwarm(t *testing.T, SwarmNum int, MsgNum int) {
 	// t.Skip("skipping for another test")
 
 	ctx := context.Background()
-	swarms := makeSwarms(ctx, t, SwarmNum, OptDisableReuseport)
+	swarms := makeSwarms(ctx, t, SwarmNum, swarmt.OptDisableReuseport)
 
 	// connect everyone
 	connectSwarms(t, ctx, swarms)
@@ -307,6 +311,34 @@ func TestAddrBlocking(t *testing.T) {
 	}
 }
 
+func TestSetAddrFilters(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	_, block, err := net.ParseCIDR("127.0.0.1/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocking := filter.NewFilters()
+	blocking.AddDialFilter(block)
+	s1.SetAddrFilters(blocking)
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err == nil {
+		t.Fatal("dial should have been filtered")
+	}
+
+	s1.SetAddrFilters(filter.NewFilters())
+	s1.Backoff().Clear(s2.LocalPeer())
+	if _, err := s1.DialPeer(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal("dial should have succeeded with the new filters:", err)
+	}
+	if s1.Filters == blocking {
+		t.Fatal("expected the new filters to be in place")
+	}
+}
+
 func TestFilterBounds(t *testing.T) {
 	ctx := context.Background()
 	swarms := makeSwarms(ctx, t, 2)
@@ -335,3 +367,279 @@ func TestFilterBounds(t *testing.T) {
 		t.Log("got connect")
 	}
 }
+
+func TestSwarmCloseGracefully(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s1, s2, s3 := swarms[0], swarms[1], swarms[2]
+
+	s2.SetStreamHandler(EchoStreamHandler)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	s1.Peerstore().AddAddrs(s3.LocalPeer(), s3.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s1.CloseGracefully(closeCtx)
+	}()
+
+	// wait for the swarm to start draining.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := s1.DialPeer(ctx, s3.LocalPeer()); err != nil {
+			break
+		}
+		s1.ClosePeer(s3.LocalPeer())
+		if time.Now().After(deadline) {
+			t.Fatal("expected new dials to fail while draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := s1.DialPeerViaRelay(ctx, s3.LocalPeer(), s2.LocalPeer()); err != ErrSwarmClosed {
+		t.Fatalf("expected relayed dials to fail with %q while draining, got %v", ErrSwarmClosed, err)
+	}
+
+	select {
+	case <-closed:
+		t.Fatal("swarm closed with a stream still open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// finish the in-flight stream.
+	if _, err := str.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(str, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte("pong")) {
+		t.Fatalf("expected pong, got %q", buf)
+	}
+	str.Close()
+	io.Copy(ioutil.Discard, str)
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("swarm didn't close after the stream finished")
+	}
+	if len(s1.Conns()) != 0 {
+		t.Fatal("expected all conns to be closed")
+	}
+}
+
+func TestSwarmCloseGracefullyTimeout(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	s2.SetStreamHandler(EchoStreamHandler)
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s1.NewStream(ctx, s2.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	closeCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := s1.CloseGracefully(closeCtx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the drain to time out, got %v", err)
+	}
+	if len(s1.Conns()) != 0 {
+		t.Fatal("expected all conns to be closed")
+	}
+}
+
+func TestRedundantConnsClosed(t *testing.T) {
+	ctx := context.Background()
+
+	// Delay dials so both sides are dialing before either connects.
+	delay := func(tpt transport.Transport) transport.Transport {
+		return &delayedTransport{Transport: tpt, delay: 100 * time.Millisecond}
+	}
+	for i := 0; i < 3; i++ {
+		swarms := []*Swarm{
+			genSwarmWithTransport(ctx, t, true, delay),
+			genSwarmWithTransport(ctx, t, true, delay),
+		}
+		connected := make([]int, len(swarms))
+		var lk sync.Mutex
+		for i, s := range swarms {
+			i := i
+			s.Notify(&inet.NotifyBundle{
+				ConnectedF: func(inet.Network, inet.Conn) {
+					lk.Lock()
+					connected[i]++
+					lk.Unlock()
+				},
+				DisconnectedF: func(inet.Network, inet.Conn) {
+					lk.Lock()
+					connected[i]--
+					lk.Unlock()
+				},
+			})
+		}
+		for i, s := range swarms {
+			other := swarms[1-i]
+			s.Peerstore().AddAddrs(other.LocalPeer(), other.ListenAddresses(), pstore.PermanentAddrTTL)
+		}
+
+		var wg sync.WaitGroup
+		for i, s := range swarms {
+			wg.Add(1)
+			go func(s *Swarm, remote peer.ID) {
+				defer wg.Done()
+				if _, err := s.DialPeer(ctx, remote); err != nil {
+					t.Error(err)
+				}
+			}(s, swarms[1-i].LocalPeer())
+		}
+		wg.Wait()
+
+		// both sides keep the connection opened by the smaller peer ID.
+		for i, s := range swarms {
+			remote := swarms[1-i].LocalPeer()
+			want := inet.DirInbound
+			if s.LocalPeer() < remote {
+				want = inet.DirOutbound
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				conns := s.ConnsToPeer(remote)
+				lk.Lock()
+				n := connected[i]
+				lk.Unlock()
+				if len(conns) == 1 && n == 1 {
+					if dir := conns[0].Stat().Direction; dir != want {
+						t.Fatalf("expected the connection with direction %d to survive, got %d", want, dir)
+					}
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("expected one connection, got %d (%d connected notifications)", len(conns), n)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		closeSwarms(swarms)
+	}
+}
+
+func TestSwarmNewStream(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s1, s2 := swarms[0], swarms[1]
+
+	// needs a dial
+	s1.Peerstore().AddAddrs(s2.LocalPeer(), s2.ListenAddresses(), pstore.PermanentAddrTTL)
+	str, err := s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	str.Close()
+	conns := s1.ConnsToPeer(s2.LocalPeer())
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 connection, got %d", len(conns))
+	}
+
+	// already connected
+	str, err = s1.NewStream(ctx, s2.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	str.Close()
+	if str.Conn() != conns[0] || len(s1.ConnsToPeer(s2.LocalPeer())) != 1 {
+		t.Fatal("expected the existing connection to be reused")
+	}
+
+	// backed off
+	unreachable := testutil.RandPeerIDFatal(t)
+	s1.Peerstore().AddAddr(unreachable, closedPortAddr(t), pstore.PermanentAddrTTL)
+	if _, err := s1.NewStream(ctx, unreachable); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if _, err := s1.NewStream(ctx, unreachable); err != ErrDialBackoff {
+		t.Fatalf("expected %s, got %v", ErrDialBackoff, err)
+	}
+}
+
+// quicTransport pretends to dial over QUIC: it dials the peer's TCP address
+// and reports the QUIC address it was asked to dial as the remote address.
+type quicTransport struct {
+	tcp   transport.Transport
+	peers map[peer.ID]ma.Multiaddr
+}
+
+type quicConn struct {
+	transport.Conn
+	raddr ma.Multiaddr
+}
+
+func (c *quicConn) RemoteMultiaddr() ma.Multiaddr { return c.raddr }
+
+func (qt *quicTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	c, err := qt.tcp.Dial(ctx, qt.peers[p], p)
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{Conn: c, raddr: raddr}, nil
+}
+
+func (qt *quicTransport) CanDial(addr ma.Multiaddr) bool { return true }
+
+func (qt *quicTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (qt *quicTransport) Protocols() []int { return []int{ma.P_QUIC} }
+
+func (qt *quicTransport) Proxy() bool { return false }
+
+func TestCloseConnsByProtocol(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 3)
+	defer closeSwarms(swarms)
+	s, tcpPeer, quicPeer := swarms[0], swarms[1], swarms[2]
+
+	qt := &quicTransport{
+		tcp:   s.TransportForDialing(tcpPeer.ListenAddresses()[0]),
+		peers: map[peer.ID]ma.Multiaddr{quicPeer.LocalPeer(): quicPeer.ListenAddresses()[0]},
+	}
+	if err := s.AddTransport(qt); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Peerstore().AddAddrs(tcpPeer.LocalPeer(), tcpPeer.ListenAddresses(), pstore.PermanentAddrTTL)
+	s.Peerstore().AddAddr(quicPeer.LocalPeer(), ma.StringCast("/ip4/127.0.0.1/udp/4001/quic"), pstore.PermanentAddrTTL)
+	for _, p := range []peer.ID{tcpPeer.LocalPeer(), quicPeer.LocalPeer()} {
+		if _, err := s.DialPeer(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := s.CloseConnsByProtocol(ma.P_QUIC); n != 1 {
+		t.Fatalf("expected to close one connection, closed %d", n)
+	}
+	if s.Connectedness(quicPeer.LocalPeer()) == inet.Connected {
+		t.Fatal("expected the QUIC connection to be closed")
+	}
+	if s.Connectedness(tcpPeer.LocalPeer()) != inet.Connected {
+		t.Fatal("expected the TCP connection to stay open")
+	}
+	if n := s.CloseConnsByProtocol(ma.P_QUIC); n != 0 {
+		t.Fatalf("expected nothing left to close, closed %d", n)
+	}
+}
@@ -1,13 +1,42 @@
 package swarm
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
+	"net"
+	"runtime/debug"
 	"strings"
+	"time"
 
+	addrutil "github.com/libp2p/go-addr-util"
+	peer "github.com/libp2p/go-libp2p-peer"
 	transport "github.com/libp2p/go-libp2p-transport"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
+// TransportSelector picks the transport used to dial addr out of the
+// candidate transports that can dial it. See SetTransportSelector.
+type TransportSelector func(addr ma.Multiaddr, candidates []transport.Transport) transport.Transport
+
+// SetTransportSelector sets the function used to pick a transport when dialing
+// an address more than one of our transports can dial, e.g. a transport
+// registered for /ip4 and another registered for /tcp.
+//
+// By default (nil), proxy transports win and otherwise the transport
+// registered for the address's last protocol is used.
+func (s *Swarm) SetTransportSelector(sel TransportSelector) {
+	s.transportCfg.Lock()
+	defer s.transportCfg.Unlock()
+	s.transportCfg.selector = sel
+}
+
+func (s *Swarm) transportSelector() TransportSelector {
+	s.transportCfg.RLock()
+	defer s.transportCfg.RUnlock()
+	return s.transportCfg.selector
+}
+
 // TransportForDialing retrieves the appropriate transport for dialing the given
 // multiaddr.
 func (s *Swarm) TransportForDialing(a ma.Multiaddr) transport.Transport {
@@ -16,6 +45,19 @@ func (s *Swarm) TransportForDialing(a ma.Multiaddr) transport.Transport {
 		return nil
 	}
 
+	if sel := s.transportSelector(); sel != nil {
+		candidates := s.dialCandidates(a, protocols)
+		if len(candidates) == 0 {
+			return nil
+		}
+		return sel(a, candidates)
+	}
+	return s.transportForProtocols(protocols)
+}
+
+// transportForProtocols returns the transport used to dial addresses made of
+// the given protocols, when there's no TransportSelector.
+func (s *Swarm) transportForProtocols(protocols []ma.Protocol) transport.Transport {
 	s.transports.RLock()
 	defer s.transports.RUnlock()
 	if len(s.transports.m) == 0 {
@@ -36,6 +78,280 @@ func (s *Swarm) TransportForDialing(a ma.Multiaddr) transport.Transport {
 	return s.transports.m[protocols[len(protocols)-1].Code]
 }
 
+// dialTransportCache caches the transports used to dial addresses by the
+// addresses' protocols, so filtering many addresses only looks up the
+// transport once per protocol stack (e.g., once for all /ip4/.../tcp/...
+// addresses). It's meant to be used for a single batch of addresses: the
+// cache doesn't see transports added after it's filled.
+type dialTransportCache struct {
+	s   *Swarm
+	m   map[string]transport.Transport
+	key []byte
+}
+
+func (s *Swarm) newDialTransportCache() *dialTransportCache {
+	return &dialTransportCache{s: s, m: make(map[string]transport.Transport)}
+}
+
+// canDial is like Swarm.canDial.
+func (c *dialTransportCache) canDial(a ma.Multiaddr) bool {
+	if c.s.transportSelector() != nil {
+		// The selector may look at the whole address.
+		return c.s.canDial(a)
+	}
+	key, ok := appendProtocolKey(c.key[:0], a.Bytes())
+	if !ok || len(key) == 0 {
+		return c.s.canDial(a)
+	}
+	c.key = key
+	t, ok := c.m[string(key)]
+	if !ok {
+		t = c.s.transportForProtocols(a.Protocols())
+		c.m[string(key)] = t
+	}
+	return t != nil && t.CanDial(a)
+}
+
+// appendProtocolKey appends the varint protocol codes of the binary
+// multiaddr b to key, skipping over the values. Unlike Multiaddr.Protocols,
+// it doesn't allocate (beyond growing key).
+func appendProtocolKey(key, b []byte) ([]byte, bool) {
+	for len(b) > 0 {
+		code, n, err := ma.ReadVarintCode(b)
+		if err != nil {
+			return key, false
+		}
+		key = binary.AppendUvarint(key, uint64(code))
+		b = b[n:]
+
+		p := ma.ProtocolWithCode(code)
+		switch {
+		case p.Code == 0:
+			return key, false
+		case p.Size > 0:
+			n = p.Size / 8
+		case p.Size < 0:
+			size, sn, err := ma.ReadVarintCode(b)
+			if err != nil {
+				return key, false
+			}
+			b = b[sn:]
+			n = size
+		default:
+			n = 0
+		}
+		if n < 0 || n > len(b) {
+			return key, false
+		}
+		b = b[n:]
+	}
+	return key, true
+}
+
+// dialCandidates returns the transports that can dial a, in the order of the
+// address's protocols.
+func (s *Swarm) dialCandidates(a ma.Multiaddr, protocols []ma.Protocol) []transport.Transport {
+	s.transports.RLock()
+	defer s.transports.RUnlock()
+
+	var candidates []transport.Transport
+	seen := make(map[transport.Transport]bool)
+	for _, p := range protocols {
+		t, ok := s.transports.m[p.Code]
+		if !ok || seen[t] {
+			continue
+		}
+		seen[t] = true
+		if t.CanDial(a) {
+			candidates = append(candidates, t)
+		}
+	}
+	return candidates
+}
+
+// FdConsumer is an optional interface transports can implement to tell the
+// swarm whether dialing them consumes a file descriptor. Dials over transports
+// that don't are limited separately (see ConcurrentNonFdDials).
+type FdConsumer interface {
+	ConsumesFd() bool
+}
+
+// LocalAddrDialer is an optional interface transports can implement to dial
+// from a given local address (see Swarm.SetDialLocalAddr).
+type LocalAddrDialer interface {
+	DialWithLocalAddr(ctx context.Context, raddr ma.Multiaddr, p peer.ID, laddr ma.Multiaddr) (transport.Conn, error)
+}
+
+// SetDialLocalAddr sets the local address outbound dials should originate
+// from, e.g. /ip4/192.168.1.2/tcp/0 to use a specific interface. It's only
+// used for remote addresses of the same family (IPv4 or IPv6) and only by
+// transports implementing LocalAddrDialer, the others dial as usual.
+//
+// A nil address (the default) lets the transports choose.
+func (s *Swarm) SetDialLocalAddr(laddr ma.Multiaddr) {
+	s.transportCfg.Lock()
+	defer s.transportCfg.Unlock()
+	s.transportCfg.localAddr = laddr
+}
+
+func (s *Swarm) dialLocalAddr() ma.Multiaddr {
+	s.transportCfg.RLock()
+	defer s.transportCfg.RUnlock()
+	return s.transportCfg.localAddr
+}
+
+// SetRecoverTransportPanics sets whether a panic in a transport's Dial should
+// be recovered from and treated as a failed dial of that address. It's off by
+// default so buggy transports fail fast.
+func (s *Swarm) SetRecoverTransportPanics(enable bool) {
+	s.recoverTransportPanics = enable
+}
+
+// ConnSocketOpts are socket options applied to dialed TCP connections (see
+// SetConnSocketOpts). Options left unset (nil or zero) aren't touched.
+type ConnSocketOpts struct {
+	// NoDelay sets TCP_NODELAY, if non-nil. Go sets it on every new TCP
+	// connection, so setting it to false turns Nagle's algorithm back on.
+	NoDelay *bool
+
+	// KeepAlive enables or disables TCP keepalives, if non-nil.
+	// KeepAlivePeriod sets the keepalive interval, if non-zero.
+	KeepAlive       *bool
+	KeepAlivePeriod time.Duration
+
+	// ReadBuffer and WriteBuffer set the socket buffer sizes, if non-zero.
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// NetConner is an optional interface transport connections can implement to
+// expose the net.Conn they're layered on, e.g. to apply ConnSocketOpts. The
+// swarm finds the net.Conn under connections upgraded by a tracked upgrader
+// on its own (see Swarm.TrackUpgrader).
+type NetConner interface {
+	NetConn() net.Conn
+}
+
+// SetConnSocketOpts sets the socket options applied to dialed connections
+// right after the transport dials them. They're applied to TCP connections
+// whose net.Conn the swarm can reach: connections upgraded by a tracked
+// upgrader (see TrackUpgrader), like the stock TCP transport's, and
+// connections implementing NetConner. It's a no-op for the others.
+//
+// A nil value (the default) leaves the sockets as the transports set them up.
+func (s *Swarm) SetConnSocketOpts(opts *ConnSocketOpts) {
+	s.transportCfg.Lock()
+	defer s.transportCfg.Unlock()
+	s.transportCfg.sockOpts = opts
+}
+
+func (s *Swarm) connSocketOpts() *ConnSocketOpts {
+	s.transportCfg.RLock()
+	defer s.transportCfg.RUnlock()
+	return s.transportCfg.sockOpts
+}
+
+// tcpConn is what ConnSocketOpts are set through. It's implemented by
+// *net.TCPConn and by the manet connections wrapping one.
+type tcpConn interface {
+	SetNoDelay(bool) error
+	SetKeepAlive(bool) error
+	SetKeepAlivePeriod(time.Duration) error
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}
+
+// applySocketOpts applies the configured socket options to c, if possible.
+func (s *Swarm) applySocketOpts(c transport.Conn) error {
+	opts := s.connSocketOpts()
+	if opts == nil {
+		return nil
+	}
+	tc, ok := s.netConnOf(c).(tcpConn)
+	if !ok {
+		return nil
+	}
+
+	if opts.NoDelay != nil {
+		if err := tc.SetNoDelay(*opts.NoDelay); err != nil {
+			return err
+		}
+	}
+	if opts.KeepAlive != nil {
+		if err := tc.SetKeepAlive(*opts.KeepAlive); err != nil {
+			return err
+		}
+	}
+	if opts.KeepAlivePeriod > 0 {
+		if err := tc.SetKeepAlivePeriod(opts.KeepAlivePeriod); err != nil {
+			return err
+		}
+	}
+	if opts.ReadBuffer > 0 {
+		if err := tc.SetReadBuffer(opts.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.WriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(opts.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transportDial dials addr over tpt, from the configured local address if
+// possible, passing along tpt's configuration otherwise.
+func (s *Swarm) transportDial(ctx context.Context, tpt transport.Transport, addr ma.Multiaddr, p peer.ID) (_ transport.Conn, err error) {
+	if s.recoverTransportPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("transport %s panicked dialing %s: %s\n%s", tpt, addr, r, debug.Stack())
+				err = fmt.Errorf("transport panicked dialing %s: %v", addr, r)
+			}
+		}()
+	}
+	if laddr := s.dialLocalAddr(); laddr != nil && sameFamily(laddr, addr) {
+		if ld, ok := tpt.(LocalAddrDialer); ok {
+			return ld.DialWithLocalAddr(ctx, addr, p, laddr)
+		}
+	}
+	if cd, ok := tpt.(ConfiguredDialer); ok {
+		if cfg, ok := s.TransportConfigFor(tpt); ok {
+			return cd.DialWithConfig(ctx, addr, p, cfg)
+		}
+	}
+	return tpt.Dial(ctx, addr, p)
+}
+
+// transportListen listens on laddr over tpt, passing along tpt's configuration
+// if possible.
+func (s *Swarm) transportListen(tpt transport.Transport, laddr ma.Multiaddr) (transport.Listener, error) {
+	if cl, ok := tpt.(ConfiguredListener); ok {
+		if cfg, ok := s.TransportConfigFor(tpt); ok {
+			return cl.ListenWithConfig(laddr, cfg)
+		}
+	}
+	return tpt.Listen(laddr)
+}
+
+// sameFamily returns true if both addresses start with the same protocol
+// (e.g., /ip4).
+func sameFamily(a, b ma.Multiaddr) bool {
+	pa, pb := a.Protocols(), b.Protocols()
+	return len(pa) > 0 && len(pb) > 0 && pa[0].Code == pb[0].Code
+}
+
+// dialConsumesFd returns true if dialing the given address consumes a file
+// descriptor. Transports that don't implement FdConsumer are assumed to
+// consume one if the address is a TCP address.
+func (s *Swarm) dialConsumesFd(a ma.Multiaddr) bool {
+	if fc, ok := s.TransportForDialing(a).(FdConsumer); ok {
+		return fc.ConsumesFd()
+	}
+	return addrutil.IsFDCostlyTransport(a)
+}
+
 // TransportForListening retrieves the appropriate transport for listening on
 // the given multiaddr.
 func (s *Swarm) TransportForListening(a ma.Multiaddr) transport.Transport {
@@ -64,10 +380,51 @@ func (s *Swarm) TransportForListening(a ma.Multiaddr) transport.Transport {
 	return selected
 }
 
-// AddTransport adds a transport to this swarm.
+// AddTransport adds a transport to this swarm. If the transport exposes its
+// upgrader as an Upgrader field, the swarm tracks it (see TrackUpgrader).
 //
 // Satisfies the Network interface from go-libp2p-transport.
 func (s *Swarm) AddTransport(t transport.Transport) error {
+	return s.addTransport(t, nil)
+}
+
+// TransportConfig holds transport specific options, e.g. whether to reuse
+// ports or an idle timeout. Its keys and values are up to the transport, the
+// swarm only passes it along.
+type TransportConfig map[string]interface{}
+
+// ConfiguredDialer is an optional interface transports can implement to
+// receive the configuration they were added with (see AddTransportWithConfig)
+// when dialing.
+type ConfiguredDialer interface {
+	DialWithConfig(ctx context.Context, raddr ma.Multiaddr, p peer.ID, cfg TransportConfig) (transport.Conn, error)
+}
+
+// ConfiguredListener is an optional interface transports can implement to
+// receive the configuration they were added with (see AddTransportWithConfig)
+// when listening.
+type ConfiguredListener interface {
+	ListenWithConfig(laddr ma.Multiaddr, cfg TransportConfig) (transport.Listener, error)
+}
+
+// AddTransportWithConfig adds a transport to this swarm along with its
+// configuration. Transports implementing ConfiguredDialer or
+// ConfiguredListener get cfg whenever they dial or listen. For the others,
+// it's only kept as metadata, see TransportConfigFor.
+func (s *Swarm) AddTransportWithConfig(t transport.Transport, cfg TransportConfig) error {
+	return s.addTransport(t, cfg)
+}
+
+// TransportConfigFor returns the configuration transport t was added with, if
+// any.
+func (s *Swarm) TransportConfigFor(t transport.Transport) (TransportConfig, bool) {
+	s.transports.RLock()
+	defer s.transports.RUnlock()
+	cfg, ok := s.transports.cfgs[t]
+	return cfg, ok
+}
+
+func (s *Swarm) addTransport(t transport.Transport, cfg TransportConfig) error {
 	protocols := t.Protocols()
 
 	if len(protocols) == 0 {
@@ -97,5 +454,12 @@ func (s *Swarm) AddTransport(t transport.Transport) error {
 	for _, p := range protocols {
 		s.transports.m[p] = t
 	}
+	if cfg != nil {
+		if s.transports.cfgs == nil {
+			s.transports.cfgs = make(map[transport.Transport]TransportConfig)
+		}
+		s.transports.cfgs[t] = cfg
+	}
+	s.trackUpgraderOf(t)
 	return nil
 }
@@ -0,0 +1,32 @@
+package testing
+
+import (
+	"sync"
+	"time"
+)
+
+// ManualClock is a swarm.Clock that only moves forward when told to. Use it to
+// test backoff expiry without sleeping.
+type ManualClock struct {
+	lk  sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a ManualClock set to now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the clock's current time.
+func (c *ManualClock) Now() time.Time {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.now = c.now.Add(d)
+}
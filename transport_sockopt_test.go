@@ -0,0 +1,186 @@
+//go:build unix
+
+package swarm_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	transport "github.com/libp2p/go-libp2p-transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	tcp "github.com/libp2p/go-tcp-transport"
+	testutil "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+
+	. "github.com/libp2p/go-libp2p-swarm"
+)
+
+// netConnTransport dials plain TCP sockets, upgrades them and exposes the
+// sockets through NetConner.
+type netConnTransport struct {
+	transport.Transport
+	upgrader *tptu.Upgrader
+
+	lk    sync.Mutex
+	conns []*net.TCPConn
+}
+
+type netConn struct {
+	transport.Conn
+	raw net.Conn
+}
+
+func (c *netConn) NetConn() net.Conn {
+	return c.raw
+}
+
+func (nt *netConnTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	network, host, err := manet.DialArgs(raddr)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	mc, err := manet.WrapNetConn(raw)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	c, err := nt.upgrader.UpgradeOutbound(ctx, nt, mc, p)
+	if err != nil {
+		return nil, err
+	}
+
+	nt.lk.Lock()
+	nt.conns = append(nt.conns, raw.(*net.TCPConn))
+	nt.lk.Unlock()
+	return &netConn{Conn: c, raw: raw}, nil
+}
+
+// makeNetConnSwarm returns a dial-only swarm dialing TCP through a
+// netConnTransport.
+func makeNetConnSwarm(ctx context.Context, t *testing.T) (*Swarm, *netConnTransport) {
+	p, err := testutil.RandPeerNetParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := pstoremem.NewPeerstore()
+	ps.AddPubKey(p.ID, p.PubKey)
+	ps.AddPrivKey(p.ID, p.PrivKey)
+	s := NewSwarm(ctx, p.ID, ps, nil)
+
+	upgrader := swarmt.GenUpgrader(s)
+	nt := &netConnTransport{Transport: tcp.NewTCPTransport(upgrader), upgrader: upgrader}
+	if err := s.AddTransport(nt); err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return s, nt
+}
+
+func getsockopt(t *testing.T, c net.Conn, level, opt int) int {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		t.Fatalf("expected a socket, got %T", c)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestConnSocketOpts(t *testing.T) {
+	ctx := context.Background()
+	swarms := makeSwarms(ctx, t, 2)
+	defer closeSwarms(swarms)
+	s, target := swarms[0], swarms[1]
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+
+	dial := func() net.Conn {
+		t.Helper()
+		c, err := s.DialPeer(ctx, target.LocalPeer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nc := c.(*Conn).NetConn()
+		if nc == nil {
+			t.Fatal("expected to reach the socket of a TCP transport connection")
+		}
+		return nc
+	}
+
+	// Go enables TCP_NODELAY by default, make sure ours is applied.
+	s.SetConnSocketOpts(&ConnSocketOpts{NoDelay: boolPtr(false), KeepAlive: boolPtr(true)})
+	c := dial()
+	if v := getsockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+		t.Fatalf("expected TCP_NODELAY to be disabled, got %d", v)
+	}
+	if v := getsockopt(t, c, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v == 0 {
+		t.Fatal("expected SO_KEEPALIVE to be enabled")
+	}
+	s.ClosePeer(target.LocalPeer())
+
+	s.SetConnSocketOpts(&ConnSocketOpts{NoDelay: boolPtr(true)})
+	if v := getsockopt(t, dial(), syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v == 0 {
+		t.Fatal("expected TCP_NODELAY to be enabled")
+	}
+	s.ClosePeer(target.LocalPeer())
+
+	// options that aren't set are left as Go set them up.
+	s.SetConnSocketOpts(&ConnSocketOpts{ReadBuffer: 1 << 16})
+	c = dial()
+	if v := getsockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v == 0 {
+		t.Fatal("expected TCP_NODELAY to be left enabled")
+	}
+	if v := getsockopt(t, c, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v == 0 {
+		t.Fatal("expected SO_KEEPALIVE to be left enabled")
+	}
+}
+
+func TestConnSocketOptsNetConner(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	s, nt := makeNetConnSwarm(ctx, t)
+	defer s.Close()
+	s.SetConnSocketOpts(&ConnSocketOpts{NoDelay: boolPtr(false)})
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s.DialPeer(ctx, target.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	nt.lk.Lock()
+	c := nt.conns[len(nt.conns)-1]
+	nt.lk.Unlock()
+	if v := getsockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+		t.Fatalf("expected TCP_NODELAY to be disabled, got %d", v)
+	}
+}
@@ -2,13 +2,20 @@ package swarm_test
 
 import (
 	"context"
+	"sync"
 	"testing"
 
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 
 	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
 	transport "github.com/libp2p/go-libp2p-transport"
+	tcp "github.com/libp2p/go-tcp-transport"
+	testutil "github.com/libp2p/go-testutil"
 	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/libp2p/go-libp2p-swarm"
 )
 
 type dummyTransport struct {
@@ -45,3 +52,155 @@ func TestUselessTransport(t *testing.T) {
 		t.Fatal("adding a transport that supports no protocols should have failed")
 	}
 }
+
+// bindingTransport records the local addresses it's asked to dial from and
+// then dials as usual.
+type bindingTransport struct {
+	transport.Transport
+
+	lk     sync.Mutex
+	laddrs []ma.Multiaddr
+}
+
+func (bt *bindingTransport) DialWithLocalAddr(ctx context.Context, raddr ma.Multiaddr, p peer.ID, laddr ma.Multiaddr) (transport.Conn, error) {
+	bt.lk.Lock()
+	bt.laddrs = append(bt.laddrs, laddr)
+	bt.lk.Unlock()
+	return bt.Transport.Dial(ctx, raddr, p)
+}
+
+func TestDialLocalAddr(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	bt := new(bindingTransport)
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		bt.Transport = tpt
+		return bt
+	})
+	defer s.Close()
+
+	// only used for addresses of the same family.
+	s.SetDialLocalAddr(ma.StringCast("/ip6/::1/tcp/0"))
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s.DialPeer(ctx, target.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	s.ClosePeer(target.LocalPeer())
+
+	laddr := ma.StringCast("/ip4/127.0.0.1/tcp/0")
+	s.SetDialLocalAddr(laddr)
+	if _, err := s.DialPeer(ctx, target.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	bt.lk.Lock()
+	defer bt.lk.Unlock()
+	if len(bt.laddrs) != 1 || !bt.laddrs[0].Equal(laddr) {
+		t.Fatalf("expected one dial from %s, got %s", laddr, bt.laddrs)
+	}
+}
+
+// panickingTransport panics when dialing the given peer.
+type panickingTransport struct {
+	transport.Transport
+	bad peer.ID
+}
+
+func (pt *panickingTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.Conn, error) {
+	if p == pt.bad {
+		panic("boom")
+	}
+	return pt.Transport.Dial(ctx, raddr, p)
+}
+
+func TestRecoverTransportPanics(t *testing.T) {
+	ctx := context.Background()
+	targets := makeSwarms(ctx, t, 2)
+	defer closeSwarms(targets)
+	bad, good := targets[0], targets[1]
+
+	s := makeDialOnlySwarmWithTransport(ctx, t, func(tpt transport.Transport) transport.Transport {
+		return &panickingTransport{Transport: tpt, bad: bad.LocalPeer()}
+	})
+	defer s.Close()
+	s.SetRecoverTransportPanics(true)
+
+	s.Peerstore().AddAddrs(bad.LocalPeer(), bad.ListenAddresses(), pstore.PermanentAddrTTL)
+	s.Peerstore().AddAddrs(good.LocalPeer(), good.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s.DialPeer(ctx, bad.LocalPeer()); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if _, err := s.DialPeer(ctx, good.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// configuredTransport records the configuration it's given.
+type configuredTransport struct {
+	transport.Transport
+
+	lk   sync.Mutex
+	cfgs []TransportConfig
+}
+
+func (ct *configuredTransport) record(cfg TransportConfig) {
+	ct.lk.Lock()
+	defer ct.lk.Unlock()
+	ct.cfgs = append(ct.cfgs, cfg)
+}
+
+func (ct *configuredTransport) DialWithConfig(ctx context.Context, raddr ma.Multiaddr, p peer.ID, cfg TransportConfig) (transport.Conn, error) {
+	ct.record(cfg)
+	return ct.Transport.Dial(ctx, raddr, p)
+}
+
+func (ct *configuredTransport) ListenWithConfig(laddr ma.Multiaddr, cfg TransportConfig) (transport.Listener, error) {
+	ct.record(cfg)
+	return ct.Transport.Listen(laddr)
+}
+
+func TestTransportConfig(t *testing.T) {
+	ctx := context.Background()
+	target := makeSwarms(ctx, t, 1)[0]
+	defer target.Close()
+
+	p, err := testutil.RandPeerNetParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := pstoremem.NewPeerstore()
+	ps.AddPubKey(p.ID, p.PubKey)
+	ps.AddPrivKey(p.ID, p.PrivKey)
+	s := NewSwarm(ctx, p.ID, ps, nil)
+	defer s.Close()
+
+	cfg := TransportConfig{"reuseport": false}
+	ct := &configuredTransport{Transport: tcp.NewTCPTransport(swarmt.GenUpgrader(s))}
+	if err := s.AddTransportWithConfig(ct, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := s.TransportConfigFor(ct); !ok || got["reuseport"] != false {
+		t.Fatalf("expected the config to be stored, got %v", got)
+	}
+
+	if err := s.Listen(p.Addr); err != nil {
+		t.Fatal(err)
+	}
+	s.Peerstore().AddAddrs(target.LocalPeer(), target.ListenAddresses(), pstore.PermanentAddrTTL)
+	if _, err := s.DialPeer(ctx, target.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+
+	ct.lk.Lock()
+	defer ct.lk.Unlock()
+	if len(ct.cfgs) != 2 {
+		t.Fatalf("expected the config on listen and dial, got %v", ct.cfgs)
+	}
+	for _, c := range ct.cfgs {
+		if c["reuseport"] != false {
+			t.Fatalf("expected %v, got %v", cfg, c)
+		}
+	}
+}